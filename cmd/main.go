@@ -2,6 +2,9 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/junland/conveyor/server"
 	flag "github.com/spf13/pflag"
@@ -15,22 +18,45 @@ var GoVersion string
 
 // Default parameters when program starts without flags or environment variables.
 const (
-	defLvl          = "info"
-	defAccess       = true
-	defPort         = "8080"
-	defPID          = "/var/run/conveyor.pid"
-	defTLS          = false
-	defCert         = ""
-	defKey          = ""
-	defWorkers      = 2
-	defWorkersDir   = "./worker"
-	defWorkspaceDir = "./workspace"
+	defLvl                = "info"
+	defAccess             = true
+	defPort               = "8080"
+	defPID                = "/var/run/conveyor.pid"
+	defTLS                = false
+	defCert               = ""
+	defKey                = ""
+	defWorkers            = 2
+	defWorkersDir         = "./worker"
+	defWorkspaceDir       = "./workspace"
+	defDBFile             = "./conveyor.db"
+	defSecretsFile        = "./conveyor.secrets"
+	defEnvAllow           = "PATH,HOME,USER,LANG,LC_*,TZ,TMPDIR"
+	defJobTimeout         = 0
+	defHooksFile          = ""
+	defPollersFile        = ""
+	defArtifactsDir       = "./artifacts"
+	defArtifactRetention  = 30 * 24 * time.Hour
+	defCacheSize          = 5120
+	defWorkspaceCleanup   = "on_success"
+	defWorkspaceRetention = 24 * time.Hour
+	defSandboxMounts      = "/bin,/sbin,/usr,/lib,/lib64,/etc"
+	defCgroupDir          = ""
+	defImagesDir          = "./images"
+	defLimitCPUs          = 0
+	defLimitCPUTime       = 0
+	defLimitMemory        = 0
+	defLimitProcesses     = 0
+	defLimitOpenFiles     = 0
+	defLimitFileSize      = 0
 )
 
 var (
-	confLogLvl, confPort, confPID, confCert, confKey, confWorkersDir, confWorkspaceDir string
-	enableTLS, enableAccess, version, help                                             bool
-	confWorkers                                                                        int
+	confLogLvl, confPort, confPID, confCert, confKey, confWorkersDir, confWorkspaceDir, confDBFile, confSecretsFile, confHooksFile, confPollersFile, confArtifactsDir, confWorkspaceCleanup, confCgroupDir, confImagesDir string
+	enableTLS, enableAccess, version, help                                                                                                                                                                                bool
+	confWorkers, confCacheSize, confLimitProcesses, confLimitOpenFiles, confLimitMemory, confLimitFileSize                                                                                                                int
+	confLimitCPUs                                                                                                                                                                                                         float64
+	confEnvAllow, confSandboxMounts                                                                                                                                                                                       []string
+	confJobTimeout, confArtifactRetention, confWorkspaceRetention, confLimitCPUTime                                                                                                                                       time.Duration
 )
 
 // init defines configuration flags and environment variables.
@@ -46,6 +72,26 @@ func init() {
 	flags.StringVar(&confWorkspaceDir, "workspace-dir", GetEnvString("CONVEYOR_WORKSPACE_DIR", defWorkspaceDir), "Specify the working directory for builds.")
 	flags.IntVar(&confWorkers, "workers", GetEnvInt("CONVEYOR_WORKERS", defWorkers), "Specify amount of executors to process requests.")
 	flags.StringVar(&confWorkersDir, "workers-dir", GetEnvString("CONVEYOR_WORKERS_DIR", defWorkersDir), "Specify the working directory for builds.")
+	flags.StringVar(&confDBFile, "db-file", GetEnvString("CONVEYOR_DB_FILE", defDBFile), "Specify the database file that jobs are kept in.")
+	flags.StringVar(&confSecretsFile, "secrets-file", GetEnvString("CONVEYOR_SECRETS_FILE", defSecretsFile), "Specify the encrypted file that secrets are kept in, unlocked with CONVEYOR_SECRETS_KEY.")
+	flags.DurationVar(&confJobTimeout, "job-timeout", GetEnvDuration("CONVEYOR_JOB_TIMEOUT", defJobTimeout), "Specify how long jobs may run unless they set their own timeout, 0 for no limit.")
+	flags.StringVar(&confHooksFile, "hooks-file", GetEnvString("CONVEYOR_HOOKS_FILE", defHooksFile), "Specify the YAML file that webhooks are defined in.")
+	flags.StringVar(&confPollersFile, "pollers-file", GetEnvString("CONVEYOR_POLLERS_FILE", defPollersFile), "Specify the YAML file that polled repositories are defined in.")
+	flags.StringVar(&confArtifactsDir, "artifacts-dir", GetEnvString("CONVEYOR_ARTIFACTS_DIR", defArtifactsDir), "Specify the directory that job artifacts are kept in.")
+	flags.DurationVar(&confArtifactRetention, "artifact-retention", GetEnvDuration("CONVEYOR_ARTIFACT_RETENTION", defArtifactRetention), "Specify how long the artifacts of finished jobs are kept, 0 to keep them forever.")
+	flags.StringVar(&confWorkspaceCleanup, "workspace-cleanup", GetEnvString("CONVEYOR_WORKSPACE_CLEANUP", defWorkspaceCleanup), "Specify when the workspaces of finished jobs are removed: always, on_success or never.")
+	flags.DurationVar(&confWorkspaceRetention, "workspace-retention", GetEnvDuration("CONVEYOR_WORKSPACE_RETENTION", defWorkspaceRetention), "Specify how long workspaces that were kept are left around, 0 to keep them forever.")
+	flags.IntVar(&confCacheSize, "cache-size", GetEnvInt("CONVEYOR_CACHE_SIZE", defCacheSize), "Specify how many megabytes of job caches are kept, 0 for no limit.")
+	flags.StringSliceVar(&confEnvAllow, "env-allow", strings.Split(GetEnvString("CONVEYOR_ENV_ALLOW", defEnvAllow), ","), "Specify the server environment variables that are passed on to jobs.")
+	flags.StringSliceVar(&confSandboxMounts, "sandbox-mounts", strings.Split(GetEnvString("CONVEYOR_SANDBOX_MOUNTS", defSandboxMounts), ","), "Specify the host paths that are mounted read-only in job sandboxes.")
+	flags.StringVar(&confCgroupDir, "cgroup-dir", GetEnvString("CONVEYOR_CGROUP_DIR", defCgroupDir), "Specify a delegated cgroup v2 directory that jobs get cgroups of their own in.")
+	flags.Float64Var(&confLimitCPUs, "limit-cpus", GetEnvFloat("CONVEYOR_LIMIT_CPUS", defLimitCPUs), "Specify how many CPUs a job may use unless it sets its own limit, 0 for no limit.")
+	flags.DurationVar(&confLimitCPUTime, "limit-cpu-time", GetEnvDuration("CONVEYOR_LIMIT_CPU_TIME", defLimitCPUTime), "Specify how much CPU time every process of a job may use unless it sets its own limit, 0 for no limit.")
+	flags.IntVar(&confLimitMemory, "limit-memory", GetEnvInt("CONVEYOR_LIMIT_MEMORY", defLimitMemory), "Specify how many megabytes of memory a job may use unless it sets its own limit, 0 for no limit.")
+	flags.IntVar(&confLimitProcesses, "limit-processes", GetEnvInt("CONVEYOR_LIMIT_PROCESSES", defLimitProcesses), "Specify how many processes a job may run unless it sets its own limit, 0 for no limit.")
+	flags.IntVar(&confLimitOpenFiles, "limit-open-files", GetEnvInt("CONVEYOR_LIMIT_OPEN_FILES", defLimitOpenFiles), "Specify how many files every process of a job may open unless it sets its own limit, 0 for no limit.")
+	flags.IntVar(&confLimitFileSize, "limit-file-size", GetEnvInt("CONVEYOR_LIMIT_FILE_SIZE", defLimitFileSize), "Specify the largest file in megabytes a job may write unless it sets its own limit, 0 for no limit.")
+	flags.StringVar(&confImagesDir, "images-dir", GetEnvString("CONVEYOR_IMAGES_DIR", defImagesDir), "Specify the directory that the images jobs run in are loaded from.")
 	flags.BoolVarP(&help, "help", "h", false, "Show this help")
 	flags.BoolVar(&version, "version", false, "Display version information")
 	flags.SortFlags = false
@@ -58,6 +104,9 @@ func PrintHelp() {
 	fmt.Printf("\n")
 	fmt.Printf("A simple web app template.\n")
 	fmt.Printf("\n")
+	fmt.Printf("Commands:\n")
+	fmt.Printf("  secrets    Manage the secret file, see conveyor secrets.\n")
+	fmt.Printf("\n")
 	fmt.Printf("Options:\n")
 	flag.PrintDefaults()
 	fmt.Printf("\n")
@@ -74,16 +123,39 @@ func PrintVersion() {
 // Run is the entry point for starting the command line interface.
 func Run() {
 	config := server.Config{
-		LogLvl:       confLogLvl,
-		Access:       enableAccess,
-		Port:         confPort,
-		PID:          confPID,
-		TLS:          enableTLS,
-		Cert:         confCert,
-		Key:          confKey,
-		WorkspaceDir: confWorkspaceDir,
-		Workers:      confWorkers,
-		WorkersDir:   confWorkersDir,
+		LogLvl:             confLogLvl,
+		Access:             enableAccess,
+		Port:               confPort,
+		PID:                confPID,
+		TLS:                enableTLS,
+		Cert:               confCert,
+		Key:                confKey,
+		WorkspaceDir:       confWorkspaceDir,
+		Workers:            confWorkers,
+		WorkersDir:         confWorkersDir,
+		DBFile:             confDBFile,
+		SecretsFile:        confSecretsFile,
+		SecretsKey:         os.Getenv("CONVEYOR_SECRETS_KEY"),
+		EnvAllow:           confEnvAllow,
+		JobTimeout:         confJobTimeout,
+		HooksFile:          confHooksFile,
+		PollersFile:        confPollersFile,
+		ArtifactsDir:       confArtifactsDir,
+		ArtifactRetention:  confArtifactRetention,
+		CacheSize:          int64(confCacheSize) << 20,
+		WorkspaceCleanup:   confWorkspaceCleanup,
+		WorkspaceRetention: confWorkspaceRetention,
+		SandboxMounts:      confSandboxMounts,
+		CgroupDir:          confCgroupDir,
+		ImagesDir:          confImagesDir,
+		Limits: server.Limits{
+			CPUs:      confLimitCPUs,
+			CPUTime:   server.Duration(confLimitCPUTime),
+			Memory:    server.Size(confLimitMemory) << 20,
+			Processes: confLimitProcesses,
+			OpenFiles: confLimitOpenFiles,
+			FileSize:  server.Size(confLimitFileSize) << 20,
+		},
 	}
 
 	if version {
@@ -96,5 +168,13 @@ func Run() {
 		return
 	}
 
+	if flag.Arg(0) == "secrets" {
+		if err := runSecrets(config.SecretsFile, config.SecretsKey, flag.Args()[1:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, strings.TrimSpace(err.Error()))
+			os.Exit(1)
+		}
+		return
+	}
+
 	server.Start(config)
 }
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/junland/conveyor/server"
+)
+
+// secretsUsage explains the secrets command.
+const secretsUsage = `Usage: conveyor [options] secrets <command>
+
+Manages the secret file given by --secrets-file, unlocked with CONVEYOR_SECRETS_KEY.
+
+Commands:
+  list           List the names of all secrets.
+  set <name>     Store standard input as a secret.
+  remove <name>  Remove a secret.
+`
+
+// runSecrets runs the secrets command with its arguments, reading secret
+// values from in and writing what it has to say to out.
+func runSecrets(file, key string, args []string, in io.Reader, out io.Writer) error {
+	if key == "" {
+		return errors.New("CONVEYOR_SECRETS_KEY has to be set to manage secrets")
+	}
+	if len(args) == 0 {
+		return errors.New(secretsUsage)
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		names, err := server.SecretNames(file, key)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Fprintln(out, name)
+		}
+		return nil
+	case args[0] == "set" && len(args) == 2:
+		value, err := ioutil.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		// Values piped in from echo and the like end with a newline that is
+		// not part of the secret.
+		if err := server.SetSecret(file, key, args[1], strings.TrimSuffix(string(value), "\n")); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Stored secret %s\n", args[1])
+		return nil
+	case args[0] == "remove" && len(args) == 2:
+		ok, err := server.RemoveSecret(file, key, args[1])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("secret %s does not exist", args[1])
+		}
+		fmt.Fprintf(out, "Removed secret %s\n", args[1])
+		return nil
+	default:
+		return errors.New(secretsUsage)
+	}
+}
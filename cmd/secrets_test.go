@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "conveyor.secrets")
+
+	run := func(input string, args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runSecrets(file, "passphrase", args, strings.NewReader(input), &out)
+		return out.String(), err
+	}
+
+	if _, err := run("hunter2\n", "set", "DEPLOY_TOKEN"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("abc", "set", "API_KEY"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run("", "list"); err != nil || out != "API_KEY\nDEPLOY_TOKEN\n" {
+		t.Errorf("unexpected secret listing: %q %v", out, err)
+	}
+	if _, err := run("", "remove", "API_KEY"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("", "remove", "API_KEY"); err == nil {
+		t.Error("expected removing a missing secret to fail")
+	}
+	if out, _ := run("", "list"); out != "DEPLOY_TOKEN\n" {
+		t.Errorf("unexpected secret listing: %q", out)
+	}
+
+	for _, args := range [][]string{nil, {"get", "DEPLOY_TOKEN"}, {"set"}, {"set", "not-valid"}} {
+		if _, err := run("x", args...); err == nil {
+			t.Errorf("expected %v to fail", args)
+		}
+	}
+	if err := runSecrets(file, "", []string{"list"}, nil, ioutil.Discard); err == nil {
+		t.Error("expected secrets to be locked without a key")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 )
 
 // GetEnvString defines a environment variable with a specified name, fallback value.
@@ -21,8 +22,35 @@ func GetEnvInt(key string, fallback int) int {
 	if s := os.Getenv(key); s != "" {
 		i, err := strconv.Atoi(s)
 		if err == nil {
-			fmt.Println(i)
+			return i
 		}
+		fmt.Printf("Invalid value for %s, using %d\n", key, fallback)
+	}
+	return fallback
+}
+
+// GetEnvFloat defines a environment variable with a specified number (string such as "1.5"), fallback value.
+// The return is a float64 value.
+func GetEnvFloat(key string, fallback float64) float64 {
+	if s := os.Getenv(key); s != "" {
+		f, err := strconv.ParseFloat(s, 64)
+		if err == nil {
+			return f
+		}
+		fmt.Printf("Invalid value for %s, using %g\n", key, fallback)
+	}
+	return fallback
+}
+
+// GetEnvDuration defines a environment variable with a specified duration (string such as "1h30m"), fallback value.
+// The return is a time.Duration value.
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	if s := os.Getenv(key); s != "" {
+		d, err := time.ParseDuration(s)
+		if err == nil {
+			return d
+		}
+		fmt.Printf("Invalid value for %s, using %s\n", key, fallback)
 	}
 	return fallback
 }
@@ -3,6 +3,7 @@ package cmd
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 func TestGetEnvString(t *testing.T) {
@@ -19,6 +20,20 @@ func TestGetEnvString(t *testing.T) {
 	}
 }
 
+func TestGetEnvInt(t *testing.T) {
+	os.Setenv("TEST_INT", "4")
+	value := GetEnvInt("TEST_INT", 2)
+	if value != 4 {
+		t.Errorf("environment variable value is incorrect, got %d", value)
+	}
+
+	os.Setenv("TEST_INT", "four")
+	value = GetEnvInt("TEST_INT", 2)
+	if value != 2 {
+		t.Errorf("environment variable backup value is incorrect, got %d", value)
+	}
+}
+
 func TestGetEnvBool(t *testing.T) {
 	os.Setenv("TEST_BOOL", "true")
 	value := GetEnvBool("TEST_BOOL", false)
@@ -32,3 +47,31 @@ func TestGetEnvBool(t *testing.T) {
 		t.Errorf("environment variable backup value is incorrect, got %t", value)
 	}
 }
+
+func TestGetEnvDuration(t *testing.T) {
+	os.Setenv("TEST_DURATION", "1h30m")
+	value := GetEnvDuration("TEST_DURATION", time.Minute)
+	if value != 90*time.Minute {
+		t.Errorf("environment variable value is incorrect, got %s", value)
+	}
+
+	os.Setenv("TEST_DURATION", "soon")
+	value = GetEnvDuration("TEST_DURATION", time.Minute)
+	if value != time.Minute {
+		t.Errorf("environment variable backup value is incorrect, got %s", value)
+	}
+}
+
+func TestGetEnvFloat(t *testing.T) {
+	os.Setenv("TEST_FLOAT", "1.5")
+	value := GetEnvFloat("TEST_FLOAT", 2)
+	if value != 1.5 {
+		t.Errorf("environment variable value is incorrect, got %g", value)
+	}
+
+	os.Setenv("TEST_FLOAT", "lots")
+	value = GetEnvFloat("TEST_FLOAT", 2)
+	if value != 2 {
+		t.Errorf("environment variable backup value is incorrect, got %g", value)
+	}
+}
@@ -0,0 +1,555 @@
+// Package executor runs job scripts on a fixed set of workers.
+//
+// Every worker owns a queue and runs one task at a time. Lifecycle events of
+// tasks are reported back through a callback so the caller can keep track of
+// job state.
+package executor
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultShell is used to run a task script when the task does not specify a shell.
+const DefaultShell = "/bin/sh -e"
+
+// ErrNoWorker is returned when a task is submitted to a worker that does not exist.
+var ErrNoWorker = errors.New("no such worker")
+
+// ErrStopped is returned when a task is submitted after the pool has been stopped.
+var ErrStopped = errors.New("executor has been stopped")
+
+// Task describes a list of steps that should be run by a worker.
+type Task struct {
+	ID     string
+	Steps  []Step
+	Dir    string
+	Env    []string
+	Output io.Writer
+
+	// Timeout stops the task once it has been running for this long, zero
+	// means no timeout.
+	Timeout time.Duration
+
+	// Sandbox runs the steps of the task in a sandbox, nil runs them
+	// directly on the host.
+	Sandbox *Sandbox
+
+	// Limits are the resources the task may use, nil if it is not limited.
+	Limits *Limits
+
+	// Setup is called by the worker that picked up the task right before the
+	// first step is run. It can fill in anything that depends on the worker.
+	Setup func(t *Task, worker int) error
+}
+
+// Step is a single script of a task. Steps run one after another and a task
+// stops at the first step that fails.
+type Step struct {
+	Name   string
+	Script string
+	// Shell is the command the script is passed to, DefaultShell if empty.
+	Shell string
+	// Dir is the working directory of the step, relative to the task directory.
+	Dir string
+	// Env is added to the environment of the task.
+	Env []string
+}
+
+// EventType describes what happened to a task.
+type EventType int
+
+// Possible event types.
+const (
+	Started EventType = iota
+	Finished
+	StepStarted
+	StepFinished
+)
+
+// Event reports a change in the lifecycle of a task. Step is the index of the
+// step for step events.
+type Event struct {
+	Type   EventType
+	Task   *Task
+	Worker int
+	Step   int
+	Time   time.Time
+	Result *Result
+}
+
+// Result describes the outcome of a task. A task that ran into its timeout
+// is both cancelled and timed out.
+type Result struct {
+	ExitCode  int
+	Err       error
+	Cancelled bool
+	TimedOut  bool
+	Started   time.Time
+	Finished  time.Time
+	Duration  time.Duration
+	Usage     Usage
+}
+
+// run tracks a task that is being executed. pid and done belong to the
+// process of the current step.
+type run struct {
+	task      *Task
+	limits    *limitsSpec
+	pid       int
+	done      chan struct{}
+	cancelled bool
+	timedOut  bool
+	// timedOutAt is when the timeout of the task fired.
+	timedOutAt time.Time
+}
+
+// late reports whether the timeout of the run fired only after at, when the
+// steps it was meant to stop had already exited. The pool lock has to be
+// held.
+func (r *run) late(at time.Time) bool {
+	return r.timedOut && !at.IsZero() && r.timedOutAt.After(at)
+}
+
+// stop marks the run as cancelled and stops the process of the current step.
+// A step that has no process yet is stopped as soon as it starts. The pool
+// lock has to be held.
+func (r *run) stop(grace time.Duration) {
+	r.cancelled = true
+	if r.pid != 0 {
+		go terminate(r.pid, r.done, grace)
+	}
+}
+
+// worker owns a queue of tasks.
+type worker struct {
+	n       int
+	queue   []*Task
+	current *run
+	wake    chan struct{}
+}
+
+// Pool is a set of workers that run tasks.
+type Pool struct {
+	// KillGrace is how long a cancelled task has to exit after SIGTERM before it is sent SIGKILL.
+	KillGrace time.Duration
+
+	mu      sync.Mutex
+	workers []*worker
+	notify  func(Event)
+	stopped bool
+	wg      sync.WaitGroup
+
+	// cgroup is the directory task cgroups are created in, with the
+	// controllers that are enabled for them.
+	cgroup      string
+	controllers map[string]bool
+}
+
+// New creates a pool of n workers, numbered from 1 to n, and starts them.
+// notify is called for every task event and must not block for long.
+func New(n int, notify func(Event)) *Pool {
+	p := &Pool{KillGrace: 10 * time.Second, notify: notify}
+
+	for i := 1; i <= n; i++ {
+		w := &worker{n: i, wake: make(chan struct{}, 1)}
+		p.workers = append(p.workers, w)
+		p.wg.Add(1)
+		go p.loop(w)
+	}
+
+	return p
+}
+
+// Workers returns the number of workers in the pool.
+func (p *Pool) Workers() int {
+	return len(p.workers)
+}
+
+// Submit adds a task to the queue of worker n.
+func (p *Pool) Submit(n int, t *Task) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped {
+		return ErrStopped
+	}
+
+	if n < 1 || n > len(p.workers) {
+		return ErrNoWorker
+	}
+
+	p.workers[n-1].enqueue(t)
+
+	return nil
+}
+
+// Dispatch adds a task to the queue of the worker with the least amount of
+// queued and running tasks and returns the number of that worker.
+func (p *Pool) Dispatch(t *Task) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped {
+		return 0, ErrStopped
+	}
+
+	var least *worker
+	for _, w := range p.workers {
+		if least == nil || w.load() < least.load() {
+			least = w
+		}
+	}
+
+	if least == nil {
+		return 0, ErrNoWorker
+	}
+
+	least.enqueue(t)
+
+	return least.n, nil
+}
+
+// Len returns the number of tasks that are queued or running on worker n.
+func (p *Pool) Len(n int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n < 1 || n > len(p.workers) {
+		return 0
+	}
+
+	return p.workers[n-1].load()
+}
+
+// enqueue adds a task to the end of the worker's queue and wakes it up.
+// The pool lock has to be held.
+func (w *worker) enqueue(t *Task) {
+	w.queue = append(w.queue, t)
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// load returns the number of tasks that are queued or running on the worker.
+// The pool lock has to be held.
+func (w *worker) load() int {
+	l := len(w.queue)
+	if w.current != nil {
+		l++
+	}
+	return l
+}
+
+// Cancel removes a queued task or stops a running one. A cancelled task is
+// reported as finished with Cancelled set. It returns false if the task is
+// not known to the pool.
+func (p *Pool) Cancel(id string) bool {
+	p.mu.Lock()
+
+	for _, w := range p.workers {
+		for i, t := range w.queue {
+			if t.ID != id {
+				continue
+			}
+			w.queue = append(w.queue[:i], w.queue[i+1:]...)
+			p.mu.Unlock()
+
+			now := time.Now()
+			p.emit(Event{Type: Finished, Task: t, Worker: w.n, Time: now, Result: &Result{ExitCode: -1, Cancelled: true, Finished: now}})
+			return true
+		}
+
+		if w.current != nil && w.current.task.ID == id {
+			w.current.stop(p.KillGrace)
+			p.mu.Unlock()
+			return true
+		}
+	}
+
+	p.mu.Unlock()
+	return false
+}
+
+// Stop drops all queued tasks, stops running tasks and waits for the workers to exit.
+func (p *Pool) Stop() {
+	p.mu.Lock()
+	p.stopped = true
+	for _, w := range p.workers {
+		w.queue = nil
+		if w.current != nil {
+			w.current.stop(p.KillGrace)
+		}
+		close(w.wake)
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+// loop runs the tasks queued on a worker one after another.
+func (p *Pool) loop(w *worker) {
+	defer p.wg.Done()
+
+	for {
+		p.mu.Lock()
+		if p.stopped {
+			p.mu.Unlock()
+			return
+		}
+		if len(w.queue) == 0 {
+			p.mu.Unlock()
+			if _, ok := <-w.wake; !ok {
+				return
+			}
+			continue
+		}
+		t := w.queue[0]
+		w.queue = w.queue[1:]
+		r := &run{task: t}
+		w.current = r
+		p.mu.Unlock()
+
+		p.execute(w, r)
+
+		p.mu.Lock()
+		w.current = nil
+		p.mu.Unlock()
+	}
+}
+
+// execute runs the steps of a task and reports its events.
+func (p *Pool) execute(w *worker, r *run) {
+	t := r.task
+
+	res := &Result{Started: time.Now()}
+
+	if t.Setup != nil {
+		if err := t.Setup(t, w.n); err != nil {
+			res.ExitCode = -1
+			res.Err = err
+			res.Finished = time.Now()
+			p.emit(Event{Type: Finished, Task: t, Worker: w.n, Time: res.Finished, Result: res})
+			return
+		}
+	}
+
+	spec, err := p.limits(t)
+	if err != nil {
+		res.ExitCode = -1
+		res.Err = err
+		res.Finished = time.Now()
+		p.emit(Event{Type: Finished, Task: t, Worker: w.n, Time: res.Finished, Result: res})
+		return
+	}
+	r.limits = spec
+
+	log.Debugf("Worker %d starting task %s", w.n, t.ID)
+
+	p.emit(Event{Type: Started, Task: t, Worker: w.n, Time: res.Started})
+
+	var timer *time.Timer
+	if t.Timeout > 0 {
+		timer = time.AfterFunc(t.Timeout, func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if !r.cancelled {
+				log.Warnf("Task %s timed out after %s", t.ID, t.Timeout)
+				r.timedOut = true
+				r.timedOutAt = time.Now()
+				r.stop(p.KillGrace)
+			}
+		})
+	}
+
+	// ended is when the last step that was run exited, if the steps came to
+	// an end by themselves rather than being cancelled.
+	var ended time.Time
+	for i := range t.Steps {
+		p.mu.Lock()
+		cancelled := r.cancelled
+		p.mu.Unlock()
+
+		if cancelled {
+			break
+		}
+
+		sr := p.step(w, r, i)
+		if sr.Usage.PeakMemory > res.Usage.PeakMemory {
+			res.Usage.PeakMemory = sr.Usage.PeakMemory
+		}
+		res.Usage.CPUTime += sr.Usage.CPUTime
+		if i == len(t.Steps)-1 || sr.Err != nil || sr.ExitCode != 0 {
+			ended = sr.Finished
+		}
+		if sr.Err != nil || sr.ExitCode != 0 {
+			res.ExitCode = sr.ExitCode
+			res.Err = sr.Err
+			break
+		}
+	}
+
+	// A timeout that fires after the last step exited did not stop anything,
+	// so it does not count.
+	if timer != nil {
+		timer.Stop()
+	}
+
+	// The cgroup of the task also knows about processes that were not
+	// waited for.
+	if spec != nil && spec.Cgroup != "" {
+		closeCgroup(spec.Cgroup, &res.Usage)
+	}
+
+	res.Finished = time.Now()
+	res.Duration = res.Finished.Sub(res.Started)
+
+	p.mu.Lock()
+	late := r.late(ended)
+	res.Cancelled = r.cancelled && !late
+	res.TimedOut = r.timedOut && !late
+	p.mu.Unlock()
+
+	if res.Cancelled && res.ExitCode == 0 {
+		res.ExitCode = -1
+	}
+
+	log.Debugf("Worker %d finished task %s with exit code %d", w.n, t.ID, res.ExitCode)
+
+	p.emit(Event{Type: Finished, Task: t, Worker: w.n, Time: res.Finished, Result: res})
+}
+
+// step runs a single step of a task and reports its events.
+func (p *Pool) step(w *worker, r *run, i int) *Result {
+	t := r.task
+	s := t.Steps[i]
+
+	shell := s.Shell
+	if shell == "" {
+		shell = DefaultShell
+	}
+	args := append(strings.Fields(shell), s.Script)
+
+	dir := s.Dir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(t.Dir, dir)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	if t.Sandbox != nil && t.Sandbox.Image != "" {
+		// The shell is looked up in the image rather than on the host.
+		cmd = &exec.Cmd{Path: args[0], Args: args}
+	}
+	cmd.Dir = dir
+	cmd.Env = append(append([]string{}, t.Env...), s.Env...)
+	cmd.Stdout = t.Output
+	cmd.Stderr = t.Output
+
+	// Run the step in its own process group so it can be stopped as a whole.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	res := &Result{Started: time.Now()}
+
+	p.emit(Event{Type: StepStarted, Task: t, Worker: w.n, Step: i, Time: res.Started})
+
+	var err error
+	if t.Sandbox != nil {
+		var release func()
+		if release, err = sandbox(cmd, t.Sandbox, t.Dir); err == nil {
+			defer release()
+		}
+	}
+	if err == nil && r.limits != nil {
+		err = limit(cmd, r.limits)
+	}
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		res.ExitCode = -1
+		res.Err = err
+		res.Finished = time.Now()
+		p.emit(Event{Type: StepFinished, Task: t, Worker: w.n, Step: i, Time: res.Finished, Result: res})
+		return res
+	}
+
+	done := make(chan struct{})
+
+	p.mu.Lock()
+	r.pid = cmd.Process.Pid
+	r.done = done
+	if r.cancelled {
+		// The task was cancelled while the step was being started.
+		r.stop(p.KillGrace)
+	}
+	p.mu.Unlock()
+
+	err = cmd.Wait()
+	res.Finished = time.Now()
+	close(done)
+
+	p.mu.Lock()
+	r.pid = 0
+	late := r.late(res.Finished)
+	res.Cancelled = r.cancelled && !late
+	res.TimedOut = r.timedOut && !late
+	p.mu.Unlock()
+
+	res.Duration = res.Finished.Sub(res.Started)
+	res.ExitCode = cmd.ProcessState.ExitCode()
+	res.Usage = processUsage(cmd.ProcessState)
+	if _, ok := err.(*exec.ExitError); !ok && err != nil {
+		res.Err = err
+	}
+
+	p.emit(Event{Type: StepFinished, Task: t, Worker: w.n, Step: i, Time: res.Finished, Result: res})
+
+	return res
+}
+
+// emit reports an event to the pool's callback.
+func (p *Pool) emit(ev Event) {
+	if p.notify != nil {
+		p.notify(ev)
+	}
+}
+
+// terminate sends SIGTERM to the process group pid and follows up with
+// SIGKILL if it has not exited within the grace period. Processes that are
+// left in the group after the leader exited are waited for as well.
+func terminate(pid int, done <-chan struct{}, grace time.Duration) {
+	log.Infof("Sending SIGTERM to process group %d", pid)
+	if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil {
+		log.Warnf("Could not signal process group %d: %s", pid, err)
+	}
+
+	deadline := time.After(grace)
+
+	select {
+	case <-done:
+	case <-deadline:
+		log.Warnf("Process group %d did not exit in time, sending SIGKILL", pid)
+		syscall.Kill(-pid, syscall.SIGKILL)
+		return
+	}
+
+	for syscall.Kill(-pid, 0) == nil {
+		select {
+		case <-deadline:
+			log.Warnf("Processes of group %d are still running, sending SIGKILL", pid)
+			syscall.Kill(-pid, syscall.SIGKILL)
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package executor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects the events reported by a pool.
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+	done   chan Event
+}
+
+func newRecorder() *recorder {
+	return &recorder{done: make(chan Event, 16)}
+}
+
+func (r *recorder) notify(ev Event) {
+	r.mu.Lock()
+	r.events = append(r.events, ev)
+	r.mu.Unlock()
+	if ev.Type == Finished {
+		r.done <- ev
+	}
+}
+
+// wait returns the next finished event.
+func (r *recorder) wait(t *testing.T) Event {
+	select {
+	case ev := <-r.done:
+		return ev
+	case <-time.After(10 * time.Second):
+		t.Fatal("task did not finish in time")
+	}
+	return Event{}
+}
+
+// writeScript writes a script to a temporary directory and returns its path.
+func writeScript(t *testing.T, dir, name, body string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(body), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPoolRunsTask(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := newRecorder()
+	pool := New(1, rec.notify)
+	defer pool.Stop()
+
+	var out bytes.Buffer
+	task := &Task{
+		ID:     "one",
+		Steps:  []Step{{Script: writeScript(t, dir, "one.qscript", "echo $GREETING\nexit 4\necho unreachable\n")}},
+		Dir:    dir,
+		Env:    []string{"GREETING=hello"},
+		Output: &out,
+	}
+
+	if err := pool.Submit(1, task); err != nil {
+		t.Fatal(err)
+	}
+
+	ev := rec.wait(t)
+
+	if ev.Result.ExitCode != 4 || ev.Result.Err != nil || ev.Result.Cancelled {
+		t.Errorf("unexpected result: %+v", ev.Result)
+	}
+
+	if out.String() != "hello\n" {
+		t.Errorf("unexpected output: got %q want %q", out.String(), "hello\n")
+	}
+
+	if rec.events[0].Type != Started || rec.events[0].Worker != 1 {
+		t.Errorf("task was not reported as started: %+v", rec.events[0])
+	}
+}
+
+func TestPoolMissingShell(t *testing.T) {
+	rec := newRecorder()
+	pool := New(1, rec.notify)
+	defer pool.Stop()
+
+	if err := pool.Submit(1, &Task{ID: "one", Steps: []Step{{Script: "/nonexistent", Shell: "/nonexistent/sh"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ev := rec.wait(t)
+
+	if ev.Result.Err == nil || ev.Result.ExitCode != -1 {
+		t.Errorf("expected an executor error: %+v", ev.Result)
+	}
+}
+
+func TestPoolSubmitUnknownWorker(t *testing.T) {
+	pool := New(2, nil)
+	defer pool.Stop()
+
+	if err := pool.Submit(3, &Task{ID: "one"}); err != ErrNoWorker {
+		t.Errorf("unexpected error: got %v want %v", err, ErrNoWorker)
+	}
+}
+
+func TestPoolCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := newRecorder()
+	pool := New(1, rec.notify)
+	pool.KillGrace = 100 * time.Millisecond
+	defer pool.Stop()
+
+	script := writeScript(t, dir, "sleep.qscript", "trap '' TERM\nsleep 30 & wait\n")
+
+	pool.Submit(1, &Task{ID: "running", Steps: []Step{{Script: script}}, Dir: dir})
+	pool.Submit(1, &Task{ID: "queued", Steps: []Step{{Script: script}}, Dir: dir})
+
+	if l := pool.Len(1); l != 2 {
+		t.Errorf("unexpected queue length: got %d want 2", l)
+	}
+
+	// Removing a queued task reports it right away.
+	if !pool.Cancel("queued") {
+		t.Fatal("queued task was not found")
+	}
+
+	ev := rec.wait(t)
+	if ev.Task.ID != "queued" || !ev.Result.Cancelled {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+
+	// Wait for the other task to be started before stopping it.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		started := false
+		rec.mu.Lock()
+		for _, ev := range rec.events {
+			started = started || ev.Type == Started
+		}
+		rec.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !pool.Cancel("running") {
+		t.Fatal("running task was not found")
+	}
+
+	ev = rec.wait(t)
+	if ev.Task.ID != "running" || !ev.Result.Cancelled {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+
+	if pool.Cancel("missing") {
+		t.Error("unknown task should not be cancelled")
+	}
+}
+
+func TestPoolDispatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pool := New(3, nil)
+	pool.KillGrace = 100 * time.Millisecond
+	defer pool.Stop()
+
+	script := writeScript(t, dir, "sleep.qscript", "sleep 30\n")
+
+	// Every worker gets a task before any worker gets a second one.
+	for i, want := range []int{1, 2, 3, 1, 2} {
+		n, err := pool.Dispatch(&Task{ID: string(rune('a' + i)), Steps: []Step{{Script: script}}, Dir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("task %d was dispatched to worker %d, want %d", i, n, want)
+		}
+	}
+
+	// Once the queue of a worker shrinks it is preferred again.
+	pool.Cancel("a")
+	pool.Cancel("d")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Len(1) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n, _ := pool.Dispatch(&Task{ID: "f", Steps: []Step{{Script: script}}, Dir: dir}); n != 1 {
+		t.Errorf("task was dispatched to worker %d, want 1", n)
+	}
+}
+
+func TestPoolSetup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := newRecorder()
+	pool := New(2, rec.notify)
+	defer pool.Stop()
+
+	var out bytes.Buffer
+	task := &Task{
+		ID:     "one",
+		Output: &out,
+		Setup: func(t *Task, worker int) error {
+			script := filepath.Join(dir, "one.qscript")
+			t.Steps = []Step{{Script: script}}
+			t.Env = []string{"WORKER=" + string(rune('0'+worker))}
+			return ioutil.WriteFile(script, []byte("echo worker $WORKER\n"), 0700)
+		},
+	}
+
+	if _, err := pool.Dispatch(task); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev := rec.wait(t); ev.Result.ExitCode != 0 {
+		t.Errorf("unexpected result: %+v", ev.Result)
+	}
+
+	if out.String() != "worker 1\n" {
+		t.Errorf("unexpected output: got %q want %q", out.String(), "worker 1\n")
+	}
+}
+
+func TestPoolSteps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := newRecorder()
+	pool := New(1, rec.notify)
+	defer pool.Stop()
+
+	var out bytes.Buffer
+	task := &Task{
+		ID:  "one",
+		Dir: dir,
+		Env: []string{"GREETING=hello"},
+		Steps: []Step{
+			{Name: "first", Script: writeScript(t, dir, "first.qscript", "echo $GREETING $NAME\n"), Env: []string{"NAME=first"}},
+			{Name: "second", Script: writeScript(t, dir, "second.qscript", "basename $(pwd)\nexit 2\n"), Dir: "sub"},
+			{Name: "third", Script: writeScript(t, dir, "third.qscript", "echo unreachable\n")},
+		},
+		Output: &out,
+	}
+
+	if err := pool.Submit(1, task); err != nil {
+		t.Fatal(err)
+	}
+
+	ev := rec.wait(t)
+
+	if ev.Result.ExitCode != 2 {
+		t.Errorf("task did not fail with the exit code of the failing step: %+v", ev.Result)
+	}
+
+	if out.String() != "hello first\nsub\n" {
+		t.Errorf("unexpected output: got %q want %q", out.String(), "hello first\nsub\n")
+	}
+
+	var steps []string
+	for _, ev := range rec.events {
+		switch ev.Type {
+		case StepStarted:
+			steps = append(steps, "start "+task.Steps[ev.Step].Name)
+		case StepFinished:
+			steps = append(steps, "finish "+task.Steps[ev.Step].Name)
+		}
+	}
+
+	if got := strings.Join(steps, ", "); got != "start first, finish first, start second, finish second" {
+		t.Errorf("unexpected step events: %s", got)
+	}
+}
+
+func TestPoolTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := newRecorder()
+	pool := New(1, rec.notify)
+	pool.KillGrace = 100 * time.Millisecond
+	defer pool.Stop()
+
+	// The script leaves a child behind that ignores SIGTERM.
+	script := writeScript(t, dir, "hang.qscript", "sh -c \"trap '' TERM; sleep 30\" &\necho $! > child.pid\nwait\n")
+
+	started := time.Now()
+	pool.Submit(1, &Task{ID: "hang", Steps: []Step{{Script: script}}, Dir: dir, Timeout: 200 * time.Millisecond})
+
+	ev := rec.wait(t)
+	if !ev.Result.TimedOut || !ev.Result.Cancelled {
+		t.Errorf("task did not time out: %+v", ev.Result)
+	}
+
+	if d := time.Since(started); d > 5*time.Second {
+		t.Errorf("task took too long to be stopped: %s", d)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "child.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The whole process group is gone, including the child. Orphans are not
+	// always reaped right away, so zombies count as gone too.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stat, err := ioutil.ReadFile("/proc/" + strings.TrimSpace(string(b)) + "/stat")
+		if os.IsNotExist(err) || strings.Contains(string(stat), ") Z ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("child process %s is still running", strings.TrimSpace(string(b)))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPoolTimeoutAfterSteps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Holding up the worker after the step exited lets the timeout fire
+	// before the task is finished.
+	rec := newRecorder()
+	pool := New(1, func(ev Event) {
+		if ev.Type == StepFinished {
+			time.Sleep(300 * time.Millisecond)
+		}
+		rec.notify(ev)
+	})
+	defer pool.Stop()
+
+	script := writeScript(t, dir, "quick.qscript", "true\n")
+	pool.Submit(1, &Task{ID: "quick", Steps: []Step{{Script: script}}, Dir: dir, Timeout: 100 * time.Millisecond})
+
+	ev := rec.wait(t)
+	if ev.Result.TimedOut || ev.Result.Cancelled || ev.Result.ExitCode != 0 {
+		t.Errorf("task that finished in time was reported as timed out: %+v", ev.Result)
+	}
+}
@@ -0,0 +1,220 @@
+package executor
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// whiteoutPrefix marks a file of a layer that removes the file of the
+	// same name from the layers below it.
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque marks a directory of a layer that hides the contents of
+	// the directory in the layers below it.
+	whiteoutOpaque = ".wh..wh..opq"
+	// maxLinks is how many symbolic links are followed to resolve a path.
+	maxLinks = 255
+)
+
+// rootPath returns where path is below root when root is the root directory,
+// following symbolic links the way they would be followed in it. The path it
+// returns is always below root, whatever the links point to.
+func rootPath(root, path string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(path, "/")
+	links := 0
+
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			// Paths that do not exist yet are made where they are asked for.
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxLinks {
+			return "", fmt.Errorf("too many links in %s", path)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(link, "/"), parts...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// ExtractLayer unpacks a layer of an image, a tarball that may be compressed
+// with gzip, onto the root filesystem in root. Files removed by the layer are
+// removed from root and nothing it contains can end up outside of root.
+// Files keep their permissions but not their owners, device nodes and named
+// pipes are skipped.
+func ExtractLayer(root string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	// Opaque directories only hide what the layers below have put in them.
+	added := map[string]bool{}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		dir, base := filepath.Split(name)
+
+		parent, err := rootPath(root, dir)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case base == whiteoutOpaque:
+			if err := removeChildren(parent, added); err != nil {
+				return err
+			}
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			base = strings.TrimPrefix(base, whiteoutPrefix)
+			if base == "" || base == "." || base == ".." {
+				return fmt.Errorf("invalid whiteout %s", hdr.Name)
+			}
+			if err := os.RemoveAll(filepath.Join(parent, base)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		target := filepath.Join(parent, base)
+		added[target] = true
+
+		mode := hdr.FileInfo().Mode()
+		if info, err := os.Lstat(target); err == nil && !(info.IsDir() && mode.IsDir()) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// Directories stay writable so that later layers can change them
+			// and the root filesystem can be removed.
+			if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+				return err
+			}
+			err = os.Chmod(target, mode&(os.ModePerm|os.ModeSticky)|0700)
+		case tar.TypeReg:
+			err = writeFile(target, tr, mode&os.ModePerm)
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, target)
+		case tar.TypeLink:
+			err = linkFile(root, hdr.Linkname, target)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// removeChildren removes everything in dir that was not added by the layer
+// being extracted.
+func removeChildren(dir string, added map[string]bool) error {
+	names, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range names {
+		path := filepath.Join(dir, info.Name())
+		if added[path] {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile creates a file with the contents of r. Set-user-ID and
+// set-group-ID bits are never kept.
+func writeFile(path string, r io.Reader, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(path, perm)
+}
+
+// linkFile makes target a hard link to the file name of the root filesystem.
+func linkFile(root, name, target string) error {
+	name = filepath.Clean("/" + name)
+	dir, base := filepath.Split(name)
+	parent, err := rootPath(root, dir)
+	if err != nil {
+		return err
+	}
+
+	source := filepath.Join(parent, base)
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errors.New("cannot link to directory " + name)
+	}
+	return os.Link(source, target)
+}
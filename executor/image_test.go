@@ -0,0 +1,158 @@
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// layerEntry is a file of a test layer. Directories end with a slash,
+// symbolic links start their body with "->" and hard links with "=>".
+type layerEntry struct {
+	name, body string
+}
+
+func writeLayer(t *testing.T, entries ...layerEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+		switch {
+		case strings.HasSuffix(e.name, "/"):
+			hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeDir, 0555, 0
+		case strings.HasPrefix(e.body, "->"):
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.body[2:], 0
+		case strings.HasPrefix(e.body, "=>"):
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, e.body[2:], 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(e.body))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// listRoot returns the files below root with the contents of regular files
+// and the targets of links.
+func listRoot(t *testing.T, root string) []string {
+	var files []string
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := strings.TrimPrefix(path, root)
+		switch {
+		case name == "":
+		case info.IsDir():
+			files = append(files, name+"/")
+		case info.Mode()&os.ModeSymlink != 0:
+			link, _ := os.Readlink(path)
+			files = append(files, name+" -> "+link)
+		default:
+			b, _ := ioutil.ReadFile(path)
+			files = append(files, name+" "+string(b))
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+func TestExtractLayer(t *testing.T) {
+	root, err := ioutil.TempDir("", "executor-layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	base := writeLayer(t,
+		layerEntry{"etc/", ""},
+		layerEntry{"etc/conf", "base"},
+		layerEntry{"etc/old", "base"},
+		layerEntry{"lib/", ""},
+		layerEntry{"lib/a", "base"},
+		layerEntry{"lib/b", "base"},
+		layerEntry{"link", "->/etc/conf"},
+	)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(writeLayer(t,
+		layerEntry{"etc/.wh.old", ""},
+		layerEntry{"lib/c", "top"},
+		layerEntry{"lib/.wh..wh..opq", ""},
+		layerEntry{"lib/d", "top"},
+		layerEntry{"hard", "=>/etc/conf"},
+		layerEntry{".wh.link", ""},
+	).Bytes())
+	w.Close()
+
+	if err := ExtractLayer(root, base); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExtractLayer(root, &gz); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"/etc/", "/etc/conf base", "/hard base", "/lib/", "/lib/c top", "/lib/d top"}
+	if got := listRoot(t, root); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	// Directories keep their permissions, but stay writable.
+	info, err := os.Stat(filepath.Join(root, "lib"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("expected lib to have mode 0755, got %v", info.Mode())
+	}
+}
+
+func TestExtractLayerOutside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor-layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	os.Mkdir(root, 0755)
+
+	layer := writeLayer(t,
+		layerEntry{"../escape", "dots"},
+		layerEntry{"up", "->../.."},
+		layerEntry{"up/through-relative", "relative"},
+		layerEntry{"abs", "->/"},
+		layerEntry{"abs/through-absolute", "absolute"},
+	)
+	if err := ExtractLayer(root, layer); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"/abs -> /", "/escape dots", "/through-absolute absolute", "/through-relative relative", "/up -> ../.."}
+	if got := listRoot(t, root); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "escape")); err == nil {
+		t.Error("expected nothing to be written outside of the root")
+	}
+
+	// Hard links cannot point outside of the root either.
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0600)
+	if err := ExtractLayer(root, writeLayer(t, layerEntry{"hard", "=>../secret"})); err == nil {
+		t.Error("expected a hard link to a file outside of the root to fail")
+	}
+}
@@ -0,0 +1,46 @@
+package executor
+
+import "time"
+
+// Limits are the resources a task may use, zero means no limit. Limits are
+// enforced by the cgroup of the task where the pool has cgroups and its
+// controller is available, and with rlimits otherwise.
+type Limits struct {
+	// CPUs is how many CPUs worth of time the task gets. It can only be
+	// enforced with the cpu controller.
+	CPUs float64
+	// CPUTime is how much CPU time every process of the task may use.
+	CPUTime time.Duration
+	// Memory is the number of bytes the task may use. Without the memory
+	// controller it limits the data segment of every process.
+	Memory int64
+	// Processes is how many processes the task may run at once. Without the
+	// pids controller it limits the processes of the user running the task.
+	Processes int
+	// OpenFiles is how many files every process of the task may have open.
+	OpenFiles int
+	// FileSize is the size of the largest file the task may write.
+	FileSize int64
+}
+
+// Usage describes the resources a step or task used.
+type Usage struct {
+	// PeakMemory is the largest number of bytes in use at once.
+	PeakMemory int64
+	// CPUTime is the CPU time used by all processes.
+	CPUTime time.Duration
+}
+
+// limitsSpec tells a process how to limit itself before it runs the command
+// of a step.
+type limitsSpec struct {
+	// Cgroup is the cgroup of the task, empty if it has none.
+	Cgroup  string   `json:"cgroup,omitempty"`
+	Rlimits []rlimit `json:"rlimits,omitempty"`
+}
+
+// rlimit is a resource limit set with setrlimit(2).
+type rlimit struct {
+	Resource int    `json:"resource"`
+	Value    uint64 `json:"value"`
+}
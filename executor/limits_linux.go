@@ -0,0 +1,345 @@
+//go:build linux
+// +build linux
+
+package executor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// limitsInit is the name the executor runs itself as to limit a step.
+	limitsInit = "conveyor-limits-init"
+	// rlimitNproc is missing from the syscall package.
+	rlimitNproc = 6
+	// cpuPeriod is the period in microseconds CPU limits are enforced over.
+	cpuPeriod = 100000
+)
+
+// cgroupControllers are the controllers the pool enables for task cgroups.
+var cgroupControllers = []string{"cpu", "memory", "pids"}
+
+// The executor runs itself to join the cgroup of a task and set its rlimits
+// before it runs the command of a step, see sandbox_linux.go.
+func init() {
+	if len(os.Args) > 2 && os.Args[0] == limitsInit {
+		os.Exit(runLimitsInit(os.Args[1], os.Args[2], os.Args[3:]))
+	}
+}
+
+// UseCgroup gives every task a cgroup of its own below dir, which has to be a
+// cgroup v2 directory that is delegated to the server. Limits that have a
+// controller enabled for dir are enforced by the cgroup, and the usage of the
+// task is read from it.
+func (p *Pool) UseCgroup(dir string) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("%s is not a cgroup v2 directory: %s", dir, err)
+	}
+	available := strings.Fields(string(b))
+
+	// Controllers can only be enabled below a cgroup that has no processes,
+	// so the server moves into a cgroup of its own if it is in dir.
+	procs, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	pid := strconv.Itoa(os.Getpid())
+	for _, proc := range strings.Fields(string(procs)) {
+		if proc != pid {
+			continue
+		}
+		server := filepath.Join(dir, "server")
+		if err := os.Mkdir(server, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(server, "cgroup.procs"), []byte(pid), 0644); err != nil {
+			return fmt.Errorf("could not move the server out of %s: %s", dir, err)
+		}
+	}
+
+	controllers := make(map[string]bool)
+	for _, c := range cgroupControllers {
+		if !contains(available, c) {
+			log.Warnf("The %s controller is not available in %s, its limits are enforced with rlimits if possible", c, dir)
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+c), 0644); err != nil {
+			log.Warnf("Could not enable the %s controller in %s: %s", c, dir, err)
+			continue
+		}
+		controllers[c] = true
+	}
+
+	// Cgroups of tasks that were running when the server stopped are left
+	// behind.
+	entries, _ := ioutil.ReadDir(dir)
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), "task-") {
+			if err := removeCgroup(filepath.Join(dir, e.Name())); err != nil {
+				log.Warnf("Could not remove cgroup %s: %s", e.Name(), err)
+			}
+		}
+	}
+
+	p.mu.Lock()
+	p.cgroup = dir
+	p.controllers = controllers
+	p.mu.Unlock()
+
+	return nil
+}
+
+// limits prepares the limits of a task: its cgroup, if the pool has cgroups,
+// and the rlimits for the limits the cgroup cannot enforce. It returns nil if
+// there is nothing to limit.
+func (p *Pool) limits(t *Task) (*limitsSpec, error) {
+	p.mu.Lock()
+	root, controllers := p.cgroup, p.controllers
+	p.mu.Unlock()
+
+	l := t.Limits
+	if l == nil {
+		l = &Limits{}
+	}
+
+	spec := &limitsSpec{}
+	applied := make(map[string]bool)
+
+	if root != "" {
+		dir := filepath.Join(root, "task-"+t.ID)
+		if err := newCgroup(dir); err != nil {
+			log.Warnf("Could not create a cgroup for task %s: %s", t.ID, err)
+		} else {
+			spec.Cgroup = dir
+			for c, v := range cgroupLimits(l) {
+				if !controllers[c] || v == "" {
+					continue
+				}
+				file := filepath.Join(dir, c+".max")
+				if err := ioutil.WriteFile(file, []byte(v), 0644); err != nil {
+					log.Warnf("Could not set %s of task %s: %s", filepath.Base(file), t.ID, err)
+					continue
+				}
+				applied[c] = true
+			}
+			if applied["memory"] {
+				// Without this the memory limit is only a limit on the
+				// memory that is not swapped out.
+				ioutil.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0644)
+			}
+		}
+	}
+
+	if l.CPUs > 0 && !applied["cpu"] {
+		log.Warnf("The CPU limit of task %s is not enforced without the cpu controller", t.ID)
+	}
+
+	spec.Rlimits = rlimits(l, applied)
+
+	if spec.Cgroup == "" && len(spec.Rlimits) == 0 {
+		return nil, nil
+	}
+	return spec, nil
+}
+
+// cgroupLimits returns the values of the limit files of the controllers, an
+// empty value for limits that are not set.
+func cgroupLimits(l *Limits) map[string]string {
+	limits := map[string]string{"cpu": "", "memory": "", "pids": ""}
+	if l.CPUs > 0 {
+		quota := int64(math.Ceil(l.CPUs * cpuPeriod))
+		if quota < 1000 {
+			quota = 1000
+		}
+		limits["cpu"] = fmt.Sprintf("%d %d", quota, cpuPeriod)
+	}
+	if l.Memory > 0 {
+		limits["memory"] = strconv.FormatInt(l.Memory, 10)
+	}
+	if l.Processes > 0 {
+		limits["pids"] = strconv.Itoa(l.Processes)
+	}
+	return limits
+}
+
+// rlimits returns the rlimits for the limits that are not applied by a
+// controller.
+func rlimits(l *Limits, applied map[string]bool) []rlimit {
+	var rls []rlimit
+	if l.CPUTime > 0 {
+		rls = append(rls, rlimit{syscall.RLIMIT_CPU, uint64(math.Ceil(l.CPUTime.Seconds()))})
+	}
+	if l.Memory > 0 && !applied["memory"] {
+		rls = append(rls, rlimit{syscall.RLIMIT_DATA, uint64(l.Memory)})
+	}
+	if l.Processes > 0 && !applied["pids"] {
+		rls = append(rls, rlimit{rlimitNproc, uint64(l.Processes)})
+	}
+	if l.OpenFiles > 0 {
+		rls = append(rls, rlimit{syscall.RLIMIT_NOFILE, uint64(l.OpenFiles)})
+	}
+	if l.FileSize > 0 {
+		rls = append(rls, rlimit{syscall.RLIMIT_FSIZE, uint64(l.FileSize)})
+	}
+	return rls
+}
+
+// limit turns cmd into a command that limits itself before it runs.
+func limit(cmd *exec.Cmd, spec *limitsSpec) error {
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	cmd.Args = append([]string{limitsInit, string(raw), cmd.Path}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	return nil
+}
+
+// runLimitsInit joins the cgroup of a task and sets its rlimits, then runs
+// the command in its place. It only returns if that fails.
+func runLimitsInit(raw, path string, args []string) int {
+	var spec limitsSpec
+	err := json.Unmarshal([]byte(raw), &spec)
+	if err == nil && spec.Cgroup != "" {
+		err = ioutil.WriteFile(filepath.Join(spec.Cgroup, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644)
+	}
+	for _, rl := range spec.Rlimits {
+		if err != nil {
+			break
+		}
+		err = setrlimit(rl)
+	}
+	if err == nil {
+		err = syscall.Exec(path, args, os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "Could not run %s with its limits: %s\n", path, err)
+	return setupFailed
+}
+
+// setrlimit lowers a resource limit. Limits above the hard limit of the
+// server are left at the hard limit.
+func setrlimit(rl rlimit) error {
+	var cur syscall.Rlimit
+	if err := syscall.Getrlimit(rl.Resource, &cur); err != nil {
+		return err
+	}
+
+	v := rl.Value
+	if v > cur.Max {
+		v = cur.Max
+	}
+	next := syscall.Rlimit{Cur: v, Max: v}
+	if rl.Resource == syscall.RLIMIT_CPU && v < cur.Max {
+		// Processes get SIGXCPU at the soft limit and are only killed a
+		// second later, which lets shells report what happened.
+		next.Max = v + 1
+	}
+	return syscall.Setrlimit(rl.Resource, &next)
+}
+
+// newCgroup creates an empty cgroup, removing what is left of an earlier one.
+func newCgroup(dir string) error {
+	if err := removeCgroup(dir); err != nil {
+		return err
+	}
+	return os.Mkdir(dir, 0755)
+}
+
+// readCgroupUsage fills in the usage of a task from its cgroup, leaving the
+// values the cgroup does not report alone.
+func readCgroupUsage(dir string, u *Usage) {
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "memory.peak")); err == nil {
+		if v, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil {
+			u.PeakMemory = v
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				u.CPUTime = time.Duration(v) * time.Microsecond
+			}
+		}
+	}
+}
+
+// closeCgroup reads the usage of a task from its cgroup and removes it,
+// killing whatever processes the task left behind.
+func closeCgroup(dir string, u *Usage) {
+	readCgroupUsage(dir, u)
+	if err := removeCgroup(dir); err != nil {
+		log.Warnf("Could not remove cgroup %s: %s", dir, err)
+	}
+}
+
+// removeCgroup kills the processes in a cgroup and removes it.
+func removeCgroup(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0644); err != nil {
+		// Kernels before 5.14 cannot kill a cgroup at once.
+		procs, _ := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+		for _, p := range strings.Fields(string(procs)) {
+			if pid, err := strconv.Atoi(p); err == nil {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	}
+
+	// Killed processes leave the cgroup once they have exited.
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = syscall.Rmdir(dir); err == nil || err == syscall.ENOENT {
+			return nil
+		}
+		if err != syscall.EBUSY {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+// processUsage returns the resources used by an exited process and the
+// children it waited for.
+func processUsage(ps *os.ProcessState) Usage {
+	u := Usage{CPUTime: ps.UserTime() + ps.SystemTime()}
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		u.PeakMemory = ru.Maxrss * 1024
+	}
+	return u
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+//go:build linux
+// +build linux
+
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := newRecorder()
+	pool := New(1, rec.notify)
+	defer pool.Stop()
+
+	script := writeScript(t, dir, "limits.qscript", "ulimit -n\nhead -c 4096 /dev/zero > big || echo too big\n")
+
+	var out bytes.Buffer
+	pool.Submit(1, &Task{
+		ID:     "limited",
+		Steps:  []Step{{Script: script}},
+		Dir:    dir,
+		Output: &out,
+		Limits: &Limits{OpenFiles: 20, FileSize: 1024},
+	})
+
+	ev := rec.wait(t)
+	if ev.Result.ExitCode != 0 || ev.Result.Err != nil {
+		t.Fatalf("unexpected result: %+v: %s", ev.Result, out.String())
+	}
+	if !strings.HasPrefix(out.String(), "20\n") || !strings.HasSuffix(out.String(), "too big\n") {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+	if info, err := os.Stat(filepath.Join(dir, "big")); err != nil || info.Size() > 1024 {
+		t.Errorf("file grew beyond its limit: %v", err)
+	}
+	if ev.Result.Usage.PeakMemory <= 0 {
+		t.Errorf("peak memory was not recorded: %+v", ev.Result.Usage)
+	}
+}
+
+func TestLimitsCPUTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := newRecorder()
+	pool := New(1, rec.notify)
+	defer pool.Stop()
+
+	script := writeScript(t, dir, "spin.qscript", "while :; do :; done\n")
+	pool.Submit(1, &Task{ID: "spin", Steps: []Step{{Script: script}}, Dir: dir, Limits: &Limits{CPUTime: time.Second}})
+
+	// The shell is stopped by SIGXCPU once it used up its CPU time.
+	ev := rec.wait(t)
+	if ev.Result.ExitCode != 128+24 && ev.Result.ExitCode != -1 {
+		t.Errorf("unexpected exit code: %d", ev.Result.ExitCode)
+	}
+	if u := ev.Result.Usage; u.CPUTime < 900*time.Millisecond || u.CPUTime > 3*time.Second {
+		t.Errorf("unexpected CPU time: %s", u.CPUTime)
+	}
+}
+
+// cgroup2Dir returns a new cgroup below the cgroup v2 hierarchy, skipping
+// the test if there is none that can be written to.
+func cgroup2Dir(t *testing.T) string {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[2] != "cgroup2" {
+			continue
+		}
+		dir, err := ioutil.TempDir(fields[1], "conveyor-test-")
+		if err != nil {
+			t.Skipf("cgroups cannot be created: %s", err)
+		}
+		return dir
+	}
+	t.Skip("there is no cgroup v2 hierarchy")
+	return ""
+}
+
+func TestLimitsCgroup(t *testing.T) {
+	cgroup := cgroup2Dir(t)
+	defer removeCgroup(cgroup)
+
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := newRecorder()
+	pool := New(1, rec.notify)
+	defer pool.Stop()
+
+	if err := pool.UseCgroup(cgroup); err != nil {
+		t.Fatal(err)
+	}
+
+	// The script leaves a process behind that is not in its process group.
+	script := writeScript(t, dir, "cgroup.qscript", "cat /proc/self/cgroup\nsetsid sleep 30 > /dev/null 2>&1 &\necho $! > child.pid\n")
+
+	var out bytes.Buffer
+	pool.Submit(1, &Task{ID: "grouped", Steps: []Step{{Script: script}}, Dir: dir, Output: &out})
+
+	ev := rec.wait(t)
+	if ev.Result.ExitCode != 0 || ev.Result.Err != nil {
+		t.Fatalf("unexpected result: %+v: %s", ev.Result, out.String())
+	}
+	if !strings.Contains(out.String(), "/"+filepath.Base(cgroup)+"/task-grouped\n") {
+		t.Errorf("task did not run in its cgroup: %q", out.String())
+	}
+
+	// The cgroup is removed along with whatever was left in it.
+	if _, err := os.Stat(filepath.Join(cgroup, "task-grouped")); !os.IsNotExist(err) {
+		t.Errorf("cgroup of the task was not removed: %v", err)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "child.pid"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stat, err := ioutil.ReadFile("/proc/" + strings.TrimSpace(string(b)) + "/stat")
+		if os.IsNotExist(err) || strings.Contains(string(stat), ") Z ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("process %s left behind by the task is still running", strings.TrimSpace(string(b)))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// UseCgroup fails, as cgroups only exist on Linux.
+func (p *Pool) UseCgroup(dir string) error {
+	return errors.New("cgroups are only supported on Linux")
+}
+
+// limits fails for tasks with limits, which are only enforced on Linux.
+func (p *Pool) limits(t *Task) (*limitsSpec, error) {
+	if t.Limits != nil {
+		return nil, errors.New("resource limits are only supported on Linux")
+	}
+	return nil, nil
+}
+
+// limit is never called, as there are no limits to apply.
+func limit(cmd *exec.Cmd, spec *limitsSpec) error {
+	return errors.New("resource limits are only supported on Linux")
+}
+
+// closeCgroup does nothing, as tasks never have a cgroup.
+func closeCgroup(dir string, u *Usage) {}
+
+// processUsage returns the CPU time used by an exited process and the
+// children it waited for.
+func processUsage(ps *os.ProcessState) Usage {
+	return Usage{CPUTime: ps.UserTime() + ps.SystemTime()}
+}
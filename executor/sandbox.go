@@ -0,0 +1,18 @@
+package executor
+
+// Sandbox describes the private view of the system a task is run in. The
+// task directory is the only place a sandboxed task can write to, apart from
+// a temporary /tmp.
+type Sandbox struct {
+	// Mounts are paths of the host, such as toolchains, that are mounted
+	// read-only at the same place inside the sandbox. Paths that do not
+	// exist are left out.
+	Mounts []string
+	// Network lets the task use the network of the host. Without it the
+	// task only has a loopback device of its own.
+	Network bool
+	// Image is the root filesystem of an image that the sandbox is built on
+	// instead of an empty root. It is never changed by the task, whatever it
+	// writes outside of the task directory is thrown away with the sandbox.
+	Image string
+}
@@ -0,0 +1,497 @@
+//go:build linux
+// +build linux
+
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// sandboxInit is the name the executor runs itself as to set up a sandbox.
+	sandboxInit = "conveyor-sandbox-init"
+	// setupFailed is the exit code of a step whose sandbox or limits could
+	// not be set up.
+	setupFailed = 125
+
+	// Capabilities and prctl(2) options missing from the syscall package.
+	capChown                = 0
+	capDacOverride          = 1
+	capFowner               = 3
+	capSetpcap              = 8
+	capNetAdmin             = 12
+	capSysAdmin             = 21
+	prSetNoNewPrivs         = 38
+	prCapAmbient            = 47
+	prCapAmbientClearAll    = 4
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+// sandboxDevices are the devices of the host that are available in a sandbox.
+var sandboxDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// sandboxSpec tells the first process of a sandbox how to set it up.
+type sandboxSpec struct {
+	// Root is an empty directory the root filesystem is built in.
+	Root string `json:"root"`
+	// Dir is the task directory, which is the only one that can be written to.
+	Dir     string   `json:"dir"`
+	Workdir string   `json:"workdir"`
+	Mounts  []string `json:"mounts"`
+	Network bool     `json:"network"`
+	Image   string   `json:"image,omitempty"`
+}
+
+// The executor runs itself to set up sandboxes, so that whatever program
+// links it can run sandboxed tasks without doing anything about it.
+func init() {
+	if len(os.Args) > 1 && os.Args[0] == sandboxInit {
+		os.Exit(runSandboxInit(os.Args[1], os.Args[2:]))
+	}
+}
+
+// sandbox turns cmd into a command that runs in new user, mount, PID, IPC,
+// UTS and, unless the sandbox has the network of the host, network
+// namespaces. The function it returns cleans up once the command has exited.
+func sandbox(cmd *exec.Cmd, sb *Sandbox, dir string) (func(), error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	image := sb.Image
+	if image != "" {
+		if image, err = filepath.Abs(image); err != nil {
+			return nil, err
+		}
+	}
+	workdir, err := filepath.Abs(cmd.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// The script is the last argument, relative to the working directory
+	// like it is outside of a sandbox.
+	args := append([]string{cmd.Path}, cmd.Args[1:]...)
+	script := args[len(args)-1]
+	if !filepath.IsAbs(script) {
+		script = filepath.Join(workdir, script)
+		args[len(args)-1] = script
+	}
+
+	root, err := ioutil.TempDir("", "conveyor-sandbox-")
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := json.Marshal(sandboxSpec{
+		Root:    root,
+		Dir:     dir,
+		Workdir: workdir,
+		Mounts:  append(append([]string{}, sb.Mounts...), script),
+		Network: sb.Network,
+		Image:   image,
+	})
+	if err != nil {
+		os.Remove(root)
+		return nil, err
+	}
+
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = append([]string{sandboxInit, string(spec)}, args...)
+
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	if !sb.Network {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	// The task keeps the user and group it would have outside of the sandbox.
+	// Users other than root lose their capabilities in the new user namespace
+	// when the executor runs itself, so the ones needed to set up the sandbox
+	// are kept as ambient capabilities.
+	cmd.SysProcAttr.Cloneflags = uintptr(flags)
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	cmd.SysProcAttr.AmbientCaps = []uintptr{capChown, capDacOverride, capFowner, capSetpcap, capNetAdmin, capSysAdmin}
+
+	// The root filesystem is only mounted inside the sandbox, so the
+	// directory is empty again once the command has exited.
+	return func() { os.Remove(root) }, nil
+}
+
+// runSandboxInit is run as the first process of a new sandbox. It sets up
+// the sandbox, runs the command and returns its exit code once it has
+// exited. Every other process in the sandbox is killed when it returns.
+func runSandboxInit(raw string, args []string) int {
+	// Capabilities are dropped from this thread, which is the one the
+	// command is started from.
+	runtime.LockOSThread()
+
+	var spec sandboxSpec
+	err := json.Unmarshal([]byte(raw), &spec)
+	if err == nil {
+		err = spec.setup()
+	}
+	if err == nil {
+		err = dropCapabilities()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set up sandbox: %s\n", err)
+		return setupFailed
+	}
+
+	// Signals sent to the process group reach the command by themselves,
+	// they are only caught so that they do not stop the sandbox first.
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = spec.Workdir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not start %s in sandbox: %s\n", args[0], err)
+		return setupFailed
+	}
+
+	// Processes that lose their parent are adopted by this one, so every
+	// process has to be reaped until the command exits.
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not wait for %s in sandbox: %s\n", args[0], err)
+			return setupFailed
+		}
+		if pid != cmd.Process.Pid {
+			continue
+		}
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+}
+
+// setup builds the root filesystem of the sandbox and switches to it. It has
+// a read-only root, either empty or the image of the sandbox, with the mounts
+// of the sandbox, a few devices, its own /proc and /tmp and the task
+// directory, which can be written to.
+func (s *sandboxSpec) setup() error {
+	// Nothing that is mounted from here on is seen outside of the sandbox.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("could not make mounts private: %s", err)
+	}
+
+	if err := mountFS("tmpfs", s.Root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return err
+	}
+	root := s.Root
+	if s.Image != "" {
+		var err error
+		if root, err = s.mountImage(); err != nil {
+			return err
+		}
+	}
+
+	// Links in an image are followed as if the sandbox root was the root,
+	// so that nothing is mounted outside of it.
+	tmp, err := rootPath(root, "/tmp")
+	if err != nil {
+		return err
+	}
+	if err := mountFS("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return err
+	}
+	proc, err := rootPath(root, "/proc")
+	if err != nil {
+		return err
+	}
+	if err := mountFS("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return err
+	}
+	if err := mountDevices(root); err != nil {
+		return err
+	}
+
+	for _, path := range s.Mounts {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := bindMount(root, path, true); err != nil {
+			return err
+		}
+	}
+	if err := bindMount(root, s.Dir, false); err != nil {
+		return err
+	}
+
+	old := filepath.Join(root, ".old")
+	if err := os.Mkdir(old, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(root, old); err != nil {
+		return fmt.Errorf("could not switch to the sandbox root: %s", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.old", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("could not unmount the host root: %s", err)
+	}
+	if err := os.Remove("/.old"); err != nil {
+		return err
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("could not make the sandbox root read-only: %s", err)
+	}
+
+	if !s.Network {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("could not bring up the loopback device: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// mountImage mounts the image of the sandbox below its root with an overlay,
+// so that mount points can be made without changing the image. It returns
+// where the image is mounted.
+func (s *sandboxSpec) mountImage() (string, error) {
+	upper := filepath.Join(s.Root, "upper")
+	work := filepath.Join(s.Root, "work")
+	root := filepath.Join(s.Root, "root")
+	for _, dir := range []string{upper, work} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return "", err
+		}
+	}
+
+	data := "lowerdir=" + s.Image + ",upperdir=" + upper + ",workdir=" + work
+	if err := mountFS("overlay", root, "overlay", syscall.MS_NOSUID|syscall.MS_NODEV, data); err != nil {
+		return "", err
+	}
+	return root, nil
+}
+
+// mountDevices gives the sandbox a /dev with the devices that programs
+// expect to be there.
+func mountDevices(root string) error {
+	dev, err := rootPath(root, "/dev")
+	if err != nil {
+		return err
+	}
+	if err := mountFS("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=0755"); err != nil {
+		return err
+	}
+
+	for _, name := range sandboxDevices {
+		if _, err := os.Stat("/dev/" + name); err != nil {
+			continue
+		}
+		if err := bindMount(root, "/dev/"+name, false); err != nil {
+			return err
+		}
+	}
+
+	links := map[string]string{"fd": "/proc/self/fd", "stdin": "/proc/self/fd/0", "stdout": "/proc/self/fd/1", "stderr": "/proc/self/fd/2"}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountFS mounts a filesystem at target, creating it first.
+func mountFS(source, target, fstype string, flags uintptr, data string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(source, target, fstype, flags, data); err != nil {
+		return fmt.Errorf("could not mount %s at %s: %s", fstype, target, err)
+	}
+	return nil
+}
+
+// bindMount makes path of the host available at the same place below root.
+// Symbolic links to directories, such as /bin on systems with a merged /usr,
+// are copied instead, while links to files, such as /etc/resolv.conf, are
+// followed.
+func bindMount(root, path string, readonly bool) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Stat(path); err == nil && !target.IsDir() {
+			info = target
+		}
+	}
+
+	dir, err := rootPath(root, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, filepath.Join(dir, filepath.Base(path)))
+	}
+
+	target, err := rootPath(root, path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	default:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+
+	if err := syscall.Mount(path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("could not mount %s: %s", path, err)
+	}
+	if !readonly {
+		return nil
+	}
+
+	flags := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | lockedFlags(path)
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("could not mount %s read-only: %s", path, err)
+	}
+	return nil
+}
+
+// lockedFlags returns the flags of the mount path is on that its bind mounts
+// have to keep when they are remounted in a user namespace.
+func lockedFlags(path string) uintptr {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0
+	}
+
+	// Flags reported by statfs, see statvfs(3).
+	known := []struct {
+		st int64
+		ms uintptr
+	}{
+		{0x2, syscall.MS_NOSUID},
+		{0x4, syscall.MS_NODEV},
+		{0x8, syscall.MS_NOEXEC},
+		{0x400, syscall.MS_NOATIME},
+		{0x800, syscall.MS_NODIRATIME},
+		{0x1000, syscall.MS_RELATIME},
+	}
+
+	var flags uintptr
+	for _, f := range known {
+		if int64(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	return flags
+}
+
+// loopbackUp brings up the loopback device of a new network namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var req struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(req.name[:], "lo")
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	req.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// dropCapabilities makes sure the command and everything it starts has no
+// capabilities, not even when it is run by root, so that it cannot undo the
+// setup of the sandbox.
+func dropCapabilities() error {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return err
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return err
+	}
+
+	// Root gets the inheritable capabilities back when it runs a program.
+	hdr := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("could not get capabilities: %s", errno)
+	}
+	data[0].inheritable, data[1].inheritable = 0, 0
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("could not clear inheritable capabilities: %s", errno)
+	}
+
+	for c := 0; c <= last; c++ {
+		if err := prctl(syscall.PR_CAPBSET_DROP, uintptr(c)); err != nil {
+			return fmt.Errorf("could not drop capability %d: %s", c, err)
+		}
+	}
+	if err := prctl(prCapAmbient, prCapAmbientClearAll); err != nil {
+		return fmt.Errorf("could not clear ambient capabilities: %s", err)
+	}
+	if err := prctl(prSetNoNewPrivs, 1); err != nil {
+		return fmt.Errorf("could not disable new privileges: %s", err)
+	}
+	return nil
+}
+
+// prctl calls prctl(2) with a single argument.
+func prctl(option, arg uintptr) error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, option, arg, 0, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+//go:build linux
+// +build linux
+
+package executor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sandboxMounts are the host paths sandboxed tests need for a shell.
+var sandboxMounts = []string{"/bin", "/sbin", "/usr", "/lib", "/lib64", "/etc"}
+
+// runSandboxed runs a script in a sandbox and returns its result and output.
+func runSandboxed(t *testing.T, dir, body string, sb *Sandbox) (*Result, string) {
+	rec := newRecorder()
+	pool := New(1, rec.notify)
+	defer pool.Stop()
+
+	var out bytes.Buffer
+	pool.Submit(1, &Task{
+		ID:      "sandboxed",
+		Steps:   []Step{{Script: writeScript(t, dir, "sandboxed.qscript", body)}},
+		Dir:     dir,
+		Output:  &out,
+		Sandbox: sb,
+	})
+
+	ev := rec.wait(t)
+	return ev.Result, out.String()
+}
+
+// skipWithoutSandbox skips the test if the system does not let this user
+// create the namespaces a sandbox needs.
+func skipWithoutSandbox(t *testing.T, dir string) {
+	res, out := runSandboxed(t, dir, "true\n", &Sandbox{Mounts: sandboxMounts})
+	if res.Err != nil || res.ExitCode != 0 {
+		t.Skipf("sandboxes are not available: %v %s", res.Err, out)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	other, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(other)
+
+	skipWithoutSandbox(t, dir)
+
+	script := strings.Join([]string{
+		"set -e",
+		"echo written > file",
+		"test ! -e " + other,
+		"! touch /usr/conveyor 2>/dev/null",
+		"! touch /conveyor 2>/dev/null",
+		"touch /tmp/scratch",
+		"grep -q '^CapEff:.0*$' /proc/self/status",
+		"test ! -e /proc/" + strconv.Itoa(os.Getpid()),
+		"head -c " + strconv.Itoa(len(sandboxInit)) + " /proc/1/cmdline; echo",
+		"grep -c : /proc/net/dev",
+	}, "\n")
+
+	res, out := runSandboxed(t, dir, script+"\n", &Sandbox{Mounts: sandboxMounts})
+	if res.ExitCode != 0 || res.Err != nil {
+		t.Fatalf("sandboxed script failed: %+v %s", res, out)
+	}
+
+	// The sandbox has processes of its own, and there is no network device
+	// apart from the loopback one.
+	if out != sandboxInit+"\n1\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "file")); err != nil || string(b) != "written\n" {
+		t.Errorf("file written in the task directory is missing: %q %v", b, err)
+	}
+	if _, err := os.Stat("/tmp/scratch"); err == nil {
+		os.Remove("/tmp/scratch")
+		t.Error("file written to /tmp of the sandbox is on the host")
+	}
+
+	// With the network of the host the sandbox sees its devices.
+	res, out = runSandboxed(t, dir, "grep -c : /proc/net/dev\n", &Sandbox{Mounts: sandboxMounts, Network: true})
+	if res.ExitCode != 0 || out == "1\n" {
+		t.Errorf("sandbox does not have the network of the host: %+v %q", res, out)
+	}
+}
+
+func TestSandboxCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	skipWithoutSandbox(t, dir)
+
+	rec := newRecorder()
+	pool := New(1, rec.notify)
+	pool.KillGrace = 100 * time.Millisecond
+	defer pool.Stop()
+
+	script := writeScript(t, dir, "sleep.qscript", "sh -c \"trap '' TERM; sleep 30\" &\nwait\n")
+
+	started := time.Now()
+	pool.Submit(1, &Task{ID: "sleep", Steps: []Step{{Script: script}}, Dir: dir, Sandbox: &Sandbox{Mounts: sandboxMounts}, Timeout: 200 * time.Millisecond})
+
+	ev := rec.wait(t)
+	if !ev.Result.TimedOut {
+		t.Errorf("task did not time out: %+v", ev.Result)
+	}
+	if d := time.Since(started); d > 5*time.Second {
+		t.Errorf("sandboxed task took too long to be stopped: %s", d)
+	}
+}
+
+func TestSandboxLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	skipWithoutSandbox(t, dir)
+
+	rec := newRecorder()
+	pool := New(1, rec.notify)
+	defer pool.Stop()
+
+	var out bytes.Buffer
+	pool.Submit(1, &Task{
+		ID:      "limited",
+		Steps:   []Step{{Script: writeScript(t, dir, "limits.qscript", "ulimit -n\n")}},
+		Dir:     dir,
+		Output:  &out,
+		Sandbox: &Sandbox{Mounts: sandboxMounts},
+		Limits:  &Limits{OpenFiles: 20},
+	})
+
+	ev := rec.wait(t)
+	if ev.Result.ExitCode != 0 || out.String() != "20\n" {
+		t.Errorf("limits do not apply in a sandbox: %+v %q", ev.Result, out.String())
+	}
+}
+
+// writeImage writes a root filesystem with nothing but /bin/sh and the
+// libraries it needs, skipping the test if they cannot be found.
+func writeImage(t *testing.T, root string) {
+	out, err := exec.Command("ldd", "/bin/sh").Output()
+	if err != nil {
+		t.Skipf("cannot find the libraries of /bin/sh: %s", err)
+	}
+
+	files := []string{"/bin/sh"}
+	for _, line := range strings.Split(string(out), "\n") {
+		for _, field := range strings.Fields(line) {
+			if filepath.IsAbs(field) {
+				files = append(files, field)
+			}
+		}
+	}
+
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Skipf("cannot read %s: %s", file, err)
+		}
+		target := filepath.Join(root, file)
+		os.MkdirAll(filepath.Dir(target), 0755)
+		if err := ioutil.WriteFile(target, b, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSandboxImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	skipWithoutSandbox(t, dir)
+
+	image, err := ioutil.TempDir("", "executor-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(image)
+
+	writeImage(t, image)
+	before, _ := exec.Command("find", image).Output()
+
+	// Links to files are mounted with the file they point to.
+	host, err := ioutil.TempDir("", "executor-host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(host)
+	ioutil.WriteFile(filepath.Join(host, "resolv.conf"), []byte("linked\n"), 0644)
+	link := filepath.Join(host, "link")
+	os.Symlink("resolv.conf", link)
+
+	script := strings.Join([]string{
+		"set -e",
+		"test ! -e /usr",
+		"if echo changed 2>/dev/null > /bin/sh; then exit 1; fi",
+		"if echo new 2>/dev/null > /new; then exit 1; fi",
+		"read line < " + link,
+		"test $line = linked",
+		"echo written > file",
+	}, "\n")
+
+	res, out := runSandboxed(t, dir, script+"\n", &Sandbox{Image: image, Mounts: []string{link}})
+	if res.ExitCode != 0 || res.Err != nil {
+		t.Fatalf("script failed in image: %+v %s", res, out)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "file")); err != nil || string(b) != "written\n" {
+		t.Errorf("file written in the task directory is missing: %q %v", b, err)
+	}
+
+	// Mount points are made in an overlay, not in the image.
+	if after, _ := exec.Command("find", image).Output(); string(after) != string(before) {
+		t.Errorf("image was changed: %s", after)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// sandbox fails, as sandboxes are built from Linux namespaces.
+func sandbox(cmd *exec.Cmd, sb *Sandbox, dir string) (func(), error) {
+	return nil, errors.New("sandboxes are only supported on Linux")
+}
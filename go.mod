@@ -7,4 +7,7 @@ require (
 	github.com/justinas/alice v1.2.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/pflag v1.0.5
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	gopkg.in/yaml.v2 v2.2.8
 )
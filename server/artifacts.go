@@ -0,0 +1,341 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// artifactSweepInterval is how often expired artifacts are removed.
+const artifactSweepInterval = time.Hour
+
+// Artifact is a file a job left behind in its workspace.
+type Artifact struct {
+	// Path is the slash separated path of the file in the workspace.
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Digest is the SHA-256 of the content, under which it is stored.
+	Digest string      `json:"digest"`
+	Mode   os.FileMode `json:"mode"`
+}
+
+// validateArtifacts checks that the artifact patterns of a job stay inside
+// its workspace.
+func validateArtifacts(patterns []string) error {
+	for _, pattern := range patterns {
+		if !workspacePath(pattern) {
+			return fmt.Errorf("artifact %q has to be a path inside the workspace", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid artifact pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// workspacePath reports whether p is a relative path that stays inside the
+// workspace.
+func workspacePath(p string) bool {
+	clean := filepath.Clean(p)
+	return p != "" && !filepath.IsAbs(p) && clean != ".." && !strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+// within reports whether the resolved path p is root or below it.
+func within(root, p string) bool {
+	return p == root || strings.HasPrefix(p, root+string(filepath.Separator))
+}
+
+// artifactDir returns the directory artifacts are kept in.
+func (c *Config) artifactDir() string {
+	if c.ArtifactsDir != "" {
+		return c.ArtifactsDir
+	}
+	return c.WorkersDir + "_artifacts"
+}
+
+// blobPath returns where the content with the given digest is stored.
+func (c *Config) blobPath(digest string) string {
+	sum := strings.TrimPrefix(digest, "sha256:")
+	if len(sum) < 2 {
+		sum = "__" + sum
+	}
+	return filepath.Join(c.artifactDir(), "sha256", sum[:2], sum)
+}
+
+// storeBlob copies a file into the artifact store and returns its digest.
+// Content that is already stored is kept only once.
+func (c *Config) storeBlob(file string) (string, error) {
+	src, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tmp, err := ioutil.TempFile(c.artifactDir(), ".upload-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), src); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	blob := c.blobPath(digest)
+
+	if _, err := os.Stat(blob); err == nil {
+		// Keep the sweeper from removing content that is in use again.
+		now := time.Now()
+		return digest, os.Chtimes(blob, now, now)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blob), 0700); err != nil {
+		return "", err
+	}
+	return digest, os.Rename(tmp.Name(), blob)
+}
+
+// collectArtifacts stores the files in dir that match the artifact patterns
+// of a job. Matching directories are collected with everything in them,
+// symbolic links are never followed.
+func (c *Config) collectArtifacts(dir string, patterns []string) ([]Artifact, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var artifacts []Artifact
+
+	add := func(file string, info os.FileInfo) error {
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if seen[rel] || !info.Mode().IsRegular() {
+			return nil
+		}
+		seen[rel] = true
+
+		digest, err := c.storeBlob(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", rel, err)
+		}
+		artifacts = append(artifacts, Artifact{Path: rel, Size: info.Size(), Digest: digest, Mode: info.Mode().Perm()})
+		return nil
+	}
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, match := range matches {
+			// Matches reached through a linked directory could be anywhere.
+			real, err := filepath.EvalSymlinks(match)
+			if err != nil || !within(root, real) {
+				continue
+			}
+			info, err := os.Lstat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				if err := add(real, info); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			err = filepath.Walk(real, func(file string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				return add(file, info)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Slice(artifacts, func(i, k int) bool { return artifacts[i].Path < artifacts[k].Path })
+
+	return artifacts, nil
+}
+
+// saveArtifacts collects the artifacts of a job that succeeded and reports
+// them in its log.
+func (c *Config) saveArtifacts(id string, req JobRequest, dir string, out io.Writer) error {
+	started := time.Now()
+
+	artifacts, err := c.collectArtifacts(dir, req.Artifacts)
+	if err != nil {
+		fmt.Fprintf(out, "Could not collect artifacts: %s\n", err)
+		return fmt.Errorf("could not collect artifacts: %s", err)
+	}
+
+	var size int64
+	for _, a := range artifacts {
+		size += a.Size
+	}
+
+	fmt.Fprintf(out, "Collected %d artifacts (%d bytes)\n", len(artifacts), size)
+	log.Infof("Collected %d artifacts of job %s in %s", len(artifacts), id, time.Since(started))
+
+	c.jobs.update(id, func(j *Job) { j.Artifacts = artifacts })
+
+	return nil
+}
+
+// sweepArtifacts forgets the artifacts of jobs that finished longer ago than
+// the retention period and removes stored content no job refers to anymore.
+func (c *Config) sweepArtifacts(now time.Time) {
+	if c.ArtifactRetention > 0 {
+		cutoff := now.Add(-c.ArtifactRetention)
+		for _, j := range c.jobs.list() {
+			if len(j.Artifacts) == 0 || j.FinishedAt == nil || j.FinishedAt.After(cutoff) {
+				continue
+			}
+			log.Infof("Artifacts of job %s have expired", j.ID)
+			c.jobs.update(j.ID, func(j *Job) {
+				j.Artifacts = nil
+				j.ArtifactsExpired = true
+			})
+		}
+	}
+
+	used := make(map[string]bool)
+	for _, j := range c.jobs.list() {
+		for _, a := range j.Artifacts {
+			used[c.blobPath(a.Digest)] = true
+		}
+	}
+
+	// Content that was stored recently may belong to a job that is still
+	// being collected.
+	cutoff := now.Add(-artifactSweepInterval)
+
+	filepath.Walk(filepath.Join(c.artifactDir(), "sha256"), func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || used[file] || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(file); err != nil {
+			log.Errorf("Could not remove artifact %s: %s", file, err)
+		}
+		return nil
+	})
+}
+
+// runArtifactSweeper sweeps the artifact store regularly until the server stops.
+func (c *Config) runArtifactSweeper() {
+	ticker := time.NewTicker(artifactSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		c.sweepArtifacts(time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// artifactJob looks up the job whose artifacts are asked for, responding
+// with an error if they cannot be served.
+func (c *Config) artifactJob(w http.ResponseWriter, r *http.Request) (Job, bool) {
+	ps := httprouter.ParamsFromContext(r.Context())
+
+	job, ok := c.jobs.get(ps.ByName("id"))
+	if !ok {
+		respondError(w, http.StatusNotFound, "Job not found.")
+		return job, false
+	}
+
+	if job.isPipeline() {
+		respondError(w, http.StatusBadRequest, "Pipelines have no artifacts of their own, read the artifacts of their jobs.")
+		return job, false
+	}
+
+	if job.ArtifactsExpired {
+		respondError(w, http.StatusGone, "Artifacts of this job have expired.")
+		return job, false
+	}
+
+	return job, true
+}
+
+// ListArtifacts lists the artifacts a job left behind.
+func (c *Config) ListArtifacts(w http.ResponseWriter, r *http.Request) {
+	job, ok := c.artifactJob(w, r)
+	if !ok {
+		return
+	}
+
+	artifacts := job.Artifacts
+	if artifacts == nil {
+		artifacts = []Artifact{}
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{"artifacts": artifacts})
+}
+
+// GetArtifact serves the content of an artifact.
+func (c *Config) GetArtifact(w http.ResponseWriter, r *http.Request) {
+	job, ok := c.artifactJob(w, r)
+	if !ok {
+		return
+	}
+
+	ps := httprouter.ParamsFromContext(r.Context())
+	name := strings.TrimPrefix(ps.ByName("path"), "/")
+
+	var artifact *Artifact
+	for i := range job.Artifacts {
+		if job.Artifacts[i].Path == name {
+			artifact = &job.Artifacts[i]
+		}
+	}
+	if artifact == nil {
+		respondError(w, http.StatusNotFound, "Artifact not found.")
+		return
+	}
+
+	file, err := os.Open(c.blobPath(artifact.Digest))
+	if err != nil {
+		log.Errorf("Could not open artifact %s of job %s: %s", name, job.ID, err)
+		respondError(w, http.StatusInternalServerError, "Could not read artifact.")
+		return
+	}
+	defer file.Close()
+
+	var modified time.Time
+	if job.FinishedAt != nil {
+		modified = *job.FinishedAt
+	}
+
+	w.Header().Set("ETag", `"`+artifact.Digest+`"`)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.Replace(path.Base(name), `"`, "", -1)+`"`)
+	http.ServeContent(w, r, name, modified, file)
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// getArtifacts sends a request for the artifacts of a job.
+func getArtifacts(t *testing.T, config *Config, url string) *httptest.ResponseRecorder {
+	// Set up the request.
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	return rr
+}
+
+// listArtifacts returns the artifacts of a job as served by the API.
+func listArtifacts(t *testing.T, config *Config, id string) []Artifact {
+	rr := getArtifacts(t, config, "/job/"+id+"/artifacts")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+	}
+
+	var resp struct {
+		Artifacts []Artifact `json:"artifacts"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Artifacts
+}
+
+func TestArtifactsInvalid(t *testing.T) {
+	tests := []string{
+		`{"name": "a", "commands": ["ls"], "artifacts": ["/etc/passwd"]}`,
+		`{"name": "a", "commands": ["ls"], "artifacts": ["../other/*"]}`,
+		`{"name": "a", "commands": ["ls"], "artifacts": ["dist/["]}`,
+		`{"name": "a", "artifacts": ["dist"], "jobs": [{"name": "b", "commands": ["ls"]}]}`,
+	}
+
+	for _, body := range tests {
+		if _, err := parseJobRequest("application/json", []byte(body)); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	id := postJob(t, config, `{"name": "build", "artifacts": ["dist", "*.log", "link", "missing/*"], "commands": [
+		"mkdir -p dist/sub && printf binary > dist/app.bin && printf same > dist/sub/a.txt && printf same > dist/sub/b.txt",
+		"echo done > build.log && echo ignored > other.txt && ln -sf /etc/hostname link"
+	]}`)
+
+	if job := waitForJob(t, config, id); job.State != StateSucceeded {
+		t.Fatalf("job did not succeed: %+v", job)
+	}
+
+	artifacts := listArtifacts(t, config, id)
+
+	want := []string{"build.log", "dist/app.bin", "dist/sub/a.txt", "dist/sub/b.txt"}
+	if len(artifacts) != len(want) {
+		t.Fatalf("unexpected artifacts: %+v", artifacts)
+	}
+	for i, a := range artifacts {
+		if a.Path != want[i] {
+			t.Errorf("unexpected artifact %d: got %s want %s", i, a.Path, want[i])
+		}
+	}
+
+	// Content is only stored once.
+	if artifacts[2].Digest != artifacts[3].Digest || artifacts[1].Digest == artifacts[2].Digest {
+		t.Errorf("unexpected digests: %+v", artifacts)
+	}
+
+	rr := getArtifacts(t, config, "/job/"+id+"/artifacts/dist/app.bin")
+	if rr.Code != http.StatusOK || rr.Body.String() != "binary" || rr.Header().Get("ETag") != `"`+artifacts[1].Digest+`"` {
+		t.Errorf("unexpected download: %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	if rr := getArtifacts(t, config, "/job/"+id+"/artifacts/other.txt"); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if log := getRunLog(t, config, id, "1"); log != "Collected 4 artifacts (19 bytes)\n" {
+		t.Errorf("unexpected log: %q", log)
+	}
+}
+
+func TestArtifactsOfFailedJob(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	id := postJob(t, config, `{"name": "build", "artifacts": ["*.txt"], "commands": ["echo 1 > a.txt", "false"]}`)
+
+	if job := waitForJob(t, config, id); job.State != StateFailed {
+		t.Fatalf("job did not fail: %+v", job)
+	}
+
+	if artifacts := listArtifacts(t, config, id); len(artifacts) != 0 {
+		t.Errorf("failed job has artifacts: %+v", artifacts)
+	}
+}
+
+func TestSweepArtifacts(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	config.ArtifactRetention = time.Hour
+
+	id := postJob(t, config, `{"name": "build", "artifacts": ["a.txt"], "commands": ["echo 1 > a.txt"]}`)
+	waitForJob(t, config, id)
+
+	artifacts := listArtifacts(t, config, id)
+	if len(artifacts) != 1 {
+		t.Fatalf("unexpected artifacts: %+v", artifacts)
+	}
+	blob := config.blobPath(artifacts[0].Digest)
+
+	// Artifacts of recent jobs are kept.
+	config.sweepArtifacts(time.Now())
+	if _, err := os.Stat(blob); err != nil {
+		t.Fatalf("artifact of recent job was removed: %s", err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(blob, old, old)
+	config.jobs.update(id, func(j *Job) { j.FinishedAt = &old })
+
+	config.sweepArtifacts(time.Now())
+
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Errorf("expired artifact was not removed: %v", err)
+	}
+	if rr := getArtifacts(t, config, "/job/"+id+"/artifacts"); rr.Code != http.StatusGone {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusGone)
+	}
+}
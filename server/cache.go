@@ -0,0 +1,559 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxCacheKey limits the length of cache keys, which are used as file names.
+	maxCacheKey = 200
+	// cacheExt is the extension of cache archives.
+	cacheExt = ".tar.gz"
+)
+
+// Cache describes files in the workspace that are kept from one job to the
+// next, such as downloaded dependencies.
+type Cache struct {
+	// Key names the archive the paths are saved as. It is a template that
+	// can use the name of the job as {{ .Name }}, the ref of its source as
+	// {{ .Ref }} and the hash of files as {{ hashFiles "go.sum" }}.
+	Key string `json:"key" yaml:"key"`
+	// RestoreKeys are key prefixes, written like Key, that the newest
+	// matching archive is restored from if there is none for Key.
+	RestoreKeys []string `json:"restore_keys,omitempty" yaml:"restore_keys,omitempty"`
+	// Paths are the files and directories in the workspace that are cached.
+	Paths []string `json:"paths" yaml:"paths"`
+}
+
+// CacheStatus reports what a job did with its cache.
+type CacheStatus struct {
+	Key string `json:"key,omitempty"`
+	// Restored is the key of the archive the workspace was restored from.
+	Restored string `json:"restored,omitempty"`
+	Saved    bool   `json:"saved,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// cacheKeyData is what cache key templates can refer to.
+type cacheKeyData struct {
+	Name string
+	Ref  string
+}
+
+// validate checks that the cache keys are valid templates and that the paths
+// stay inside the workspace.
+func (c *Cache) validate() error {
+	if c.Key == "" {
+		return errors.New("cache needs a key")
+	}
+	if len(c.Paths) == 0 {
+		return errors.New("cache needs paths")
+	}
+	for _, p := range c.Paths {
+		if !workspacePath(p) {
+			return fmt.Errorf("cache path %q has to be inside the workspace", p)
+		}
+	}
+	for _, key := range append([]string{c.Key}, c.RestoreKeys...) {
+		if _, err := parseCacheKey(key, ""); err != nil {
+			return fmt.Errorf("invalid cache key %q: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// parseCacheKey parses a cache key template that hashes files in dir.
+func parseCacheKey(key, dir string) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"hashFiles": func(patterns ...string) (string, error) {
+			return hashFiles(dir, patterns)
+		},
+	}
+	return template.New("key").Option("missingkey=error").Funcs(funcs).Parse(key)
+}
+
+// renderCacheKey fills in a cache key template for a job running in dir.
+func renderCacheKey(key string, data cacheKeyData, dir string) (string, error) {
+	tmpl, err := parseCacheKey(key, dir)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	rendered := strings.TrimSpace(b.String())
+	if rendered == "" {
+		return "", fmt.Errorf("cache key %q is empty", key)
+	}
+	if len(rendered) > maxCacheKey {
+		return "", fmt.Errorf("cache key %q is longer than %d characters", key, maxCacheKey)
+	}
+	return rendered, nil
+}
+
+// hashFiles returns the SHA-256 of the names and contents of the regular
+// files in dir that match the patterns.
+func hashFiles(dir string, patterns []string) (string, error) {
+	seen := make(map[string]bool)
+	var files []string
+
+	for _, pattern := range patterns {
+		if !workspacePath(pattern) {
+			return "", fmt.Errorf("%q has to be inside the workspace", pattern)
+		}
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return "", err
+		}
+		for _, match := range matches {
+			if info, err := os.Lstat(match); err == nil && info.Mode().IsRegular() && !seen[match] {
+				seen[match] = true
+				files = append(files, match)
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		return "", fmt.Errorf("no files match %s", strings.Join(patterns, ", "))
+	}
+
+	sort.Strings(files)
+
+	hash := sha256.New()
+	for _, file := range files {
+		rel, _ := filepath.Rel(dir, file)
+		io.WriteString(hash, filepath.ToSlash(rel)+"\x00")
+
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// cacheDir returns the directory cache archives are kept in.
+func (c *Config) cacheDir() string {
+	return c.WorkersDir + "_cache"
+}
+
+// cachePath returns where the archive with the given key is stored.
+func (c *Config) cachePath(key string) string {
+	return filepath.Join(c.cacheDir(), url.PathEscape(key)+cacheExt)
+}
+
+// cacheKeyOf returns the key of the archive stored in the given file.
+func cacheKeyOf(name string) (string, bool) {
+	if !strings.HasSuffix(name, cacheExt) || strings.HasPrefix(name, ".") {
+		return "", false
+	}
+	key, err := url.PathUnescape(strings.TrimSuffix(name, cacheExt))
+	return key, err == nil
+}
+
+// findCache returns the key of the archive to restore: the one stored for
+// key, or else the newest one that starts with the first prefix any
+// archive starts with.
+func (c *Config) findCache(key string, prefixes []string) (string, bool) {
+	if _, err := os.Stat(c.cachePath(key)); err == nil {
+		return key, true
+	}
+
+	entries, err := ioutil.ReadDir(c.cacheDir())
+	if err != nil {
+		return "", false
+	}
+
+	for _, prefix := range prefixes {
+		var (
+			found  string
+			newest time.Time
+		)
+		for _, entry := range entries {
+			name, ok := cacheKeyOf(entry.Name())
+			if !ok || !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			if found == "" || entry.ModTime().After(newest) {
+				found, newest = name, entry.ModTime()
+			}
+		}
+		if found != "" {
+			return found, true
+		}
+	}
+
+	return "", false
+}
+
+// restoreCache restores the archive matching the cache of a job into its
+// workspace. A cache only speeds jobs up, so problems with it are reported
+// in the log of the job but never fail it.
+func (c *Config) restoreCache(id string, req JobRequest, dir string, out io.Writer) {
+	var status CacheStatus
+	defer c.jobs.update(id, func(j *Job) { j.Cache = &status })
+
+	data := cacheKeyData{Name: req.Name}
+	if req.Source != nil {
+		data.Ref = req.Source.Ref
+	}
+
+	key, err := renderCacheKey(req.Cache.Key, data, dir)
+	if err != nil {
+		fmt.Fprintf(out, "Not using cache: %s\n", err)
+		status.Error = err.Error()
+		return
+	}
+	status.Key = key
+
+	var prefixes []string
+	for _, restoreKey := range req.Cache.RestoreKeys {
+		prefix, err := renderCacheKey(restoreKey, data, dir)
+		if err != nil {
+			fmt.Fprintf(out, "Not restoring cache from %q: %s\n", restoreKey, err)
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	found, ok := c.findCache(key, prefixes)
+	if !ok {
+		fmt.Fprintf(out, "No cache found for %s\n", key)
+		return
+	}
+
+	archive := c.cachePath(found)
+
+	size, err := extractCache(archive, dir)
+	if err != nil {
+		fmt.Fprintf(out, "Could not restore cache %s: %s\n", found, err)
+		log.Warnf("Could not restore cache %s for job %s: %s", found, id, err)
+		status.Error = err.Error()
+		return
+	}
+
+	// Archives that are used are the last to be pruned.
+	now := time.Now()
+	os.Chtimes(archive, now, now)
+
+	status.Restored = found
+	fmt.Fprintf(out, "Restored cache %s (%d bytes)\n", found, size)
+}
+
+// saveCache saves the cached paths of a job that succeeded, unless an
+// archive already exists for its key.
+func (c *Config) saveCache(id string, req JobRequest, status CacheStatus, dir string, out io.Writer) {
+	if status.Key == "" {
+		return
+	}
+
+	if _, err := os.Stat(c.cachePath(status.Key)); err == nil {
+		fmt.Fprintf(out, "Cache %s is up to date\n", status.Key)
+		return
+	}
+
+	size, err := c.writeCache(status.Key, req.Cache.Paths, dir, out)
+	if err != nil {
+		fmt.Fprintf(out, "Could not save cache %s: %s\n", status.Key, err)
+		log.Warnf("Could not save cache %s for job %s: %s", status.Key, id, err)
+		c.jobs.update(id, func(j *Job) {
+			if j.Cache != nil {
+				j.Cache.Error = err.Error()
+			}
+		})
+		return
+	}
+
+	fmt.Fprintf(out, "Saved cache %s (%d bytes)\n", status.Key, size)
+	c.jobs.update(id, func(j *Job) {
+		if j.Cache != nil {
+			j.Cache.Saved = true
+		}
+	})
+
+	c.pruneCache()
+}
+
+// writeCache archives the given paths of the workspace under key and
+// returns the size of the archive. Paths that do not exist are left out.
+func (c *Config) writeCache(key string, paths []string, dir string, out io.Writer) (int64, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempFile(c.cacheDir(), ".save-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+
+	for _, p := range paths {
+		full := filepath.Join(root, p)
+
+		// Paths reached through a linked directory could be anywhere.
+		parent, err := filepath.EvalSymlinks(filepath.Dir(full))
+		if err != nil || !within(root, parent) {
+			fmt.Fprintf(out, "Cache path %s does not exist\n", p)
+			continue
+		}
+		if _, err := os.Lstat(full); os.IsNotExist(err) {
+			fmt.Fprintf(out, "Cache path %s does not exist\n", p)
+			continue
+		}
+
+		err = filepath.Walk(full, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return addToArchive(tw, root, file, info)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), os.Rename(tmp.Name(), c.cachePath(key))
+}
+
+// addToArchive writes a directory, regular file or symbolic link below root
+// to an archive. Anything else is left out.
+func addToArchive(tw *tar.Writer, root, file string, info os.FileInfo) error {
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		return err
+	}
+
+	var link string
+	switch {
+	case info.IsDir(), info.Mode().IsRegular():
+	case info.Mode()&os.ModeSymlink != 0:
+		if link, err = os.Readlink(file); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// extractCache unpacks an archive into dir and returns the number of bytes
+// restored. Entries are never written outside of dir or through a symbolic
+// link.
+func extractCache(archive, dir string) (int64, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gz)
+
+	var size int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+
+		name := filepath.FromSlash(strings.TrimSuffix(hdr.Name, "/"))
+		if !workspacePath(name) {
+			return size, fmt.Errorf("%s is outside of the workspace", hdr.Name)
+		}
+		if err := checkParents(root, name); err != nil {
+			return size, err
+		}
+
+		target := filepath.Join(root, name)
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return size, err
+			}
+
+		case tar.TypeReg:
+			if err := replaceable(target); err != nil {
+				return size, err
+			}
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if err != nil {
+				return size, err
+			}
+			n, err := io.Copy(out, tr)
+			size += n
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return size, err
+			}
+			os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+
+		case tar.TypeSymlink:
+			if err := replaceable(target); err != nil {
+				return size, err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return size, err
+			}
+		}
+	}
+}
+
+// checkParents makes sure that every directory leading to the path rel
+// below root that already exists is a real directory.
+func checkParents(root, rel string) error {
+	cur := root
+	for _, part := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		cur = filepath.Join(cur, part)
+
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", cur)
+		}
+	}
+	return nil
+}
+
+// replaceable creates the parent directories of a file that is about to be
+// restored and removes whatever is in its place.
+func replaceable(target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pruneCache removes the least recently used archives until the cache fits
+// in its size limit.
+func (c *Config) pruneCache() {
+	if c.CacheSize <= 0 {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(c.cacheDir())
+	if err != nil {
+		log.Errorf("Could not read cache directory: %s", err)
+		return
+	}
+
+	var (
+		archives []os.FileInfo
+		total    int64
+	)
+	for _, entry := range entries {
+		if _, ok := cacheKeyOf(entry.Name()); ok && entry.Mode().IsRegular() {
+			archives = append(archives, entry)
+			total += entry.Size()
+		}
+	}
+
+	sort.Slice(archives, func(i, k int) bool { return archives[i].ModTime().Before(archives[k].ModTime()) })
+
+	for _, archive := range archives {
+		if total <= c.CacheSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.cacheDir(), archive.Name())); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Could not remove cache %s: %s", archive.Name(), err)
+			continue
+		}
+		key, _ := cacheKeyOf(archive.Name())
+		log.Infof("Removed cache %s to stay within the cache size", key)
+		total -= archive.Size()
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeArchive writes a cache archive with the given entries.
+func writeArchive(t *testing.T, file string, entries []*tar.Header) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write(make([]byte, hdr.Size))
+		}
+	}
+	tw.Close()
+	gz.Close()
+}
+
+func TestCacheInvalid(t *testing.T) {
+	tests := []string{
+		`{"name": "a", "commands": ["ls"], "cache": {"paths": ["deps"]}}`,
+		`{"name": "a", "commands": ["ls"], "cache": {"key": "deps"}}`,
+		`{"name": "a", "commands": ["ls"], "cache": {"key": "deps", "paths": ["../deps"]}}`,
+		`{"name": "a", "commands": ["ls"], "cache": {"key": "deps-{{ hashFiles \"go.sum\"", "paths": ["deps"]}}`,
+		`{"name": "a", "commands": ["ls"], "cache": {"key": "deps", "restore_keys": ["{{ checksum }}"], "paths": ["deps"]}}`,
+		`{"name": "a", "cache": {"key": "deps", "paths": ["deps"]}, "jobs": [{"name": "b", "commands": ["ls"]}]}`,
+	}
+
+	for _, body := range tests {
+		if _, err := parseJobRequest("application/json", []byte(body)); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "go.sum"), []byte("v1"), 0600)
+
+	data := cacheKeyData{Name: "build", Ref: "main"}
+	key := `{{ .Name }}-{{ .Ref }}-{{ hashFiles "go.sum" "*.lock" }}`
+
+	first, err := renderCacheKey(key, data, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first, "build-main-") || len(first) != len("build-main-")+64 {
+		t.Errorf("unexpected key: %s", first)
+	}
+
+	if again, _ := renderCacheKey(key, data, dir); again != first {
+		t.Errorf("key is not stable: got %s want %s", again, first)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "go.sum"), []byte("v2"), 0600)
+	if changed, _ := renderCacheKey(key, data, dir); changed == first {
+		t.Errorf("key did not change with the hashed files: %s", changed)
+	}
+
+	for _, key := range []string{`{{ hashFiles "missing" }}`, `{{ .Branch }}`, ` `, strings.Repeat("x", maxCacheKey+1)} {
+		if _, err := renderCacheKey(key, data, dir); err == nil {
+			t.Errorf("expected an error for %q", key)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	repo, _ := newTestRepo(t, "v1")
+	defer os.RemoveAll(repo)
+
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	job := `{"name": "build", "source": {"repo": "` + repo + `"}, "cache": {"key": "deps-{{ hashFiles \"file.txt\" }}", "restore_keys": ["deps-"], "paths": ["deps", "missing"]}, "commands": [
+		"test -e deps || (mkdir -p deps/sub && cat file.txt > deps/sub/file && ln -s sub/file deps/link)",
+		"cat deps/link"
+	]}`
+
+	// The first run has nothing to restore and saves its cache.
+	first := waitForJob(t, config, postJob(t, config, job))
+	if first.State != StateSucceeded || first.Cache == nil || first.Cache.Restored != "" || !first.Cache.Saved {
+		t.Fatalf("cache was not saved: %+v", first.Cache)
+	}
+	if log := getRunLog(t, config, first.ID, "1"); !strings.Contains(log, "No cache found for "+first.Cache.Key) || !strings.Contains(log, "Cache path missing does not exist") {
+		t.Errorf("unexpected log: %q", log)
+	}
+
+	// The next run of the same commit restores it.
+	second := waitForJob(t, config, postJob(t, config, job))
+	if second.State != StateSucceeded || second.Cache.Key != first.Cache.Key || second.Cache.Restored != first.Cache.Key || second.Cache.Saved {
+		t.Fatalf("cache was not restored: %+v", second.Cache)
+	}
+	if log := getRunLog(t, config, second.ID, "1"); !strings.Contains(log, "Restored cache") || !strings.Contains(log, "is up to date") {
+		t.Errorf("unexpected log: %q", log)
+	}
+
+	// A changed file falls back to the restore keys, and the restored
+	// dependencies are the ones of the first run.
+	testCommit(t, repo, "v2")
+
+	third := waitForJob(t, config, postJob(t, config, job))
+	if third.State != StateSucceeded || third.Cache.Key == first.Cache.Key || third.Cache.Restored != first.Cache.Key || !third.Cache.Saved {
+		t.Fatalf("cache was not restored from a restore key: %+v", third.Cache)
+	}
+	if log := getRunLog(t, config, third.ID, "1"); !strings.Contains(log, "v1\n") {
+		t.Errorf("unexpected log: %q", log)
+	}
+
+	for _, key := range []string{first.Cache.Key, third.Cache.Key} {
+		if _, err := os.Stat(config.cachePath(key)); err != nil {
+			t.Errorf("cache %s was not kept: %s", key, err)
+		}
+	}
+}
+
+func TestCacheNotSavedOnFailure(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	job := waitForJob(t, config, postJob(t, config, `{"name": "build", "cache": {"key": "deps", "paths": ["deps"]}, "commands": ["mkdir -p deps", "false"]}`))
+
+	if job.State != StateFailed || job.Cache == nil || job.Cache.Saved {
+		t.Fatalf("unexpected cache status: %+v", job.Cache)
+	}
+	if _, err := os.Stat(config.cachePath("deps")); !os.IsNotExist(err) {
+		t.Errorf("cache of failed job was saved: %v", err)
+	}
+}
+
+func TestExtractCacheUnsafe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outside := filepath.Join(dir, "outside")
+	workspace := filepath.Join(dir, "workspace")
+	os.Mkdir(outside, 0700)
+	os.Mkdir(workspace, 0700)
+
+	tests := [][]*tar.Header{
+		{{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0600}},
+		{{Name: "/etc/escape", Typeflag: tar.TypeReg, Mode: 0600}},
+		{
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "link/escape", Typeflag: tar.TypeReg, Mode: 0600},
+		},
+	}
+
+	for i, entries := range tests {
+		archive := filepath.Join(dir, "archive.tar.gz")
+		writeArchive(t, archive, entries)
+
+		if _, err := extractCache(archive, workspace); err == nil {
+			t.Errorf("expected an error for archive %d", i)
+		}
+	}
+
+	if files, _ := ioutil.ReadDir(outside); len(files) != 0 {
+		t.Errorf("files were written outside of the workspace: %v", files)
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{WorkersDir: filepath.Join(dir, "worker"), CacheSize: 250}
+	os.Mkdir(config.cacheDir(), 0700)
+
+	// Archives are used from oldest to newest.
+	now := time.Now()
+	for i, key := range []string{"a", "b", "c"} {
+		file := config.cachePath(key)
+		ioutil.WriteFile(file, make([]byte, 100), 0600)
+		used := now.Add(time.Duration(i-3) * time.Minute)
+		os.Chtimes(file, used, used)
+	}
+
+	config.pruneCache()
+
+	for key, kept := range map[string]bool{"a": false, "b": true, "c": true} {
+		if _, err := os.Stat(config.cachePath(key)); (err == nil) != kept {
+			t.Errorf("unexpected state of cache %s: kept %v, got %v", key, kept, err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronMacros are the shorthands that can be used instead of five fields.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+	dayNames   = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+)
+
+// cronSearchLimit is how far ahead the next run of a schedule is looked for,
+// expressions such as "0 0 30 2 *" never match.
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// cronField is the set of values a field of a cron expression matches.
+type cronField uint64
+
+func (f cronField) has(v int) bool {
+	return f&(1<<uint(v)) != 0
+}
+
+// cronSpec is a parsed cron expression.
+type cronSpec struct {
+	minute, hour, dom, month, dow cronField
+	// domAny and dowAny record which of the day fields start with a *.
+	// If neither does, a day matches when either of them matches.
+	domAny, dowAny bool
+}
+
+// parseCron parses a standard five field cron expression (minute, hour, day
+// of month, month and day of week) or one of the @ macros.
+func parseCron(expr string) (*cronSpec, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields, got %d", expr, len(fields))
+	}
+
+	var spec cronSpec
+	var err error
+
+	if spec.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %s", err)
+	}
+	if spec.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %s", err)
+	}
+	if spec.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %s", err)
+	}
+	if spec.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("month: %s", err)
+	}
+	// Both 0 and 7 are Sunday.
+	if spec.dow, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("day of week: %s", err)
+	}
+	if spec.dow.has(7) {
+		spec.dow |= 1
+	}
+
+	spec.domAny = strings.HasPrefix(fields[2], "*")
+	spec.dowAny = strings.HasPrefix(fields[4], "*")
+
+	return &spec, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps.
+func parseCronField(s string, min, max int, names map[string]int) (cronField, error) {
+	value := func(v string) (int, error) {
+		if n, ok := names[strings.ToLower(v)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q is not between %d and %d", v, min, max)
+		}
+		return n, nil
+	}
+
+	var f cronField
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+
+		var lo, hi int
+		switch {
+		case rng == "*":
+			lo, hi = min, max
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if hi, err = value(bounds[1]); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		default:
+			var err error
+			if lo, err = value(rng); err != nil {
+				return 0, err
+			}
+			hi = lo
+			// A step on a single value runs to the end of the field.
+			if strings.Contains(part, "/") {
+				hi = max
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			f |= 1 << uint(v)
+		}
+	}
+	return f, nil
+}
+
+// matchesDay reports whether the day of t is matched by the expression.
+func (s *cronSpec) matchesDay(t time.Time) bool {
+	dom := s.dom.has(t.Day())
+	dow := s.dow.has(int(t.Weekday()))
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first time after t that matches the expression in the
+// location of t, or the zero time if there is none.
+func (s *cronSpec) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+
+	// advance moves on to n, making sure the search keeps going forward
+	// around changes to daylight saving time.
+	advance := func(n time.Time) {
+		if !n.After(t) {
+			n = t.Add(time.Minute)
+		}
+		t = n
+	}
+
+	for t.Before(limit) {
+		switch {
+		case !s.month.has(int(t.Month())):
+			advance(time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc))
+		case !s.matchesDay(t):
+			advance(time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc))
+		case !s.hour.has(t.Hour()):
+			advance(time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc))
+		case !s.minute.has(t.Minute()):
+			advance(t.Add(time.Minute))
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr     string
+		from     time.Time
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 1, 10, 30, 15, 0, time.UTC), time.Date(2024, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 1, 10, 31, 0, 0, time.UTC), time.Date(2024, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC), time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * mon-fri", time.Date(2024, 1, 5, 3, 0, 0, 0, time.UTC), time.Date(2024, 1, 8, 2, 30, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1 1,jul *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		// 02:30 does not exist on the day daylight saving time starts.
+		{"30 2 * * *", time.Date(2024, 3, 30, 12, 0, 0, 0, berlin), time.Date(2024, 4, 1, 2, 30, 0, 0, berlin)},
+		{"0 3 * * *", time.Date(2024, 3, 30, 12, 0, 0, 0, berlin), time.Date(2024, 3, 31, 3, 0, 0, 0, berlin)},
+		{"0 0 30 2 *", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}},
+	}
+
+	for _, test := range tests {
+		spec, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("could not parse %q: %s", test.expr, err)
+			continue
+		}
+		if got := spec.next(test.from); !got.Equal(test.expected) {
+			t.Errorf("unexpected next run of %q after %s: got %s want %s", test.expr, test.from, got, test.expected)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "@sometimes"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("expected an error for %q", expr)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// validateJobs checks the jobs of a pipeline request: names have to be unique,
+// needs have to refer to other jobs of the pipeline and must not form a cycle.
+func (r *JobRequest) validateJobs() error {
+	if len(r.Commands) > 0 || len(r.Stages) > 0 {
+		return errors.New("a pipeline with jobs cannot have commands or stages of its own")
+	}
+
+	byName := make(map[string]*JobRequest)
+	for i := range r.Jobs {
+		job := &r.Jobs[i]
+		if err := job.validate(); err != nil {
+			return fmt.Errorf("job %d: %s", i+1, err)
+		}
+		if len(job.Jobs) > 0 {
+			return fmt.Errorf("job %s cannot have jobs of its own", job.Name)
+		}
+		if byName[job.Name] != nil {
+			return fmt.Errorf("job %s is defined more than once", job.Name)
+		}
+		byName[job.Name] = job
+
+		merged := *job
+		merged.inherit(*r)
+		for _, name := range merged.Secrets {
+			if _, ok := merged.Env[name]; ok {
+				return fmt.Errorf("job %s: %s is both a variable and a secret", job.Name, name)
+			}
+		}
+	}
+
+	for _, job := range r.Jobs {
+		for _, need := range job.Needs {
+			if byName[need] == nil {
+				return fmt.Errorf("job %s needs %s, which does not exist", job.Name, need)
+			}
+		}
+	}
+
+	// Walk the needs of every job, a job that is reached again while it is
+	// still being visited is part of a cycle.
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make(map[string]int)
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visiting:
+			return fmt.Errorf("job %s depends on itself", name)
+		case visited:
+			return nil
+		}
+		marks[name] = visiting
+		for _, need := range byName[name].Needs {
+			if err := visit(need); err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+		return nil
+	}
+
+	for _, job := range r.Jobs {
+		if err := visit(job.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inherit gives a job of a pipeline the settings of the pipeline it does not
+// have itself. Variables and secrets of the pipeline are added to those of
+// the job, whose own variables win.
+func (r *JobRequest) inherit(p JobRequest) {
+	if r.Timeout == 0 {
+		r.Timeout = p.Timeout
+	}
+	if r.Retry == nil {
+		r.Retry = p.Retry
+	}
+	if r.Source == nil {
+		r.Source = p.Source
+	}
+	if r.Cleanup == "" {
+		r.Cleanup = p.Cleanup
+	}
+	if r.Sandbox == nil {
+		r.Sandbox = p.Sandbox
+	}
+	if r.Limits == nil {
+		r.Limits = p.Limits
+	}
+	if r.Image == "" {
+		r.Image = p.Image
+	}
+
+	if len(p.Env) > 0 {
+		env := make(map[string]string, len(p.Env)+len(r.Env))
+		for k, v := range p.Env {
+			env[k] = v
+		}
+		for k, v := range r.Env {
+			env[k] = v
+		}
+		r.Env = env
+	}
+
+	if len(p.Secrets) > 0 {
+		have := make(map[string]bool, len(r.Secrets))
+		for _, name := range r.Secrets {
+			have[name] = true
+		}
+		secrets := append([]string{}, r.Secrets...)
+		for _, name := range p.Secrets {
+			if !have[name] {
+				secrets = append(secrets, name)
+			}
+		}
+		r.Secrets = secrets
+	}
+}
+
+// newJob returns a queued job for a request. For a pipeline with jobs or a
+// matrix it also returns a pending job for each job of the pipeline and each
+// combination of the matrix. A pending job waits until its needs have
+// succeeded, needing a job with a matrix means needing all of its variants.
+func newJob(req JobRequest, at time.Time) (*Job, []*Job) {
+	job := &Job{
+		ID:       newJobID(),
+		Name:     req.Name,
+		Attempt:  1,
+		Run:      1,
+		QueuedAt: at,
+		Request:  req,
+		Stages:   newStageStatus(req.pipeline()),
+	}
+	job.setState(StateQueued, at)
+
+	requests := req.Jobs
+	if req.Matrix != nil {
+		requests = []JobRequest{req}
+	}
+
+	variants := make([][]variant, len(requests))
+	ids := make(map[string][]string)
+	for i := range requests {
+		variants[i] = requests[i].variants()
+		for range variants[i] {
+			ids[requests[i].Name] = append(ids[requests[i].Name], newJobID())
+		}
+	}
+
+	var children []*Job
+	for i, r := range requests {
+		for k, v := range variants[i] {
+			v.req.inherit(req)
+			child := &Job{
+				ID:       ids[r.Name][k],
+				Name:     v.req.Name,
+				Attempt:  1,
+				Run:      1,
+				Parent:   job.ID,
+				QueuedAt: at,
+				Matrix:   v.vars,
+				Request:  v.req,
+				Stages:   newStageStatus(v.req.pipeline()),
+			}
+			for _, need := range r.Needs {
+				child.Needs = append(child.Needs, ids[need]...)
+			}
+			child.setState(StatePending, at)
+			job.Children = append(job.Children, child.ID)
+			children = append(children, child)
+		}
+	}
+
+	return job, children
+}
+
+// isPipeline reports whether the job only groups other jobs.
+func (j *Job) isPipeline() bool {
+	return len(j.Children) > 0
+}
+
+// schedule moves the pending jobs of a pipeline along. Jobs whose needs have
+// all succeeded are queued and returned so they can be submitted, jobs with a
+// need that did not succeed are skipped. The state of the pipeline itself is
+// derived from the state of its jobs.
+func (t *jobTable) schedule(id string) []*Job {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	parent, ok := t.jobs[id]
+	if !ok || !parent.isPipeline() {
+		return nil
+	}
+
+	var ready []*Job
+
+	// Skipping a job can skip the jobs that need it, so keep going until
+	// nothing changes.
+	for changed := true; changed; {
+		changed = false
+		for _, cid := range parent.Children {
+			child := t.jobs[cid]
+			if child == nil || child.State != StatePending {
+				continue
+			}
+
+			succeeded := true
+			for _, need := range child.Needs {
+				dep := t.jobs[need]
+				if dep == nil {
+					continue
+				}
+				if dep.FinishedAt != nil && dep.State != StateSucceeded {
+					child.skip(fmt.Sprintf("needs %s, which %s", dep.Name, describeState(dep.State)))
+					t.save(child)
+					changed = true
+					succeeded = false
+					break
+				}
+				if dep.State != StateSucceeded {
+					succeeded = false
+				}
+			}
+
+			if succeeded && child.State == StatePending {
+				child.setState(StateQueued, time.Now())
+				t.save(child)
+				ready = append(ready, child.clone())
+			}
+		}
+	}
+
+	children := make([]*Job, 0, len(parent.Children))
+	for _, cid := range parent.Children {
+		if child := t.jobs[cid]; child != nil {
+			children = append(children, child)
+		}
+	}
+	parent.aggregate(children)
+	t.save(parent)
+
+	return ready
+}
+
+// skip marks a job that will not run because one of its needs did not succeed.
+func (j *Job) skip(reason string) {
+	j.finish(StateSkipped, -1)
+	j.ExitCode = nil
+	j.Reason = reason
+}
+
+// aggregate derives the state of a pipeline from the state of its jobs.
+func (j *Job) aggregate(children []*Job) {
+	var started *time.Time
+	done := true
+	counts := make(map[JobState]int)
+
+	for _, child := range children {
+		counts[child.State]++
+		if child.FinishedAt == nil {
+			done = false
+		}
+		if child.StartedAt != nil && (started == nil || child.StartedAt.Before(*started)) {
+			started = child.StartedAt
+		}
+	}
+
+	if started != nil && j.StartedAt == nil {
+		s := *started
+		j.StartedAt = &s
+	}
+
+	if !done {
+		if started != nil && j.State == StateQueued {
+			j.setState(StateRunning, *started)
+		}
+		return
+	}
+
+	if j.FinishedAt != nil {
+		return
+	}
+
+	state := StateSucceeded
+	switch {
+	case j.State == StateCancelled:
+		state = StateCancelled
+	case counts[StateInterrupted] > 0:
+		state = StateInterrupted
+	case counts[StateCancelled] > 0:
+		state = StateCancelled
+	case counts[StateFailed] > 0 || counts[StateSkipped] > 0 || counts[StateTimedOut] > 0:
+		state = StateFailed
+	}
+
+	j.finish(state, -1)
+	j.ExitCode = nil
+}
+
+// describeState explains why a job did not succeed.
+func describeState(state JobState) string {
+	switch state {
+	case StateSkipped:
+		return "was skipped"
+	case StateCancelled:
+		return "was cancelled"
+	case StateInterrupted:
+		return "was interrupted"
+	case StateTimedOut:
+		return "timed out"
+	}
+	return "failed"
+}
+
+// schedulePipeline submits the jobs of a pipeline that are ready to run.
+func (c *Config) schedulePipeline(id string) {
+	for _, job := range c.jobs.schedule(id) {
+		if _, err := c.submit(job); err != nil {
+			log.Errorf("Could not submit job %s: %s", job.ID, err)
+			// A job that could not be submitted causes the jobs that need it to be skipped.
+			c.schedulePipeline(id)
+		}
+	}
+}
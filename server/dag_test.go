@@ -0,0 +1,220 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+const testDAG = `
+name: release
+jobs:
+  - name: frontend
+    commands:
+      - sleep 0.5
+  - name: backend
+    commands:
+      - sleep 0.5
+  - name: integration
+    needs: [frontend, backend]
+    commands:
+      - echo integration
+  - name: deploy
+    needs: [integration]
+    commands:
+      - echo deploy
+`
+
+// pipelineJobs returns the jobs of a pipeline by name.
+func pipelineJobs(t *testing.T, config *Config, id string) map[string]Job {
+	parent, ok := config.jobs.get(id)
+	if !ok {
+		t.Fatalf("pipeline %s not found", id)
+	}
+
+	jobs := make(map[string]Job)
+	for _, cid := range parent.Children {
+		job, _ := config.jobs.get(cid)
+		jobs[job.Name] = job
+	}
+	return jobs
+}
+
+func TestValidateJobs(t *testing.T) {
+	tests := []string{
+		"name: a\njobs:\n  - name: b\n    commands: [ls]\n  - name: b\n    commands: [ls]\n",
+		"name: a\njobs:\n  - name: b\n    needs: [c]\n    commands: [ls]\n",
+		"name: a\njobs:\n  - name: b\n    needs: [c]\n    commands: [ls]\n  - name: c\n    needs: [b]\n    commands: [ls]\n",
+		"name: a\njobs:\n  - name: b\n    needs: [b]\n    commands: [ls]\n",
+		"name: a\ncommands: [ls]\njobs:\n  - name: b\n    commands: [ls]\n",
+		"name: a\nneeds: [b]\ncommands: [ls]\n",
+		"name: a\nenv: {TOKEN: x}\njobs:\n  - name: b\n    secrets: [TOKEN]\n    commands: [ls]\n",
+	}
+
+	for _, body := range tests {
+		if _, err := parseJobRequest("application/x-yaml", []byte(body)); err == nil {
+			t.Errorf("expected an error for %q", body)
+		}
+	}
+}
+
+func TestPipelineNeeds(t *testing.T) {
+	config, cleanup := newTestConfig(t, 2)
+	defer cleanup()
+
+	id := postPipeline(t, config, testDAG)
+
+	pipeline := waitForJob(t, config, id)
+	if pipeline.State != StateSucceeded {
+		t.Fatalf("pipeline did not succeed: %+v", pipeline)
+	}
+
+	jobs := pipelineJobs(t, config, id)
+
+	for name, job := range jobs {
+		if job.State != StateSucceeded || job.Parent != id {
+			t.Errorf("job %s did not succeed: %+v", name, job)
+		}
+	}
+
+	// Jobs without needs run at the same time on different workers.
+	frontend, backend := jobs["frontend"], jobs["backend"]
+	if frontend.Worker == backend.Worker || !backend.StartedAt.Before(*frontend.FinishedAt) || !frontend.StartedAt.Before(*backend.FinishedAt) {
+		t.Errorf("independent jobs did not run in parallel: %+v %+v", frontend, backend)
+	}
+
+	// Jobs only start once everything they need has finished.
+	integration := jobs["integration"]
+	if integration.StartedAt.Before(*frontend.FinishedAt) || integration.StartedAt.Before(*backend.FinishedAt) {
+		t.Errorf("job started before its needs finished: %+v", integration)
+	}
+	if jobs["deploy"].StartedAt.Before(*integration.FinishedAt) {
+		t.Errorf("job started before its needs finished: %+v", jobs["deploy"])
+	}
+}
+
+func TestPipelineInherits(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	if err := config.secrets.set("DEPLOY_TOKEN", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Jobs get the variables, secrets and retry policy of the pipeline, but
+	// their own variables win.
+	id := postPipeline(t, config, `
+name: release
+env: {STAGE: prod, REGION: eu}
+secrets: [DEPLOY_TOKEN]
+retry: {attempts: 2}
+jobs:
+  - name: deploy
+    env: {REGION: us}
+    commands:
+      - echo "$STAGE $REGION $DEPLOY_TOKEN" > env.txt
+`)
+	waitForJob(t, config, id)
+
+	job := pipelineJobs(t, config, id)["deploy"]
+	if job.State != StateSucceeded {
+		t.Fatalf("job did not succeed: %+v", job)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(config.jobDir(job.Worker, job.ID), "env.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "prod us hunter2\n" {
+		t.Errorf("unexpected job environment: %q", b)
+	}
+	if job.Request.Retry == nil || job.Request.Retry.Attempts != 2 {
+		t.Errorf("retry policy was not inherited: %+v", job.Request.Retry)
+	}
+}
+
+func TestPipelineSkipsDependents(t *testing.T) {
+	config, cleanup := newTestConfig(t, 2)
+	defer cleanup()
+
+	id := postPipeline(t, config, `
+name: release
+jobs:
+  - name: frontend
+    commands: ["true"]
+  - name: backend
+    commands: ["exit 2"]
+  - name: integration
+    needs: [frontend, backend]
+    commands: ["true"]
+  - name: deploy
+    needs: [integration]
+    commands: ["true"]
+`)
+
+	pipeline := waitForJob(t, config, id)
+	if pipeline.State != StateFailed {
+		t.Fatalf("pipeline did not fail: %+v", pipeline)
+	}
+
+	jobs := pipelineJobs(t, config, id)
+
+	if jobs["frontend"].State != StateSucceeded || jobs["backend"].State != StateFailed {
+		t.Errorf("unexpected job states: %+v", jobs)
+	}
+
+	tests := map[string]string{
+		"integration": "needs backend, which failed",
+		"deploy":      "needs integration, which was skipped",
+	}
+
+	for name, reason := range tests {
+		job := jobs[name]
+		if job.State != StateSkipped || job.Reason != reason || job.StartedAt != nil {
+			t.Errorf("job %s was not skipped: %+v", name, job)
+		}
+	}
+}
+
+func TestCancelPipeline(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	id := postPipeline(t, config, `
+name: release
+jobs:
+  - name: build
+    commands: ["sleep 10"]
+  - name: deploy
+    needs: [build]
+    commands: ["true"]
+`)
+
+	jobs := pipelineJobs(t, config, id)
+	waitForState(t, config, jobs["build"].ID, StateRunning)
+
+	// Set up the request.
+	req, err := http.NewRequest("DELETE", "/job/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	if pipeline := waitForJob(t, config, id); pipeline.State != StateCancelled {
+		t.Errorf("pipeline was not cancelled: %+v", pipeline)
+	}
+
+	for name, job := range pipelineJobs(t, config, id) {
+		if job.State != StateCancelled {
+			t.Errorf("job %s was not cancelled: %+v", name, job)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/junland/conveyor/executor"
+)
+
+// Executor decides how the steps of a job are run. Every job is run by the
+// executor its image asks for.
+type Executor interface {
+	// Prepare readies the task of a job once its workspace is set up. env is
+	// the part of the server environment that jobs get, the environment it
+	// returns is the one the variables of the job are added to.
+	Prepare(t *executor.Task, req JobRequest, env []string) ([]string, error)
+}
+
+// executor returns the executor of a job: the shell of the host for jobs
+// without an image and an OCI image for the others.
+func (c *Config) executor(req JobRequest) Executor {
+	if req.Image != "" {
+		return &ociExecutor{c: c}
+	}
+	return &shellExecutor{c: c}
+}
+
+// shellExecutor runs the steps of a job with the shell of the host, in a
+// sandbox if the job asks for one.
+type shellExecutor struct {
+	c *Config
+}
+
+// Prepare sandboxes the task if needed and keeps the environment as it is.
+func (e *shellExecutor) Prepare(t *executor.Task, req JobRequest, env []string) ([]string, error) {
+	t.Sandbox = e.c.sandbox(req)
+	return env, nil
+}
+
+// ociExecutor runs the steps of a job in the root filesystem of an OCI or
+// docker image, which is unpacked from the images directory. Jobs in an
+// image are always sandboxed, with the network only if their sandbox asks
+// for it.
+type ociExecutor struct {
+	c *Config
+}
+
+// Prepare unpacks the image of the job and sandboxes the task in it. The
+// environment of the image takes the place of the one of the server.
+func (e *ociExecutor) Prepare(t *executor.Task, req JobRequest, env []string) ([]string, error) {
+	img, err := e.c.image(req.Image)
+	if err != nil {
+		return nil, fmt.Errorf("could not load image %s: %s", req.Image, err)
+	}
+	e.c.jobs.update(t.ID, func(j *Job) { j.ImageID = img.ID })
+
+	sb := &executor.Sandbox{Image: img.Root}
+	if req.Sandbox != nil && req.Sandbox.Network {
+		sb.Network = true
+		sb.Mounts = []string{"/etc/resolv.conf", "/etc/hosts"}
+	}
+	t.Sandbox = sb
+
+	return imageEnv(env, img.Env), nil
+}
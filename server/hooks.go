@@ -0,0 +1,547 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Webhook providers whose push events are understood.
+const (
+	ProviderGitHub = "github"
+	ProviderGitLab = "gitlab"
+	ProviderGitea  = "gitea"
+)
+
+// Outcomes of a webhook delivery.
+const (
+	DeliveryAccepted = "accepted"
+	DeliveryIgnored  = "ignored"
+	DeliveryRejected = "rejected"
+	DeliveryFailed   = "failed"
+)
+
+const (
+	// maxHookPayload limits the size of a webhook delivery.
+	maxHookPayload = 5 << 20
+	// maxDeliveries is the number of deliveries kept for every hook.
+	maxDeliveries = 100
+	// deliveriesKind is the kind of record deliveries are stored as.
+	deliveriesKind = "deliveries"
+)
+
+// triggerName matches the names of hooks and pollers.
+var triggerName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Hook maps the push events of a repository onto a pipeline.
+type Hook struct {
+	// Name is the last part of the URL the hook is delivered to.
+	Name string `yaml:"name"`
+	// Secret signs every delivery, GitLab sends it as a token instead.
+	Secret string `yaml:"secret,omitempty"`
+	// SecretName names a secret in the secret store that is used as Secret.
+	SecretName string `yaml:"secret_name,omitempty"`
+	// Branches limits the branches that are built, every branch if empty.
+	// Entries are patterns as understood by path.Match.
+	Branches []string `yaml:"branches,omitempty"`
+	// Pipeline is queued for every push, checking out the pushed commit.
+	Pipeline JobRequest `yaml:"pipeline"`
+}
+
+// Delivery records a webhook delivery and what became of it.
+type Delivery struct {
+	ID         string          `json:"id"`
+	Hook       string          `json:"hook"`
+	Provider   string          `json:"provider,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Status     string          `json:"status"`
+	Message    string          `json:"message,omitempty"`
+	Repo       string          `json:"repo,omitempty"`
+	Ref        string          `json:"ref,omitempty"`
+	Commit     string          `json:"commit,omitempty"`
+	Job        string          `json:"job,omitempty"`
+	ReplayOf   string          `json:"replay_of,omitempty"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+}
+
+// pushEvent holds the parts of a GitHub, GitLab or Gitea push event that
+// are needed to build the pushed commit.
+type pushEvent struct {
+	Ref         string `json:"ref"`
+	After       string `json:"after"`
+	CheckoutSHA string `json:"checkout_sha"`
+	Deleted     bool   `json:"deleted"`
+	Repository  struct {
+		CloneURL   string `json:"clone_url"`
+		GitHTTPURL string `json:"git_http_url"`
+	} `json:"repository"`
+	Project struct {
+		GitHTTPURL string `json:"git_http_url"`
+	} `json:"project"`
+}
+
+// repo returns the URL the pushed repository can be cloned from.
+func (e *pushEvent) repo() string {
+	for _, url := range []string{e.Repository.CloneURL, e.Repository.GitHTTPURL, e.Project.GitHTTPURL} {
+		if url != "" {
+			return url
+		}
+	}
+	return ""
+}
+
+// commit returns the commit the branch points to after the push.
+func (e *pushEvent) commit() string {
+	if e.CheckoutSHA != "" {
+		return e.CheckoutSHA
+	}
+	return e.After
+}
+
+// deleted reports whether the push removed the branch.
+func (e *pushEvent) deleted() bool {
+	return e.Deleted || strings.Trim(e.commit(), "0") == ""
+}
+
+// validate checks that the hook can be delivered to and queue its pipeline.
+func (h *Hook) validate() error {
+	if (h.Secret == "") == (h.SecretName == "") {
+		return errors.New("hook needs either a secret or a secret_name")
+	}
+	return validateTrigger(h.Name, h.Branches, &h.Pipeline)
+}
+
+// validateTrigger checks the parts that hooks and pollers have in common.
+func validateTrigger(name string, branches []string, pipeline *JobRequest) error {
+	if !triggerName.MatchString(name) {
+		return errors.New("names can only contain letters, digits, dots, dashes and underscores")
+	}
+	for _, pattern := range branches {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid branch pattern %q", pattern)
+		}
+	}
+	if pipeline.Name == "" {
+		pipeline.Name = name
+	}
+	if len(pipeline.Needs) > 0 {
+		return errors.New("needs can only be used by the jobs of a pipeline")
+	}
+	return pipeline.validate()
+}
+
+// matchBranch reports whether a branch matches one of the patterns, every
+// branch matches if there are none.
+func matchBranch(patterns []string, branch string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceRequest returns a pipeline checking out a commit of a branch. A
+// source configured in the pipeline, for example one pointing at a mirror,
+// keeps its repository.
+func sourceRequest(pipeline JobRequest, repo, branch, commit string) JobRequest {
+	req := pipeline
+	src := Source{Repo: repo}
+	if pipeline.Source != nil {
+		src = *pipeline.Source
+	}
+	src.Ref = branch
+	src.Commit = commit
+	req.Source = &src
+	return req
+}
+
+// loadHooks reads the webhook definitions from the hooks file, if one is
+// configured.
+func (c *Config) loadHooks() error {
+	c.hooks = make(map[string]*Hook)
+
+	if c.HooksFile == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(c.HooksFile)
+	if err != nil {
+		return err
+	}
+
+	var file struct {
+		Hooks []Hook `yaml:"hooks"`
+	}
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return fmt.Errorf("could not parse %s: %s", c.HooksFile, err)
+	}
+
+	for i := range file.Hooks {
+		h := &file.Hooks[i]
+		if err := h.validate(); err != nil {
+			return fmt.Errorf("hook %q: %s", h.Name, err)
+		}
+		if _, ok := c.hooks[h.Name]; ok {
+			return fmt.Errorf("hook %q is defined more than once", h.Name)
+		}
+		c.hooks[h.Name] = h
+	}
+
+	log.Infof("Loaded %d webhooks from %s", len(c.hooks), c.HooksFile)
+
+	return nil
+}
+
+// hookSecret returns the secret deliveries to a hook are verified with.
+func (c *Config) hookSecret(h *Hook) (string, error) {
+	if h.SecretName == "" {
+		return h.Secret, nil
+	}
+	secrets, err := c.lookupSecrets([]string{h.SecretName})
+	if err != nil {
+		return "", err
+	}
+	return secrets[h.SecretName], nil
+}
+
+// hookProvider works out who sent a delivery and the kind of event it holds.
+// Gitea also sends the headers of GitHub, so it is looked for first.
+func hookProvider(header http.Header) (string, string) {
+	switch {
+	case header.Get("X-Gitea-Event") != "":
+		return ProviderGitea, header.Get("X-Gitea-Event")
+	case header.Get("X-Gitlab-Event") != "":
+		// GitLab names its events "Push Hook", "Tag Push Hook" and so on.
+		event := strings.TrimSuffix(header.Get("X-Gitlab-Event"), " Hook")
+		return ProviderGitLab, strings.Replace(strings.ToLower(event), " ", "_", -1)
+	case header.Get("X-GitHub-Event") != "":
+		return ProviderGitHub, header.Get("X-GitHub-Event")
+	}
+	return "", ""
+}
+
+// verifyDelivery checks that a delivery was sent by someone who knows the
+// secret of the hook. GitHub and Gitea sign the payload with HMAC-SHA256,
+// GitLab sends the secret itself.
+func verifyDelivery(provider string, header http.Header, body []byte, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	switch provider {
+	case ProviderGitHub:
+		sig := header.Get("X-Hub-Signature-256")
+		return strings.HasPrefix(sig, "sha256=") && validMAC(body, strings.TrimPrefix(sig, "sha256="), secret)
+	case ProviderGitea:
+		return validMAC(body, header.Get("X-Gitea-Signature"), secret)
+	case ProviderGitLab:
+		return subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(secret)) == 1
+	}
+	return false
+}
+
+// validMAC reports whether signature is the hex encoded HMAC-SHA256 of body.
+func validMAC(body []byte, signature, secret string) bool {
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// deliver queues the pipeline of a hook for a verified delivery and records
+// the outcome in the delivery. It returns the HTTP status to respond with.
+func (c *Config) deliver(h *Hook, d *Delivery) int {
+	ignore := func(format string, args ...interface{}) int {
+		d.Status = DeliveryIgnored
+		d.Message = fmt.Sprintf(format, args...)
+		return http.StatusOK
+	}
+	fail := func(status int, format string, args ...interface{}) int {
+		d.Status = DeliveryFailed
+		d.Message = fmt.Sprintf(format, args...)
+		return status
+	}
+
+	if d.Event != "push" {
+		return ignore("%s events are not built", d.Event)
+	}
+
+	var event pushEvent
+	if err := json.Unmarshal(d.Payload, &event); err != nil {
+		return fail(http.StatusBadRequest, "could not parse payload: %s", err)
+	}
+
+	d.Repo = event.repo()
+	d.Ref = event.Ref
+	d.Commit = event.commit()
+
+	branch := strings.TrimPrefix(event.Ref, "refs/heads/")
+	switch {
+	case branch == event.Ref:
+		return ignore("%s is not a branch", event.Ref)
+	case event.deleted():
+		return ignore("branch %s was deleted", branch)
+	case !matchBranch(h.Branches, branch):
+		return ignore("branch %s is not built", branch)
+	}
+
+	req := sourceRequest(h.Pipeline, d.Repo, branch, d.Commit)
+	if err := req.validate(); err != nil {
+		return fail(http.StatusBadRequest, "%s", err)
+	}
+	if err := c.checkSecrets(&req); err != nil {
+		return fail(http.StatusBadRequest, "%s", err)
+	}
+
+	job, _, err := c.queueJob(req)
+	d.Job = job.ID
+	if err != nil {
+		log.Errorf("Could not submit job %s: %s", job.ID, err)
+		return fail(http.StatusInternalServerError, "could not submit job: %s", err)
+	}
+
+	log.Infof("Delivery %s to hook %s queued job %s for %s at %s", d.ID, h.Name, job.ID, branch, d.Commit)
+
+	d.Status = DeliveryAccepted
+	return http.StatusOK
+}
+
+// saveDelivery stores a delivery and drops the oldest deliveries of its hook.
+func (c *Config) saveDelivery(d *Delivery) {
+	if err := c.jobs.store.Put(deliveriesKind, d.ID, d); err != nil {
+		log.Errorf("Could not save delivery %s: %s", d.ID, err)
+		return
+	}
+
+	deliveries, err := c.deliveries(d.Hook)
+	if err != nil {
+		log.Errorf("Could not load deliveries of hook %s: %s", d.Hook, err)
+		return
+	}
+	for i := maxDeliveries; i < len(deliveries); i++ {
+		if err := c.jobs.store.Delete(deliveriesKind, deliveries[i].ID); err != nil {
+			log.Errorf("Could not delete delivery %s: %s", deliveries[i].ID, err)
+		}
+	}
+}
+
+// deliveries returns the stored deliveries of a hook, newest first.
+func (c *Config) deliveries(hook string) ([]*Delivery, error) {
+	var deliveries []*Delivery
+	err := c.jobs.store.List(deliveriesKind, func(id string, data []byte) error {
+		var d Delivery
+		if err := json.Unmarshal(data, &d); err != nil {
+			return err
+		}
+		if d.Hook == hook {
+			deliveries = append(deliveries, &d)
+		}
+		return nil
+	})
+
+	sort.Slice(deliveries, func(i, k int) bool {
+		if !deliveries[i].ReceivedAt.Equal(deliveries[k].ReceivedAt) {
+			return deliveries[i].ReceivedAt.After(deliveries[k].ReceivedAt)
+		}
+		return deliveries[i].ID > deliveries[k].ID
+	})
+
+	return deliveries, err
+}
+
+// delivery returns a stored delivery of a hook.
+func (c *Config) delivery(hook, id string) (*Delivery, bool) {
+	deliveries, err := c.deliveries(hook)
+	if err != nil {
+		log.Errorf("Could not load deliveries of hook %s: %s", hook, err)
+		return nil, false
+	}
+	for _, d := range deliveries {
+		if d.ID == id {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// respondDelivery tells the sender of a delivery what became of it.
+func respondDelivery(w http.ResponseWriter, status int, d *Delivery) {
+	resp := map[string]interface{}{"delivery": d.ID, "status": d.Status}
+	switch d.Status {
+	case DeliveryAccepted:
+		resp["message"] = "Delivery accepted."
+		resp["id"] = d.Job
+	case DeliveryIgnored:
+		resp["message"] = "Delivery ignored: " + d.Message + "."
+	default:
+		resp["error"] = "Delivery " + d.Status + ": " + d.Message + "."
+	}
+	respondJSON(w, status, resp)
+}
+
+// ReceiveHook handles a push event delivered to a hook. The delivery is
+// verified with the secret of the hook before the pipeline of the hook is
+// queued for the pushed commit. Every delivery is recorded.
+func (c *Config) ReceiveHook(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+	name := ps.ByName("name")
+
+	hook, ok := c.hooks[name]
+	if !ok {
+		respondError(w, http.StatusNotFound, "Hook not found.")
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHookPayload+1))
+	if err != nil {
+		log.Errorf("Something went wrong with reading the delivery to hook %s: %s", name, err)
+		respondError(w, http.StatusBadRequest, "Could not read request.")
+		return
+	}
+	if len(body) > maxHookPayload {
+		respondError(w, http.StatusRequestEntityTooLarge, "Payload too large.")
+		return
+	}
+
+	provider, event := hookProvider(r.Header)
+
+	d := &Delivery{ID: newJobID(), Hook: name, Provider: provider, Event: event, ReceivedAt: time.Now()}
+
+	secret, err := c.hookSecret(hook)
+	if err != nil {
+		log.Errorf("Could not look up the secret of hook %s: %s", name, err)
+		respondError(w, http.StatusInternalServerError, "Could not verify delivery.")
+		return
+	}
+
+	var status int
+	switch {
+	case provider == "":
+		log.Warnf("Rejected delivery %s to hook %s from an unknown webhook provider", d.ID, name)
+		d.Status, d.Message = DeliveryRejected, "unknown webhook provider"
+		status = http.StatusBadRequest
+	case !verifyDelivery(provider, r.Header, body, secret):
+		log.Warnf("Rejected delivery %s to hook %s with an invalid signature", d.ID, name)
+		d.Status, d.Message = DeliveryRejected, "invalid signature"
+		status = http.StatusUnauthorized
+	case !json.Valid(body):
+		d.Status, d.Message = DeliveryFailed, "payload is not json"
+		status = http.StatusBadRequest
+	default:
+		// Only verified payloads are kept, so that they can be replayed.
+		d.Payload = body
+		status = c.deliver(hook, d)
+	}
+
+	// Rejected deliveries are only logged, so that anyone without the secret
+	// cannot push the real deliveries of the hook out of its history.
+	if d.Status != DeliveryRejected {
+		c.saveDelivery(d)
+	}
+
+	respondDelivery(w, status, d)
+}
+
+// ListDeliveries lists the recorded deliveries of a hook, newest first. The
+// payloads are left out, they are served with every single delivery.
+func (c *Config) ListDeliveries(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+	name := ps.ByName("name")
+
+	if _, ok := c.hooks[name]; !ok {
+		respondError(w, http.StatusNotFound, "Hook not found.")
+		return
+	}
+
+	deliveries, err := c.deliveries(name)
+	if err != nil {
+		log.Errorf("Could not load deliveries of hook %s: %s", name, err)
+		respondError(w, http.StatusInternalServerError, "Could not load deliveries.")
+		return
+	}
+
+	for _, d := range deliveries {
+		d.Payload = nil
+	}
+	if deliveries == nil {
+		deliveries = []*Delivery{}
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{"deliveries": deliveries})
+}
+
+// GetDelivery serves a recorded delivery including its payload.
+func (c *Config) GetDelivery(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+
+	d, ok := c.delivery(ps.ByName("name"), ps.ByName("delivery"))
+	if !ok {
+		respondError(w, http.StatusNotFound, "Delivery not found.")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, d)
+}
+
+// ReplayDelivery handles a recorded delivery again with the current
+// definition of its hook. The replay is recorded as a new delivery.
+func (c *Config) ReplayDelivery(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+	name := ps.ByName("name")
+
+	hook, ok := c.hooks[name]
+	if !ok {
+		respondError(w, http.StatusNotFound, "Hook not found.")
+		return
+	}
+
+	original, ok := c.delivery(name, ps.ByName("delivery"))
+	if !ok {
+		respondError(w, http.StatusNotFound, "Delivery not found.")
+		return
+	}
+
+	if len(original.Payload) == 0 {
+		respondError(w, http.StatusBadRequest, "Only deliveries with a JSON payload can be replayed.")
+		return
+	}
+
+	d := &Delivery{
+		ID:         newJobID(),
+		Hook:       name,
+		Provider:   original.Provider,
+		Event:      original.Event,
+		ReceivedAt: time.Now(),
+		ReplayOf:   original.ID,
+		Payload:    original.Payload,
+	}
+
+	status := c.deliver(hook, d)
+
+	c.saveDelivery(d)
+
+	respondDelivery(w, status, d)
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadTestHooks writes a hooks file and loads it into the configuration.
+func loadTestHooks(t *testing.T, config *Config, hooks string) {
+	config.HooksFile = filepath.Join(filepath.Dir(config.WorkersDir), "hooks.yml")
+	if err := ioutil.WriteFile(config.HooksFile, []byte(hooks), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.loadHooks(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sign returns the hex encoded HMAC-SHA256 of body.
+func sign(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverHook posts a payload to a hook and returns the decoded response.
+func deliverHook(t *testing.T, config *Config, url string, headers map[string]string, body string, want int) map[string]interface{} {
+	// Set up the request.
+	req, err := http.NewRequest("POST", url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != want {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, want, rr.Body.String())
+	}
+
+	var resp map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// githubPush returns a push event as sent by GitHub along with its headers.
+func githubPush(repo, ref, commit, secret string) (string, map[string]string) {
+	body := `{"ref": "` + ref + `", "after": "` + commit + `", "repository": {"clone_url": "` + repo + `"}}`
+	return body, map[string]string{
+		"X-GitHub-Event":      "push",
+		"X-Hub-Signature-256": "sha256=" + sign(body, secret),
+	}
+}
+
+const testHooks = `
+hooks:
+  - name: app
+    secret: s3cret
+    branches: ["main", "release/*"]
+    pipeline:
+      commands: ["echo $CONVEYOR_REF $(cat file.txt) > result.out"]
+`
+
+func TestHookInvalid(t *testing.T) {
+	tests := []Hook{
+		{Name: "a b", Secret: "x", Pipeline: JobRequest{Commands: []string{"ls"}}},
+		{Name: "app", Pipeline: JobRequest{Commands: []string{"ls"}}},
+		{Name: "app", Secret: "x", SecretName: "X", Pipeline: JobRequest{Commands: []string{"ls"}}},
+		{Name: "app", Secret: "x", Branches: []string{"["}, Pipeline: JobRequest{Commands: []string{"ls"}}},
+		{Name: "app", Secret: "x", Pipeline: JobRequest{Commands: []string{"ls"}, Timeout: -1}},
+	}
+
+	for _, hook := range tests {
+		if err := hook.validate(); err == nil {
+			t.Errorf("expected an error for %+v", hook)
+		}
+	}
+}
+
+func TestVerifyDelivery(t *testing.T) {
+	body := []byte(`{"ref": "refs/heads/main"}`)
+
+	tests := []struct {
+		provider string
+		header   http.Header
+		valid    bool
+	}{
+		{ProviderGitHub, http.Header{"X-Hub-Signature-256": {"sha256=" + sign(string(body), "s3cret")}}, true},
+		{ProviderGitHub, http.Header{"X-Hub-Signature-256": {"sha256=" + sign(string(body), "other")}}, false},
+		{ProviderGitHub, http.Header{"X-Hub-Signature-256": {sign(string(body), "s3cret")}}, false},
+		{ProviderGitea, http.Header{"X-Gitea-Signature": {sign(string(body), "s3cret")}}, true},
+		{ProviderGitea, http.Header{"X-Gitea-Signature": {"nothex"}}, false},
+		{ProviderGitLab, http.Header{"X-Gitlab-Token": {"s3cret"}}, true},
+		{ProviderGitLab, http.Header{"X-Gitlab-Token": {"s3cre"}}, false},
+		{ProviderGitLab, http.Header{}, false},
+	}
+
+	for _, test := range tests {
+		if got := verifyDelivery(test.provider, test.header, body, "s3cret"); got != test.valid {
+			t.Errorf("unexpected result for %s %v: got %v want %v", test.provider, test.header, got, test.valid)
+		}
+	}
+}
+
+func TestReceiveHook(t *testing.T) {
+	repo, commits := newTestRepo(t, "first", "second")
+	defer os.RemoveAll(repo)
+
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	loadTestHooks(t, config, testHooks)
+
+	// A GitHub push to a built branch queues the pipeline at the pushed commit.
+	body, headers := githubPush(repo, "refs/heads/main", commits[0], "s3cret")
+	resp := deliverHook(t, config, "/hooks/app", headers, body, http.StatusOK)
+
+	if resp["status"] != DeliveryAccepted {
+		t.Fatalf("delivery was not accepted: %v", resp)
+	}
+
+	id := resp["id"].(string)
+	job := waitForJob(t, config, id)
+	if job.State != StateSucceeded || job.Name != "app" || job.Commit != commits[0] {
+		t.Fatalf("unexpected job: %+v", job)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(config.jobDir(1, id), "result.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "main first\n" {
+		t.Errorf("unexpected checkout: %q", b)
+	}
+
+	// GitLab sends its secret as a token.
+	body = `{"ref": "refs/heads/main", "checkout_sha": "` + commits[1] + `", "project": {"git_http_url": "` + repo + `"}}`
+	resp = deliverHook(t, config, "/hooks/app", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "s3cret"}, body, http.StatusOK)
+
+	if job := waitForJob(t, config, resp["id"].(string)); job.State != StateSucceeded || job.Commit != commits[1] {
+		t.Errorf("unexpected job for gitlab push: %+v", job)
+	}
+
+	// Pushes to other branches, deleted branches and other events are ignored.
+	body, headers = githubPush(repo, "refs/heads/feature", commits[1], "s3cret")
+	if resp := deliverHook(t, config, "/hooks/app", headers, body, http.StatusOK); resp["status"] != DeliveryIgnored {
+		t.Errorf("push to feature branch was not ignored: %v", resp)
+	}
+
+	body, headers = githubPush(repo, "refs/heads/main", "0000000000000000000000000000000000000000", "s3cret")
+	if resp := deliverHook(t, config, "/hooks/app", headers, body, http.StatusOK); resp["status"] != DeliveryIgnored {
+		t.Errorf("deleted branch was not ignored: %v", resp)
+	}
+
+	headers["X-GitHub-Event"] = "issues"
+	if resp := deliverHook(t, config, "/hooks/app", headers, body, http.StatusOK); resp["status"] != DeliveryIgnored {
+		t.Errorf("issues event was not ignored: %v", resp)
+	}
+
+	// Deliveries with a bad signature are rejected and not recorded.
+	body, headers = githubPush(repo, "refs/heads/main", commits[1], "wrong")
+	if resp := deliverHook(t, config, "/hooks/app", headers, body, http.StatusUnauthorized); resp["status"] != DeliveryRejected {
+		t.Errorf("delivery with bad signature was not rejected: %v", resp)
+	}
+
+	deliverHook(t, config, "/hooks/other", headers, body, http.StatusNotFound)
+
+	deliveries, err := config.deliveries("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{DeliveryIgnored, DeliveryIgnored, DeliveryIgnored, DeliveryAccepted, DeliveryAccepted}
+	if len(deliveries) != len(want) {
+		t.Fatalf("unexpected number of deliveries: got %d want %d", len(deliveries), len(want))
+	}
+	for i, d := range deliveries {
+		if d.Status != want[i] {
+			t.Errorf("unexpected status of delivery %d: got %s want %s", i, d.Status, want[i])
+		}
+	}
+	if deliveries[4].Job != id || deliveries[4].Provider != ProviderGitHub || deliveries[4].Commit != commits[0] {
+		t.Errorf("unexpected delivery: %+v", deliveries[4])
+	}
+}
+
+func TestReplayDelivery(t *testing.T) {
+	repo, commits := newTestRepo(t, "first")
+	defer os.RemoveAll(repo)
+
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	loadTestHooks(t, config, testHooks)
+
+	body, headers := githubPush(repo, "refs/heads/main", commits[0], "s3cret")
+	resp := deliverHook(t, config, "/hooks/app", headers, body, http.StatusOK)
+
+	delivery := resp["delivery"].(string)
+	first := resp["id"].(string)
+
+	// Set up the request.
+	req, err := http.NewRequest("GET", "/hooks/app/deliveries/"+delivery, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	var d Delivery
+	if err := json.Unmarshal(rr.Body.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || d.ID != delivery || d.Status != DeliveryAccepted || d.Job != first || len(d.Payload) == 0 {
+		t.Fatalf("unexpected delivery: %d %s", rr.Code, rr.Body.String())
+	}
+
+	resp = deliverHook(t, config, "/hooks/app/deliveries/"+delivery+"/replay", nil, "", http.StatusOK)
+
+	second, _ := resp["id"].(string)
+	if resp["status"] != DeliveryAccepted || second == "" || second == first {
+		t.Fatalf("replay did not queue a new job: %v", resp)
+	}
+
+	if job := waitForJob(t, config, second); job.State != StateSucceeded || job.Commit != commits[0] {
+		t.Errorf("unexpected job for replay: %+v", job)
+	}
+
+	replay, ok := config.delivery("app", resp["delivery"].(string))
+	if !ok || replay.ReplayOf != delivery {
+		t.Errorf("replay was not recorded: %+v", replay)
+	}
+
+	// Deliveries that were not verified are not recorded, so they cannot be
+	// replayed, and neither can deliveries without a JSON payload.
+	body, headers = githubPush(repo, "refs/heads/main", commits[0], "wrong")
+	resp = deliverHook(t, config, "/hooks/app", headers, body, http.StatusUnauthorized)
+	deliverHook(t, config, "/hooks/app/deliveries/"+resp["delivery"].(string)+"/replay", nil, "", http.StatusNotFound)
+
+	headers["X-Hub-Signature-256"] = "sha256=" + sign("not json", "s3cret")
+	resp = deliverHook(t, config, "/hooks/app", headers, "not json", http.StatusBadRequest)
+	deliverHook(t, config, "/hooks/app/deliveries/"+resp["delivery"].(string)+"/replay", nil, "", http.StatusBadRequest)
+	deliverHook(t, config, "/hooks/app/deliveries/missing/replay", nil, "", http.StatusNotFound)
+}
@@ -0,0 +1,453 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/junland/conveyor/executor"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultPath is the PATH of jobs whose image does not set one.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// digestPattern matches the content digests of OCI images.
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// image is an image whose root filesystem has been unpacked.
+type image struct {
+	// ID is the digest of the configuration of the image.
+	ID   string
+	Root string
+	Env  []string
+}
+
+// imageStore keeps track of the images that have been unpacked, so that the
+// images of a job are only read again when their file changes.
+type imageStore struct {
+	mu     sync.Mutex
+	images map[string]*image
+}
+
+// newImageStore creates an image store for the images unpacked in dir and
+// removes what was left of images that were being unpacked when the server
+// stopped.
+func newImageStore(dir string) *imageStore {
+	stale, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	for _, path := range stale {
+		os.RemoveAll(path)
+	}
+	return &imageStore{images: map[string]*image{}}
+}
+
+// validateImage checks an image reference of a job request, which is the
+// path of an image in the images directory followed by an optional tag.
+func validateImage(ref string) error {
+	if runtime.GOOS != "linux" {
+		return errors.New("images are only supported on Linux")
+	}
+	if path, _ := splitImage(ref); !workspacePath(path) {
+		return fmt.Errorf("%q is not a path in the images directory", ref)
+	}
+	return nil
+}
+
+// splitImage splits an image reference into its path and its tag.
+func splitImage(ref string) (string, string) {
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i:], "/") {
+		return ref, ""
+	}
+	return ref[:i], ref[i+1:]
+}
+
+// imageDir returns the directory the root filesystems of images are
+// unpacked in.
+func (c *Config) imageDir() string {
+	return c.WorkersDir + "_images"
+}
+
+// image returns the unpacked image a job reference points to, unpacking it
+// first if needed. Images are either tarballs saved by docker or OCI image
+// layouts, as directories or as tarballs.
+func (c *Config) image(ref string) (*image, error) {
+	path, tag := splitImage(ref)
+	file := filepath.Join(c.ImagesDir, path)
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c.images.mu.Lock()
+	defer c.images.mu.Unlock()
+
+	key := fmt.Sprintf("%s:%s:%d:%d", file, tag, info.Size(), info.ModTime().UnixNano())
+	if img, ok := c.images.images[key]; ok {
+		if _, err := os.Stat(img.Root); err == nil {
+			return img, nil
+		}
+	}
+
+	dir := file
+	if !info.IsDir() {
+		if dir, err = ioutil.TempDir(c.imageDir(), ".archive-"); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		log.Debug("Extracting image " + file)
+		if err := extractFile(dir, file, ""); err != nil {
+			return nil, fmt.Errorf("could not extract image: %s", err)
+		}
+	}
+
+	var m *imageManifest
+	if _, err := os.Stat(filepath.Join(dir, "oci-layout")); err == nil {
+		m, err = readOCILayout(dir, tag)
+		if err != nil {
+			return nil, err
+		}
+	} else if m, err = readDockerArchive(dir, tag); err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Config struct {
+			Env []string `json:"Env"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(m.config, &config); err != nil {
+		return nil, fmt.Errorf("invalid image configuration: %s", err)
+	}
+
+	sum := sha256.Sum256(m.config)
+	img := &image{
+		ID:   "sha256:" + hex.EncodeToString(sum[:]),
+		Root: filepath.Join(c.imageDir(), hex.EncodeToString(sum[:])),
+		Env:  config.Config.Env,
+	}
+
+	if _, err := os.Stat(img.Root); os.IsNotExist(err) {
+		log.Infof("Unpacking image %s with %d layers", ref, len(m.layers))
+		if err := c.unpackImage(img.Root, dir, m); err != nil {
+			return nil, err
+		}
+	}
+
+	c.images.images[key] = img
+	return img, nil
+}
+
+// unpackImage applies the layers of an image one after the other to a new
+// root filesystem, which is only moved to root once it is complete.
+func (c *Config) unpackImage(root, dir string, m *imageManifest) error {
+	tmp, err := ioutil.TempDir(c.imageDir(), ".rootfs-")
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range m.layers {
+		if err := extractFile(tmp, filepath.Join(dir, layer.path), layer.digest); err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("could not unpack layer %s: %s", layer.path, err)
+		}
+	}
+
+	if err := os.Chmod(tmp, 0755); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, root); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return nil
+}
+
+// extractFile extracts a tarball onto dir. If digest is set, the contents
+// of the file have to match it.
+func extractFile(dir, file, digest string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	r := io.TeeReader(f, h)
+	if err := executor.ExtractLayer(dir, r); err != nil {
+		return err
+	}
+	if digest == "" {
+		return nil
+	}
+
+	// Whatever follows the end of the tarball is part of the digest too.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	if sum := "sha256:" + hex.EncodeToString(h.Sum(nil)); sum != digest {
+		return fmt.Errorf("digest %s does not match %s", sum, digest)
+	}
+	return nil
+}
+
+// imageManifest is what is needed from an image to unpack it.
+type imageManifest struct {
+	config []byte
+	layers []imageLayer
+}
+
+// imageLayer is a layer tarball of an image. Its digest is only known for
+// OCI image layouts.
+type imageLayer struct {
+	path   string
+	digest string
+}
+
+// readDockerArchive reads the manifest of an image saved by docker save. The
+// tag picks one of the images of the archive, which can be left out if there
+// is only one.
+func readDockerArchive(dir, tag string) (*imageManifest, error) {
+	path, err := archiveFile(dir, "manifest.json")
+	if os.IsNotExist(err) {
+		return nil, errors.New("neither an OCI image layout nor a docker image archive")
+	} else if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []struct {
+		Config   string   `json:"Config"`
+		RepoTags []string `json:"RepoTags"`
+		Layers   []string `json:"Layers"`
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("invalid image manifest: %s", err)
+	}
+
+	var found []int
+	for i, e := range entries {
+		if tag == "" {
+			found = append(found, i)
+			continue
+		}
+		for _, t := range e.RepoTags {
+			if t == tag || strings.HasSuffix(t, ":"+tag) {
+				found = append(found, i)
+				break
+			}
+		}
+	}
+	if len(found) != 1 {
+		return nil, imageNotFound(tag, len(found))
+	}
+	e := entries[found[0]]
+
+	for _, p := range append([]string{e.Config}, e.Layers...) {
+		if _, err := archiveFile(dir, p); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &imageManifest{}
+	if m.config, err = ioutil.ReadFile(filepath.Join(dir, e.Config)); err != nil {
+		return nil, err
+	}
+	for _, p := range e.Layers {
+		m.layers = append(m.layers, imageLayer{path: p})
+	}
+	return m, nil
+}
+
+// archiveFile returns where the file p of a docker image archive is in dir.
+// The archive was extracted as it is and its symbolic links could point
+// anywhere on the host, so p has to be a regular file that is not reached
+// through any link.
+func archiveFile(dir, p string) (string, error) {
+	if !workspacePath(p) {
+		return "", fmt.Errorf("invalid path %q in image manifest", p)
+	}
+
+	path := dir
+	var info os.FileInfo
+	for _, part := range strings.Split(filepath.Clean(p), string(filepath.Separator)) {
+		path = filepath.Join(path, part)
+		var err error
+		if info, err = os.Lstat(path); err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s in image archive is a symbolic link", p)
+		}
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s in image archive is not a file", p)
+	}
+	return path, nil
+}
+
+// ociDescriptor points to a blob of an OCI image layout.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform"`
+}
+
+const (
+	ociIndexType = "application/vnd.oci.image.index.v1+json"
+	// dockerListType is the docker counterpart of an OCI image index.
+	dockerListType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	// ociRefName is the annotation that holds the tag of an image.
+	ociRefName = "org.opencontainers.image.ref.name"
+)
+
+// readOCILayout reads the manifest of an image from an OCI image layout. The
+// tag picks one of the images of the layout by its reference name and can be
+// left out if there is only one. Image indexes pick the image of this
+// platform.
+func readOCILayout(dir, tag string) (*imageManifest, error) {
+	var index struct {
+		Manifests []ociDescriptor `json:"manifests"`
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("invalid image index: %s", err)
+	}
+
+	var found []ociDescriptor
+	for _, d := range index.Manifests {
+		if tag == "" || d.Annotations[ociRefName] == tag {
+			found = append(found, d)
+		}
+	}
+	if len(found) != 1 {
+		return nil, imageNotFound(tag, len(found))
+	}
+	desc := found[0]
+
+	for desc.MediaType == ociIndexType || desc.MediaType == dockerListType {
+		if b, err = readBlob(dir, desc.Digest); err != nil {
+			return nil, err
+		}
+		index.Manifests = nil
+		if err := json.Unmarshal(b, &index); err != nil {
+			return nil, fmt.Errorf("invalid image index: %s", err)
+		}
+
+		found = nil
+		for _, d := range index.Manifests {
+			if d.Platform != nil && d.Platform.OS == "linux" && d.Platform.Architecture == runtime.GOARCH {
+				found = append(found, d)
+			}
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("image has no manifest for linux/%s", runtime.GOARCH)
+		}
+		desc = found[0]
+	}
+
+	var manifest struct {
+		Config ociDescriptor   `json:"config"`
+		Layers []ociDescriptor `json:"layers"`
+	}
+	if b, err = readBlob(dir, desc.Digest); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid image manifest: %s", err)
+	}
+
+	m := &imageManifest{}
+	if m.config, err = readBlob(dir, manifest.Config.Digest); err != nil {
+		return nil, err
+	}
+	for _, l := range manifest.Layers {
+		if !digestPattern.MatchString(l.Digest) {
+			return nil, fmt.Errorf("unsupported digest %q", l.Digest)
+		}
+		if strings.HasSuffix(l.MediaType, "+zstd") {
+			return nil, errors.New("layers compressed with zstd are not supported")
+		}
+		m.layers = append(m.layers, imageLayer{path: layoutPath(l.Digest), digest: l.Digest})
+	}
+	return m, nil
+}
+
+// readBlob reads a blob of an OCI image layout and checks its digest.
+func readBlob(dir, digest string) ([]byte, error) {
+	if !digestPattern.MatchString(digest) {
+		return nil, fmt.Errorf("unsupported digest %q", digest)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, layoutPath(digest)))
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(b); "sha256:"+hex.EncodeToString(sum[:]) != digest {
+		return nil, fmt.Errorf("blob %s does not match its digest", digest)
+	}
+	return b, nil
+}
+
+// layoutPath returns where a blob is in an OCI image layout.
+func layoutPath(digest string) string {
+	return filepath.Join("blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// imageNotFound explains why no single image was found for a tag.
+func imageNotFound(tag string, n int) error {
+	switch {
+	case n > 0:
+		return fmt.Errorf("image has %d images, pick one with a tag", n)
+	case tag != "":
+		return fmt.Errorf("image has no tag %q", tag)
+	default:
+		return errors.New("image is empty")
+	}
+}
+
+// imageEnv returns the environment of a job that runs in an image: the
+// variables of the image, with a default PATH if it has none, and the ones
+// of env it does not set. The PATH of the server never makes sense in an
+// image.
+func imageEnv(env, vars []string) []string {
+	set := map[string]bool{"PATH": true}
+	path := false
+	for _, v := range vars {
+		name := strings.SplitN(v, "=", 2)[0]
+		set[name] = true
+		path = path || name == "PATH"
+	}
+
+	var out []string
+	for _, v := range env {
+		if !set[strings.SplitN(v, "=", 2)[0]] {
+			out = append(out, v)
+		}
+	}
+	if !path {
+		out = append(out, "PATH="+defaultPath)
+	}
+	return append(out, vars...)
+}
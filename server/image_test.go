@@ -0,0 +1,258 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// imageConfig is the configuration of the test images.
+const imageConfig = `{"architecture": "amd64", "os": "linux", "config": {"Env": ["PATH=/bin", "IMAGE_VAR=set"]}}`
+
+// imageLayers returns the layers of a test image: a shell with its libraries
+// and a file that is removed again by the second layer.
+func imageLayers(t *testing.T) [][]byte {
+	out, err := exec.Command("ldd", "/bin/sh").Output()
+	if err != nil {
+		t.Skipf("cannot find the libraries of /bin/sh: %s", err)
+	}
+
+	files := map[string]string{"etc/version": "1\n", "etc/gone": "x"}
+	paths := []string{"/bin/sh"}
+	for _, line := range strings.Split(string(out), "\n") {
+		for _, field := range strings.Fields(line) {
+			if filepath.IsAbs(field) {
+				paths = append(paths, field)
+			}
+		}
+	}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Skipf("cannot read %s: %s", path, err)
+		}
+		files[strings.TrimPrefix(path, "/")] = string(b)
+	}
+
+	return [][]byte{
+		tarball(t, files),
+		tarball(t, map[string]string{"etc/version": "2\n", "etc/.wh.gone": ""}),
+	}
+}
+
+// tarball returns a tarball of files, which are all executable.
+func tarball(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, body := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(body))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// writeDockerArchive writes a test image the way docker save does.
+func writeDockerArchive(t *testing.T, path string, layers [][]byte) {
+	config := strings.TrimPrefix(digest([]byte(imageConfig)), "sha256:") + ".json"
+	files := map[string]string{config: imageConfig}
+
+	var names []string
+	for i, layer := range layers {
+		name := string(rune('a'+i)) + "/layer.tar"
+		files[name] = string(layer)
+		names = append(names, name)
+	}
+
+	manifest, _ := json.Marshal([]map[string]interface{}{
+		{"Config": config, "RepoTags": []string{"tools:1"}, "Layers": names},
+	})
+	files["manifest.json"] = string(manifest)
+
+	if err := ioutil.WriteFile(path, tarball(t, files), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeOCILayout writes a test image as an OCI image layout with compressed
+// layers.
+func writeOCILayout(t *testing.T, dir string, layers [][]byte) {
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	os.MkdirAll(blobs, 0755)
+
+	blob := func(mediaType string, b []byte) map[string]interface{} {
+		d := digest(b)
+		ioutil.WriteFile(filepath.Join(blobs, strings.TrimPrefix(d, "sha256:")), b, 0644)
+		return map[string]interface{}{"mediaType": mediaType, "digest": d, "size": len(b)}
+	}
+
+	var descs []map[string]interface{}
+	for _, layer := range layers {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(layer)
+		w.Close()
+		descs = append(descs, blob("application/vnd.oci.image.layer.v1.tar+gzip", buf.Bytes()))
+	}
+
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"config":        blob("application/vnd.oci.image.config.v1+json", []byte(imageConfig)),
+		"layers":        descs,
+	})
+	desc := blob("application/vnd.oci.image.manifest.v1+json", manifest)
+	desc["annotations"] = map[string]string{ociRefName: "1.0"}
+
+	index, _ := json.Marshal(map[string]interface{}{"schemaVersion": 2, "manifests": []interface{}{desc}})
+	ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion": "1.0.0"}`), 0644)
+}
+
+func TestImageInvalid(t *testing.T) {
+	tests := []string{
+		`{"name": "a", "commands": ["ls"], "image": "../tools.tar"}`,
+		`{"name": "a", "commands": ["ls"], "image": "/images/tools.tar"}`,
+		`{"name": "a", "commands": ["ls"], "image": ":1"}`,
+	}
+
+	for _, body := range tests {
+		if _, err := parseJobRequest("application/json", []byte(body)); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
+
+func TestImageEnv(t *testing.T) {
+	env := imageEnv([]string{"PATH=/host/bin", "HOME=/root", "LANG=C"}, []string{"LANG=C.UTF-8"})
+	want := []string{"HOME=/root", "PATH=" + defaultPath, "LANG=C.UTF-8"}
+	if strings.Join(env, " ") != strings.Join(want, " ") {
+		t.Errorf("expected %v, got %v", want, env)
+	}
+}
+
+func TestImageJob(t *testing.T) {
+	config, cleanup := newSandboxConfig(t)
+	defer cleanup()
+
+	config.ImagesDir = filepath.Join(filepath.Dir(config.WorkersDir), "images")
+	os.MkdirAll(filepath.Join(config.ImagesDir, "layout"), 0755)
+
+	layers := imageLayers(t)
+	writeDockerArchive(t, filepath.Join(config.ImagesDir, "tools.tar"), layers)
+	writeOCILayout(t, filepath.Join(config.ImagesDir, "layout"), layers)
+
+	commands := `[
+		"read version < /etc/version && test $version = 2",
+		"test ! -e /etc/gone",
+		"test ! -e /usr",
+		"test \"$IMAGE_VAR\" = set",
+		"if echo changed 2>/dev/null > /etc/version; then exit 1; fi",
+		"echo built > out"
+	]`
+
+	for _, ref := range []string{"tools.tar", "tools.tar:1", "layout:1.0"} {
+		job := waitForJob(t, config, postJob(t, config, `{"name": "a", "image": "`+ref+`", "commands": `+commands+`}`))
+		if job.State != StateSucceeded {
+			t.Fatalf("job in %s failed: %s %s", ref, job.Error, getRunLog(t, config, job.ID, "1"))
+		}
+		if job.ImageID != digest([]byte(imageConfig)) {
+			t.Errorf("unexpected image id for %s: %s", ref, job.ImageID)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(job.Workspace, "out")); err != nil || string(b) != "built\n" {
+			t.Errorf("job in %s did not write to its workspace: %q %v", ref, b, err)
+		}
+	}
+
+	// Both images have the same configuration, so they share a root
+	// filesystem, which none of the jobs have changed.
+	roots, _ := ioutil.ReadDir(config.imageDir())
+	if len(roots) != 1 {
+		t.Fatalf("expected one unpacked image, got %d", len(roots))
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(config.imageDir(), roots[0].Name(), "etc", "version")); string(b) != "2\n" {
+		t.Errorf("image was changed: %q", b)
+	}
+}
+
+func TestImageMissing(t *testing.T) {
+	config, cleanup := newSandboxConfig(t)
+	defer cleanup()
+
+	config.ImagesDir = filepath.Join(filepath.Dir(config.WorkersDir), "images")
+	os.MkdirAll(filepath.Join(config.ImagesDir, "empty"), 0755)
+	writeDockerArchive(t, filepath.Join(config.ImagesDir, "tools.tar"), nil)
+
+	tests := map[string]string{
+		"missing.tar": "no such file",
+		"empty":       "neither an OCI image layout nor a docker image archive",
+		"tools.tar:2": `no tag "2"`,
+	}
+
+	for ref, want := range tests {
+		job := waitForJob(t, config, postJob(t, config, `{"name": "a", "image": "`+ref+`", "commands": ["true"]}`))
+		if job.State != StateFailed || !strings.Contains(job.Error, want) {
+			t.Errorf("expected job in %s to fail with %q, got %s: %s", ref, want, job.State, job.Error)
+		}
+	}
+}
+
+func TestImageArchiveLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The files an archive points to cannot be links to files of the host.
+	os.Mkdir(filepath.Join(dir, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a", "layer.tar"), tarball(t, nil), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(imageConfig), 0644)
+	os.Symlink("/etc/passwd", filepath.Join(dir, "passwd.json"))
+	os.Symlink("/etc", filepath.Join(dir, "etc"))
+
+	tests := map[string]string{
+		`[{"Config": "config.json", "Layers": ["a/layer.tar"]}]`:         "",
+		`[{"Config": "passwd.json", "Layers": ["a/layer.tar"]}]`:         "symbolic link",
+		`[{"Config": "etc/passwd", "Layers": ["a/layer.tar"]}]`:          "symbolic link",
+		`[{"Config": "config.json", "Layers": ["etc/passwd"]}]`:          "symbolic link",
+		`[{"Config": "config.json", "Layers": ["a"]}]`:                   "not a file",
+		`[{"Config": "config.json", "Layers": ["../a/layer.tar"]}]`:      "invalid path",
+		`[{"Config": "config.json", "Layers": ["a/../../a/layer.tar"]}]`: "invalid path",
+	}
+
+	for manifest, want := range tests {
+		ioutil.WriteFile(filepath.Join(dir, "manifest.json"), []byte(manifest), 0644)
+		_, err := readDockerArchive(dir, "")
+		switch {
+		case want == "" && err != nil:
+			t.Errorf("unexpected error for %s: %s", manifest, err)
+		case want != "" && (err == nil || !strings.Contains(err.Error(), want)):
+			t.Errorf("expected an error with %q for %s, got %v", want, manifest, err)
+		}
+	}
+
+	// Neither can the manifest itself.
+	os.Remove(filepath.Join(dir, "manifest.json"))
+	os.Symlink("/etc/passwd", filepath.Join(dir, "manifest.json"))
+	if _, err := readDockerArchive(dir, ""); err == nil || !strings.Contains(err.Error(), "symbolic link") {
+		t.Errorf("expected a linked manifest to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,802 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/junland/conveyor/executor"
+	log "github.com/sirupsen/logrus"
+)
+
+// JobState describes where a job is in its lifecycle.
+type JobState string
+
+// Possible job states.
+const (
+	StateQueued    JobState = "queued"
+	StateRunning   JobState = "running"
+	StateSucceeded JobState = "succeeded"
+	StateFailed    JobState = "failed"
+	StateCancelled JobState = "cancelled"
+
+	// StatePending is used for steps that have not run yet and for jobs of a
+	// pipeline that wait for their needs. StateSkipped is used for steps and
+	// jobs that did not run because something before them did not succeed.
+	StatePending JobState = "pending"
+	StateSkipped JobState = "skipped"
+
+	// StateInterrupted is used for jobs that were running when the server stopped.
+	StateInterrupted JobState = "interrupted"
+
+	// StateTimedOut is used for jobs that were stopped because they ran for too long.
+	StateTimedOut JobState = "timed_out"
+)
+
+var (
+	errJobNotFound    = errors.New("job not found")
+	errJobFinished    = errors.New("job already finished")
+	errJobNotFinished = errors.New("job has not finished")
+)
+
+// JobRequest describes the statement of work. It either has a flat list of
+// commands, a pipeline of stages or a set of jobs that need each other. A
+// job with a matrix is run once for every combination of its variables.
+type JobRequest struct {
+	Name      string            `json:"name" yaml:"name"`
+	Commands  []string          `json:"commands,omitempty" yaml:"commands,omitempty"`
+	Stages    []Stage           `json:"stages,omitempty" yaml:"stages,omitempty"`
+	Env       map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	Secrets   []string          `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+	Timeout   Duration          `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Retry     *RetryPolicy      `json:"retry,omitempty" yaml:"retry,omitempty"`
+	Source    *Source           `json:"source,omitempty" yaml:"source,omitempty"`
+	Artifacts []string          `json:"artifacts,omitempty" yaml:"artifacts,omitempty"`
+	Cache     *Cache            `json:"cache,omitempty" yaml:"cache,omitempty"`
+	Cleanup   string            `json:"cleanup,omitempty" yaml:"cleanup,omitempty"`
+	Sandbox   *Sandbox          `json:"sandbox,omitempty" yaml:"sandbox,omitempty"`
+	Image     string            `json:"image,omitempty" yaml:"image,omitempty"`
+	Limits    *Limits           `json:"limits,omitempty" yaml:"limits,omitempty"`
+	Matrix    *Matrix           `json:"matrix,omitempty" yaml:"matrix,omitempty"`
+	Needs     []string          `json:"needs,omitempty" yaml:"needs,omitempty"`
+	Jobs      []JobRequest      `json:"jobs,omitempty" yaml:"jobs,omitempty"`
+}
+
+// Duration is a time.Duration that is written as a string such as "1h30m"
+// in job requests.
+type Duration time.Duration
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON reads a duration string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations have to be strings such as \"10m\"")
+	}
+	return d.parse(s)
+}
+
+// UnmarshalYAML reads a duration string.
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Job describes a submitted job and its current status.
+type Job struct {
+	ID               string            `json:"id"`
+	Name             string            `json:"name"`
+	State            JobState          `json:"state"`
+	Worker           int               `json:"worker"`
+	ExitCode         *int              `json:"exit_code,omitempty"`
+	QueuedAt         time.Time         `json:"queued_at"`
+	StartedAt        *time.Time        `json:"started_at,omitempty"`
+	FinishedAt       *time.Time        `json:"finished_at,omitempty"`
+	Attempt          int               `json:"attempt"`
+	Run              int               `json:"run"`
+	Runs             []RunRecord       `json:"runs,omitempty"`
+	RestartOf        string            `json:"restart_of,omitempty"`
+	Error            string            `json:"error,omitempty"`
+	Reason           string            `json:"reason,omitempty"`
+	Parent           string            `json:"parent,omitempty"`
+	Children         []string          `json:"children,omitempty"`
+	Needs            []string          `json:"needs,omitempty"`
+	Matrix           map[string]string `json:"matrix,omitempty"`
+	Commit           string            `json:"commit,omitempty"`
+	ImageID          string            `json:"image_id,omitempty"`
+	Workspace        string            `json:"workspace,omitempty"`
+	Artifacts        []Artifact        `json:"artifacts,omitempty"`
+	ArtifactsExpired bool              `json:"artifacts_expired,omitempty"`
+	Cache            *CacheStatus      `json:"cache,omitempty"`
+	Usage            *Usage            `json:"usage,omitempty"`
+	Request          JobRequest        `json:"request"`
+	Stages           []StageStatus     `json:"stages"`
+	Transitions      []Transition      `json:"transitions"`
+}
+
+// Transition records when a job entered a state.
+type Transition struct {
+	State JobState  `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
+// jobTable keeps track of every job the server knows about. Every change to
+// a job is written through to the job store.
+type jobTable struct {
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	store JobStore
+}
+
+func newJobTable(store JobStore) *jobTable {
+	return &jobTable{jobs: make(map[string]*Job), store: store}
+}
+
+// load fills the table with the jobs kept in the store.
+func (t *jobTable) load() ([]*Job, error) {
+	jobs, err := t.store.Load()
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, j := range jobs {
+		t.jobs[j.ID] = j
+	}
+	return jobs, nil
+}
+
+// save writes a job to the store. The table lock has to be held.
+func (t *jobTable) save(j *Job) {
+	if err := t.store.Save(j); err != nil {
+		log.Errorf("Could not save job %s: %s", j.ID, err)
+	}
+}
+
+// add stores a new job in the table.
+func (t *jobTable) add(j *Job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.jobs[j.ID] = j
+	t.save(j)
+}
+
+// get returns a copy of the job with the given id.
+func (t *jobTable) get(id string) (Job, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, ok := t.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j.clone(), true
+}
+
+// update applies fn to the job with the given id while holding the table lock.
+func (t *jobTable) update(id string, fn func(j *Job)) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, ok := t.jobs[id]
+	if !ok {
+		return false
+	}
+	fn(j)
+	t.save(j)
+	return true
+}
+
+// cancel marks a queued or running job as cancelled.
+func (t *jobTable) cancel(id string) (Job, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, ok := t.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	switch j.State {
+	case StatePending:
+		// The job never made it to a worker, so it is done right away.
+		j.finish(StateCancelled, -1)
+		j.ExitCode = nil
+		t.save(j)
+		return *j.clone(), nil
+	case StateQueued, StateRunning:
+		j.setState(StateCancelled, time.Now())
+		t.save(j)
+		return *j.clone(), nil
+	}
+	return *j.clone(), errJobFinished
+}
+
+// restart adds a new attempt of a finished job to the table. Every attempt
+// refers back to the job that was originally submitted. Restarting a
+// pipeline runs all of its jobs again, restarting one of its jobs runs just
+// that job on its own.
+func (t *jobTable) restart(id string) (*Job, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, ok := t.jobs[id]
+	if !ok {
+		return nil, errJobNotFound
+	}
+	if j.FinishedAt == nil {
+		return nil, errJobNotFinished
+	}
+
+	original := j.ID
+	if j.RestartOf != "" {
+		original = j.RestartOf
+	}
+
+	attempt := 1
+	for _, other := range t.jobs {
+		if (other.ID == original || other.RestartOf == original) && other.Attempt > attempt {
+			attempt = other.Attempt
+		}
+	}
+
+	job, children := newJob(j.Request, time.Now())
+	job.Attempt = attempt + 1
+	job.RestartOf = original
+
+	for _, child := range append([]*Job{job}, children...) {
+		t.jobs[child.ID] = child
+		t.save(child)
+	}
+
+	return job, nil
+}
+
+// newJobID returns a random identifier for a job.
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// CreateJob is a function that collects and parses incoming jobs.
+func (c *Config) CreateJob(w http.ResponseWriter, r *http.Request) {
+
+	// Make sure we can only be called with an HTTP POST request.
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("Something went wrong with reading the job request: %s", err)
+		respondError(w, http.StatusBadRequest, "Could not read request.")
+		return
+	}
+
+	jobReq, err := parseJobRequest(r.Header.Get("Content-Type"), reqBody)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := c.checkSecrets(&jobReq); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	job, worker, err := c.queueJob(jobReq)
+	if err != nil {
+		log.Errorf("Could not submit job %s: %s", job.ID, err)
+		respondError(w, http.StatusInternalServerError, "Something went wrong with queue worker.")
+		return
+	}
+
+	if job.isPipeline() {
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"message":   "Pipeline Submitted",
+			"id":        job.ID,
+			"jobs":      job.Children,
+			"queued_at": job.QueuedAt,
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message":   "Job Submitted",
+		"id":        job.ID,
+		"worker":    worker,
+		"queued_at": job.QueuedAt,
+	})
+
+	return
+}
+
+// queueJob adds the job described by a validated request to the job table and
+// queues it. The jobs of a pipeline are scheduled as their needs allow, a
+// single job is submitted to a worker right away and the number of that
+// worker is returned.
+func (c *Config) queueJob(req JobRequest) (*Job, int, error) {
+	job, children := newJob(req, time.Now())
+
+	c.jobs.add(job)
+
+	if job.isPipeline() {
+		for _, child := range children {
+			c.jobs.add(child)
+		}
+		c.schedulePipeline(job.ID)
+		return job, 0, nil
+	}
+
+	worker, err := c.submit(job)
+	return job, worker, err
+}
+
+// submit hands a job to the least busy worker and returns the number of that
+// worker. A job that cannot be submitted is marked as failed.
+func (c *Config) submit(job *Job) (int, error) {
+	logfile, err := os.OpenFile(c.runLogPath(job.ID, job.runNumber()), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		c.failJob(job.ID, err)
+		return 0, fmt.Errorf("could not create log file: %s", err)
+	}
+
+	task := &executor.Task{
+		ID:      job.ID,
+		Output:  logfile,
+		Timeout: c.timeout(job.Request),
+		Limits:  c.limits(job.Request),
+		Setup:   c.setupTask(job.Request, job.Stages),
+	}
+
+	worker, err := c.pool.Dispatch(task)
+	if err != nil {
+		logfile.Close()
+		c.failJob(job.ID, err)
+		return 0, err
+	}
+
+	log.Infof("Queued up job %s for worker %d", job.ID, worker)
+
+	c.jobs.update(job.ID, func(j *Job) { j.Worker = worker })
+
+	return worker, nil
+}
+
+// timeout returns how long a job may run, the server wide default unless
+// the job asks for its own timeout.
+func (c *Config) timeout(req JobRequest) time.Duration {
+	if req.Timeout > 0 {
+		return time.Duration(req.Timeout)
+	}
+	return c.JobTimeout
+}
+
+// setupTask returns a function that writes the scripts of a job and points
+// the task at the workspace of the worker that picked it up.
+func (c *Config) setupTask(req JobRequest, status []StageStatus) func(t *executor.Task, worker int) error {
+	return func(t *executor.Task, worker int) error {
+		// Scripts are run from the workspace, so their path cannot be
+		// relative to the directory the server was started in.
+		scripts, err := filepath.Abs(c.WorkersDir + "_" + strconv.Itoa(worker) + "/job-scripts.d")
+		if err != nil {
+			return err
+		}
+
+		script := func(n int) string {
+			return filepath.Join(scripts, t.ID+"."+strconv.Itoa(n)+".qscript")
+		}
+
+		stages := req.pipeline()
+		steps := executorSteps(stages, status, script)
+
+		n := 0
+		for _, stage := range stages {
+			for _, step := range stage.Steps {
+				log.Debug("Writing job script " + script(n))
+
+				var body strings.Builder
+				for _, cmd := range step.Commands {
+					body.WriteString(cmd)
+					body.WriteString("\n")
+				}
+
+				if err := ioutil.WriteFile(script(n), []byte(body.String()), 0700); err != nil {
+					return fmt.Errorf("could not write to script file: %s", err)
+				}
+				n++
+			}
+		}
+
+		secrets, err := c.lookupSecrets(req.Secrets)
+		if err != nil {
+			return err
+		}
+
+		if len(secrets) > 0 {
+			values := make([]string, 0, len(secrets))
+			for _, v := range secrets {
+				values = append(values, v)
+			}
+			t.Output = newMaskWriter(t.Output, values)
+		}
+
+		// Every run of a job starts out with an empty workspace of its own.
+		dir, err := c.prepareWorkspace(t.ID, worker)
+		if err != nil {
+			return err
+		}
+		base := allowedEnv(os.Environ(), c.EnvAllow)
+
+		var source []string
+		if req.Source != nil {
+			commit, err := c.checkoutSource(t.ID, req, dir, base, t.Output)
+			if err != nil {
+				return err
+			}
+			source = []string{"CONVEYOR_REPO=" + req.Source.Repo, "CONVEYOR_COMMIT=" + commit}
+			if req.Source.Ref != "" {
+				source = append(source, "CONVEYOR_REF="+req.Source.Ref)
+			}
+		}
+
+		if req.Cache != nil {
+			c.restoreCache(t.ID, req, dir, t.Output)
+		}
+
+		prepared, err := c.executor(req).Prepare(t, req, base)
+		if err != nil {
+			return err
+		}
+
+		// Jobs only get the parts of the server environment that are allowed
+		// or the environment of their image, followed by their own variables,
+		// their source and their secrets.
+		env := append(prepared, "PWD="+dir)
+		env = append(env, envList(req.Env)...)
+		env = append(env, source...)
+		env = append(env, envList(secrets)...)
+
+		t.Steps = steps
+		t.Dir = dir
+		t.Env = env
+
+		return nil
+	}
+}
+
+// failJob marks a job that could not be run as failed.
+func (c *Config) failJob(id string, err error) {
+	c.jobs.update(id, func(j *Job) {
+		j.finish(StateFailed, -1)
+		j.ExitCode = nil
+		j.Error = err.Error()
+	})
+}
+
+// finished lets the pipeline a job belongs to know that the job is done.
+func (c *Config) finished(id string) {
+	if job, ok := c.jobs.get(id); ok && job.Parent != "" {
+		c.schedulePipeline(job.Parent)
+	}
+}
+
+// RestartJob queues a new attempt of a finished job using the original job request.
+func (c *Config) RestartJob(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+
+	job, err := c.jobs.restart(ps.ByName("id"))
+	switch err {
+	case errJobNotFound:
+		respondError(w, http.StatusNotFound, "Job not found.")
+		return
+	case errJobNotFinished:
+		respondError(w, http.StatusConflict, "Job has not finished yet.")
+		return
+	}
+
+	if job.isPipeline() {
+		log.Infof("Restarting pipeline %s with %d jobs", job.ID, len(job.Children))
+		c.schedulePipeline(job.ID)
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"message":    "Pipeline Restarted",
+			"id":         job.ID,
+			"restart_of": job.RestartOf,
+			"attempt":    job.Attempt,
+			"jobs":       job.Children,
+			"queued_at":  job.QueuedAt,
+		})
+		return
+	}
+
+	worker, err := c.submit(job)
+	if err != nil {
+		log.Errorf("Could not submit job %s: %s", job.ID, err)
+		respondError(w, http.StatusInternalServerError, "Something went wrong with queue worker.")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message":    "Job Restarted",
+		"id":         job.ID,
+		"restart_of": job.RestartOf,
+		"attempt":    job.Attempt,
+		"worker":     worker,
+		"queued_at":  job.QueuedAt,
+	})
+}
+
+// handleEvent records the lifecycle events reported by the executor.
+func (c *Config) handleEvent(ev executor.Event) {
+	id := ev.Task.ID
+
+	switch ev.Type {
+	case executor.Started:
+		c.jobs.update(id, func(j *Job) {
+			if j.State == StateQueued {
+				j.setState(StateRunning, ev.Time)
+			}
+			started := ev.Time
+			j.Worker = ev.Worker
+			j.StartedAt = &started
+
+			run := j.currentRun()
+			run.State = j.State
+			run.Worker = ev.Worker
+			run.StartedAt = &started
+		})
+
+	case executor.StepStarted:
+		c.jobs.update(id, func(j *Job) {
+			stage, step := j.step(ev.Step)
+			if step == nil {
+				return
+			}
+			started := ev.Time
+			step.State = StateRunning
+			step.StartedAt = &started
+			stage.update()
+		})
+
+	case executor.StepFinished:
+		res := ev.Result
+
+		c.jobs.update(id, func(j *Job) {
+			stage, step := j.step(ev.Step)
+			if step == nil {
+				return
+			}
+			finished := ev.Time
+			code := res.ExitCode
+			step.FinishedAt = &finished
+			step.ExitCode = &code
+			switch {
+			case res.TimedOut:
+				step.State = StateTimedOut
+			case res.Cancelled:
+				step.State = StateCancelled
+			case res.Err != nil || res.ExitCode != 0:
+				step.State = StateFailed
+			default:
+				step.State = StateSucceeded
+			}
+			stage.update()
+		})
+
+	case executor.Finished:
+		res := ev.Result
+
+		// Artifacts and caches are collected before the worker moves on to
+		// its next job, which could change the workspace.
+		if res.Err == nil && res.ExitCode == 0 && !res.Cancelled && !res.TimedOut {
+			if job, ok := c.jobs.get(id); ok {
+				if len(job.Request.Artifacts) > 0 {
+					if err := c.saveArtifacts(id, job.Request, ev.Task.Dir, ev.Task.Output); err != nil {
+						res.Err = err
+					}
+				}
+				if res.Err == nil && job.Cache != nil {
+					c.saveCache(id, job.Request, *job.Cache, ev.Task.Dir, ev.Task.Output)
+				}
+			}
+		}
+
+		if f, ok := ev.Task.Output.(io.Closer); ok {
+			f.Close()
+		}
+
+		var (
+			retrying bool
+			delay    time.Duration
+		)
+
+		c.jobs.update(id, func(j *Job) {
+			state := StateSucceeded
+			switch {
+			case res.TimedOut:
+				log.Warnf("Job %s timed out", id)
+				state = StateTimedOut
+				j.Reason = "timed out after " + ev.Task.Timeout.String()
+			case res.Cancelled && j.State != StateCancelled:
+				// Jobs are only stopped without being cancelled when the server shuts down.
+				state = StateInterrupted
+			case res.Cancelled:
+				state = StateCancelled
+			case res.Err != nil:
+				log.Errorf("Job %s could not be run: %s", id, res.Err)
+				state = StateFailed
+			case res.ExitCode != 0:
+				log.Warnf("Job %s exited with code %d", id, res.ExitCode)
+				state = StateFailed
+			}
+
+			j.finish(state, res.ExitCode)
+			j.finishSteps(*j.FinishedAt)
+			if res.Err != nil {
+				j.Error = res.Err.Error()
+			}
+			if res.Usage != (executor.Usage{}) {
+				j.Usage = &Usage{PeakMemory: res.Usage.PeakMemory, CPUTime: Duration(res.Usage.CPUTime)}
+			}
+			if j.StartedAt == nil {
+				// The job never ran, so there is no exit code to report.
+				j.ExitCode = nil
+			}
+
+			j.recordRun()
+			delay, retrying = j.retry(res)
+		})
+
+		// Jobs that are stopped by a shutdown stay as they are, waiting
+		// retries and the rest of their pipeline are queued again when the
+		// server starts.
+		if c.stopping() {
+			return
+		}
+
+		if retrying {
+			log.Infof("Job %s will be retried in %s", id, delay)
+			c.retries.after(id, delay, func() { c.resubmit(id) })
+			return
+		}
+
+		c.cleanWorkspace(id)
+		c.finished(id)
+	}
+}
+
+// clone returns a copy of the job that does not share any state with it.
+func (j *Job) clone() *Job {
+	c := *j
+	c.Transitions = append([]Transition(nil), j.Transitions...)
+	c.Children = append([]string(nil), j.Children...)
+	c.Needs = append([]string(nil), j.Needs...)
+	c.Runs = append([]RunRecord(nil), j.Runs...)
+	c.Artifacts = append([]Artifact(nil), j.Artifacts...)
+	if j.Cache != nil {
+		cache := *j.Cache
+		c.Cache = &cache
+	}
+	if j.Usage != nil {
+		usage := *j.Usage
+		c.Usage = &usage
+	}
+	c.Stages = make([]StageStatus, len(j.Stages))
+	for i, stage := range j.Stages {
+		c.Stages[i] = stage
+		c.Stages[i].Steps = append([]StepStatus(nil), stage.Steps...)
+	}
+	return &c
+}
+
+// setState moves the job into a new state and records the transition.
+func (j *Job) setState(state JobState, at time.Time) {
+	if j.State == state && len(j.Transitions) > 0 {
+		return
+	}
+	j.State = state
+	j.Transitions = append(j.Transitions, Transition{State: state, Time: at})
+}
+
+// finish marks the job as done with the given state and exit code.
+func (j *Job) finish(state JobState, code int) {
+	now := time.Now()
+	j.setState(state, now)
+	j.ExitCode = &code
+	j.FinishedAt = &now
+}
+
+// GetJob reports the status of a single job.
+func (c *Config) GetJob(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+
+	job, ok := c.jobs.get(ps.ByName("id"))
+	if !ok {
+		respondError(w, http.StatusNotFound, "Job not found.")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, job)
+}
+
+// stopJob takes a cancelled job off the workers. A job that is not known to
+// the workers, such as one waiting to be retried, is done right away.
+func (c *Config) stopJob(id string) {
+	if c.pool.Cancel(id) {
+		return
+	}
+	c.jobs.update(id, func(j *Job) {
+		if j.State == StateCancelled && j.FinishedAt == nil {
+			j.finish(StateCancelled, -1)
+			j.ExitCode = nil
+			j.recordRun()
+		}
+	})
+}
+
+// CancelJob removes a job that has not started yet or stops a running job.
+func (c *Config) CancelJob(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+
+	job, err := c.jobs.cancel(ps.ByName("id"))
+	switch err {
+	case errJobNotFound:
+		respondError(w, http.StatusNotFound, "Job not found.")
+		return
+	case errJobFinished:
+		respondError(w, http.StatusConflict, "Job has already finished.")
+		return
+	}
+
+	log.Info("Cancelling job " + job.ID)
+
+	if !job.isPipeline() {
+		c.stopJob(job.ID)
+	}
+
+	// Cancelling a pipeline cancels every job of it that has not finished.
+	for _, id := range job.Children {
+		if _, err := c.jobs.cancel(id); err == nil {
+			c.stopJob(id)
+		}
+	}
+
+	if job.isPipeline() {
+		c.schedulePipeline(job.ID)
+	} else if job.Parent != "" {
+		c.schedulePipeline(job.Parent)
+	}
+
+	job, _ = c.jobs.get(job.ID)
+
+	respondJSON(w, http.StatusOK, job)
+}
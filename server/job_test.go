@@ -0,0 +1,422 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestConfig sets up a config with its own worker directories and a running worker pool.
+func newTestConfig(t *testing.T, workers int) (*Config, func()) {
+	dir, err := ioutil.TempDir("", "conveyor")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		Workers:      workers,
+		WorkersDir:   filepath.Join(dir, "worker"),
+		WorkspaceDir: filepath.Join(dir, "workspace"),
+		SecretsFile:  filepath.Join(dir, "conveyor.secrets"),
+		SecretsKey:   "test",
+		EnvAllow:     []string{"PATH"},
+		// Workspaces are kept for the tests to look into.
+		WorkspaceCleanup: CleanupNever,
+	}
+
+	config.createDirs()
+	config.setup()
+	config.pool.KillGrace = 100 * time.Millisecond
+
+	return config, func() {
+		config.schedules.close()
+		config.pool.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// postJob submits a job request and returns the id of the new job.
+func postJob(t *testing.T, config *Config, body string) string {
+	req, err := http.NewRequest("POST", "/job", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+	}
+
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.ID
+}
+
+// waitForJob waits until a job has finished and returns it.
+func waitForJob(t *testing.T, config *Config, id string) Job {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, ok := config.jobs.get(id); ok && job.FinishedAt != nil {
+			return job
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("job %s did not finish in time", id)
+	return Job{}
+}
+
+// waitForState waits until a job has reached the given state.
+func waitForState(t *testing.T, config *Config, id string, state JobState) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, ok := config.jobs.get(id); ok && job.State == state {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("job %s did not reach state %s in time", id, state)
+}
+
+func TestCreateJob(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	id := postJob(t, config, `{"name":"frontend","commands":["echo 1","echo 2 >&2","pwd"]}`)
+
+	job := waitForJob(t, config, id)
+
+	if job.State != StateSucceeded || job.ExitCode == nil || *job.ExitCode != 0 {
+		t.Fatalf("job did not succeed: %+v", job)
+	}
+
+	if job.StartedAt == nil || job.Worker != 1 {
+		t.Errorf("job was not started on a worker: %+v", job)
+	}
+
+	out, err := ioutil.ReadFile(config.logPath(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "1\n2\n" + config.jobDir(1, id) + "\n"
+	if string(out) != expected {
+		t.Errorf("job wrote unexpected output: got %q want %q", out, expected)
+	}
+}
+
+func TestCreateJobRelativeDirs(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	// The default directories are relative to where the server is started.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	os.Chdir(filepath.Dir(config.WorkersDir))
+	config.WorkersDir = filepath.Base(config.WorkersDir)
+	config.WorkspaceDir = filepath.Base(config.WorkspaceDir)
+
+	job := waitForJob(t, config, postJob(t, config, `{"name":"frontend","commands":["echo 1"]}`))
+	if job.State != StateSucceeded {
+		t.Errorf("job did not succeed: %+v", job)
+	}
+}
+
+func TestCreateJobBalancesWorkers(t *testing.T) {
+	config, cleanup := newTestConfig(t, 2)
+	defer cleanup()
+
+	first := postJob(t, config, `{"name":"first","commands":["sleep 30"]}`)
+	second := postJob(t, config, `{"name":"second","commands":["sleep 30"]}`)
+
+	waitForState(t, config, first, StateRunning)
+	waitForState(t, config, second, StateRunning)
+
+	one, _ := config.jobs.get(first)
+	two, _ := config.jobs.get(second)
+
+	if one.Worker != 1 || two.Worker != 2 {
+		t.Errorf("jobs were not spread over the workers: got %d and %d", one.Worker, two.Worker)
+	}
+}
+
+func TestCreateJobFailure(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	id := postJob(t, config, `{"name":"frontend","commands":["echo 1","exit 3","echo 2"]}`)
+
+	job := waitForJob(t, config, id)
+
+	if job.State != StateFailed || job.ExitCode == nil || *job.ExitCode != 3 {
+		t.Errorf("job did not fail with the exit code of the failing command: %+v", job)
+	}
+}
+
+func TestCreateJobNoName(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	// Set up the request.
+	req, err := http.NewRequest("POST", "/job", bytes.NewBufferString(`{"commands":["echo 1"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Set up the testing recorder.
+	rr := httptest.NewRecorder()
+
+	// Send the request.
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	// Check if status is correct.
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
+func TestGetJob(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	started := time.Now()
+	config.jobs.add(&Job{ID: "abc123", Name: "frontend", State: StateRunning, Worker: 1, QueuedAt: started, StartedAt: &started})
+
+	// Set up the request.
+	req, err := http.NewRequest("GET", "/job/abc123", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Set up the testing recorder.
+	rr := httptest.NewRecorder()
+
+	// Send the request.
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	// Check if status is correct.
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var job Job
+	if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+
+	if job.ID != "abc123" || job.State != StateRunning || job.Worker != 1 {
+		t.Errorf("handler returned unexpected job: %+v", job)
+	}
+
+	if job.ExitCode != nil {
+		t.Errorf("running job should not have an exit code, got %d", *job.ExitCode)
+	}
+}
+
+func TestGetJobNotFound(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	// Set up the request.
+	req, err := http.NewRequest("GET", "/job/missing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Set up the testing recorder.
+	rr := httptest.NewRecorder()
+
+	// Send the request.
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	// Check if status is correct.
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestJobFinish(t *testing.T) {
+	job := &Job{ID: "abc123", State: StateRunning}
+
+	job.finish(StateFailed, 2)
+
+	if job.State != StateFailed || job.ExitCode == nil || *job.ExitCode != 2 || job.FinishedAt == nil {
+		t.Errorf("job was not finished correctly: %+v", job)
+	}
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	// Keep the only worker busy so the second job stays in the queue.
+	first := postJob(t, config, `{"name":"first","commands":["sleep 30"]}`)
+	second := postJob(t, config, `{"name":"second","commands":["echo 1"]}`)
+
+	waitForState(t, config, first, StateRunning)
+
+	// Set up the request.
+	req, err := http.NewRequest("DELETE", "/job/"+second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Set up the testing recorder.
+	rr := httptest.NewRecorder()
+
+	// Send the request.
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	// Check if status is correct.
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	job := waitForJob(t, config, second)
+	if job.State != StateCancelled || job.StartedAt != nil || job.ExitCode != nil {
+		t.Errorf("queued job was not cancelled: %+v", job)
+	}
+
+	// Cancelling it a second time should conflict.
+	rr = httptest.NewRecorder()
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+}
+
+func TestCancelRunningJob(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	// Ignore SIGTERM so that the job has to be killed after the grace period.
+	id := postJob(t, config, `{"name":"frontend","commands":["trap '' TERM","sleep 30 & wait"]}`)
+
+	waitForState(t, config, id, StateRunning)
+
+	// Set up the request.
+	req, err := http.NewRequest("DELETE", "/job/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Set up the testing recorder.
+	rr := httptest.NewRecorder()
+
+	// Send the request.
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	// Check if status is correct.
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	job := waitForJob(t, config, id)
+	if job.State != StateCancelled {
+		t.Errorf("job has wrong state: got %v want %v", job.State, StateCancelled)
+	}
+}
+
+func TestRestartJobAttempts(t *testing.T) {
+	table := newJobTable(newMemoryStore())
+
+	finished := time.Now()
+	table.add(&Job{ID: "abc123", Name: "frontend", State: StateFailed, Attempt: 1, FinishedAt: &finished, Request: JobRequest{Name: "frontend", Commands: []string{"false"}}})
+
+	second, err := table.restart("abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if second.Attempt != 2 || second.RestartOf != "abc123" || second.State != StateQueued {
+		t.Errorf("unexpected restarted job: %+v", second)
+	}
+
+	if second.Request.Commands[0] != "false" {
+		t.Errorf("restarted job did not keep the original request: %+v", second.Request)
+	}
+
+	table.update(second.ID, func(j *Job) { j.finish(StateFailed, 1) })
+
+	// Restarting the second attempt should still refer to the original job.
+	third, err := table.restart(second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if third.Attempt != 3 || third.RestartOf != "abc123" {
+		t.Errorf("unexpected restarted job: %+v", third)
+	}
+}
+
+func TestRestartJob(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	id := postJob(t, config, `{"name":"frontend","commands":["echo 1"]}`)
+
+	// Restarting a job that has not finished should conflict.
+	req, err := http.NewRequest("POST", "/job/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job, _ := config.jobs.get(id); job.FinishedAt == nil {
+		rr := httptest.NewRecorder()
+		config.RegisterRoutes().ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusConflict {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+		}
+	}
+
+	waitForJob(t, config, id)
+
+	// Set up the testing recorder.
+	rr := httptest.NewRecorder()
+
+	// Send the request.
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	// Check if status is correct.
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var resp struct {
+		ID        string `json:"id"`
+		RestartOf string `json:"restart_of"`
+		Attempt   int    `json:"attempt"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.RestartOf != id || resp.Attempt != 2 {
+		t.Errorf("handler returned unexpected restart: %+v", resp)
+	}
+
+	if job := waitForJob(t, config, resp.ID); job.State != StateSucceeded {
+		t.Errorf("restarted job did not succeed: %+v", job)
+	}
+}
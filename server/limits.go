@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/junland/conveyor/executor"
+)
+
+// Limits are the resources a job may use, zero means the server wide default.
+type Limits struct {
+	CPUs      float64  `json:"cpus,omitempty" yaml:"cpus,omitempty"`
+	CPUTime   Duration `json:"cpu_time,omitempty" yaml:"cpu_time,omitempty"`
+	Memory    Size     `json:"memory,omitempty" yaml:"memory,omitempty"`
+	Processes int      `json:"processes,omitempty" yaml:"processes,omitempty"`
+	OpenFiles int      `json:"open_files,omitempty" yaml:"open_files,omitempty"`
+	FileSize  Size     `json:"file_size,omitempty" yaml:"file_size,omitempty"`
+}
+
+// Usage reports the resources a run of a job used.
+type Usage struct {
+	PeakMemory int64    `json:"peak_memory"`
+	CPUTime    Duration `json:"cpu_time"`
+}
+
+// validate checks that the limits can be applied. Limits that are all zero
+// do not limit anything, so they are fine everywhere.
+func (l *Limits) validate() error {
+	if l.CPUs < 0 || l.CPUTime < 0 || l.Memory < 0 || l.Processes < 0 || l.OpenFiles < 0 || l.FileSize < 0 {
+		return errors.New("resource limits cannot be negative")
+	}
+	if *l != (Limits{}) && runtime.GOOS != "linux" {
+		return errors.New("resource limits are only supported on Linux")
+	}
+	return nil
+}
+
+// limits returns the limits of a job, falling back to the server wide
+// default for every limit the job does not set. It returns nil if the job
+// is not limited at all.
+func (c *Config) limits(req JobRequest) *executor.Limits {
+	l := c.Limits
+	if r := req.Limits; r != nil {
+		if r.CPUs > 0 {
+			l.CPUs = r.CPUs
+		}
+		if r.CPUTime > 0 {
+			l.CPUTime = r.CPUTime
+		}
+		if r.Memory > 0 {
+			l.Memory = r.Memory
+		}
+		if r.Processes > 0 {
+			l.Processes = r.Processes
+		}
+		if r.OpenFiles > 0 {
+			l.OpenFiles = r.OpenFiles
+		}
+		if r.FileSize > 0 {
+			l.FileSize = r.FileSize
+		}
+	}
+
+	if l == (Limits{}) {
+		return nil
+	}
+	return &executor.Limits{
+		CPUs:      l.CPUs,
+		CPUTime:   time.Duration(l.CPUTime),
+		Memory:    int64(l.Memory),
+		Processes: l.Processes,
+		OpenFiles: l.OpenFiles,
+		FileSize:  int64(l.FileSize),
+	}
+}
+
+// Size is a number of bytes that can be written with a unit such as "512M"
+// or "2G" in job requests.
+type Size int64
+
+// UnmarshalJSON reads a size string or a number of bytes.
+func (s *Size) UnmarshalJSON(b []byte) error {
+	var n int64
+	if err := json.Unmarshal(b, &n); err == nil {
+		*s = Size(n)
+		return nil
+	}
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("sizes have to be numbers of bytes or strings such as \"512M\"")
+	}
+	return s.parse(v)
+}
+
+// UnmarshalYAML reads a size string or a number of bytes.
+func (s *Size) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	return s.parse(v)
+}
+
+// sizeUnits are the units sizes can be written in.
+var sizeUnits = map[string]int64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+func (s *Size) parse(v string) error {
+	u := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(v)), "B"), "I")
+
+	i := strings.IndexFunc(u, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(u)
+	}
+	unit, ok := sizeUnits[u[i:]]
+	if !ok {
+		return fmt.Errorf("%q is not a valid size", v)
+	}
+	n, err := strconv.ParseInt(u[:i], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid size", v)
+	}
+	if n > math.MaxInt64/unit {
+		return fmt.Errorf("%q is too large", v)
+	}
+	*s = Size(n * unit)
+	return nil
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/junland/conveyor/executor"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestLimitsInvalid(t *testing.T) {
+	tests := []string{
+		`{"name": "a", "commands": ["ls"], "limits": {"memory": "12X"}}`,
+		`{"name": "a", "commands": ["ls"], "limits": {"memory": "M"}}`,
+		`{"name": "a", "commands": ["ls"], "limits": {"memory": -1}}`,
+		`{"name": "a", "commands": ["ls"], "limits": {"processes": -1}}`,
+		`{"name": "a", "commands": ["ls"], "limits": {"cpu_time": "-1s"}}`,
+		`{"name": "a", "commands": ["ls"], "limits": {"memory": "9999999999T"}}`,
+		`{"name": "a", "commands": ["ls"], "limits": {"file_size": "8388608T"}}`,
+	}
+
+	for _, body := range tests {
+		if _, err := parseJobRequest("application/json", []byte(body)); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	tests := map[string]Size{
+		`100`:        100,
+		`"100"`:      100,
+		`"1K"`:       1 << 10,
+		`"512M"`:     512 << 20,
+		`"512MiB"`:   512 << 20,
+		`"2gb"`:      2 << 30,
+		`" 1T "`:     1 << 40,
+		`"8388607T"`: 8388607 << 40,
+	}
+
+	for in, want := range tests {
+		var s Size
+		if err := json.Unmarshal([]byte(in), &s); err != nil || s != want {
+			t.Errorf("unexpected size for %s: got %d want %d (%v)", in, s, want, err)
+		}
+	}
+
+	var l Limits
+	if err := yaml.UnmarshalStrict([]byte("memory: 1G\nfile_size: 4096\n"), &l); err != nil || l.Memory != 1<<30 || l.FileSize != 4096 {
+		t.Errorf("unexpected limits: %+v (%v)", l, err)
+	}
+}
+
+func TestLimitsZero(t *testing.T) {
+	// Limits that are all zero are valid even where limits are not supported.
+	body := `{"name": "a", "commands": ["ls"], "limits": {"memory": 0}}`
+	if _, err := parseJobRequest("application/json", []byte(body)); err != nil {
+		t.Errorf("unexpected error for %s: %s", body, err)
+	}
+}
+
+func TestConfigLimits(t *testing.T) {
+	config := &Config{Limits: Limits{Memory: 1 << 30, OpenFiles: 100}}
+
+	if l := (&Config{}).limits(JobRequest{}); l != nil {
+		t.Errorf("job without limits was limited: %+v", l)
+	}
+
+	// Jobs override the server defaults one limit at a time.
+	got := config.limits(JobRequest{Limits: &Limits{OpenFiles: 20, CPUTime: Duration(time.Minute)}})
+	want := executor.Limits{Memory: 1 << 30, OpenFiles: 20, CPUTime: time.Minute}
+	if got == nil || *got != want {
+		t.Errorf("unexpected limits: got %+v want %+v", got, want)
+	}
+}
+
+func TestJobLimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("resource limits are only supported on Linux")
+	}
+
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	config.Limits = Limits{OpenFiles: 100}
+
+	job := waitForJob(t, config, postJob(t, config, `{"name": "a", "limits": {"open_files": 20, "file_size": "1K"}, "commands": [
+		"ulimit -n",
+		"head -c 4096 /dev/zero > big || echo too big"
+	]}`))
+
+	if job.State != StateSucceeded {
+		t.Fatalf("unexpected state: %s", job.State)
+	}
+	if log := getRunLog(t, config, job.ID, "1"); !strings.HasPrefix(log, "20\n") || !strings.HasSuffix(log, "too big\n") {
+		t.Errorf("limits were not applied: %q", log)
+	}
+
+	// Usage is reported for the job and its run.
+	if job.Usage == nil || job.Usage.PeakMemory <= 0 {
+		t.Errorf("usage was not recorded: %+v", job.Usage)
+	}
+	if len(job.Runs) != 1 || job.Runs[0].Usage == nil || *job.Runs[0].Usage != *job.Usage {
+		t.Errorf("usage of the run was not recorded: %+v", job.Runs)
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// sortKeys maps the fields jobs can be sorted by to a function that returns a
+// string which orders the same way as the field.
+var sortKeys = map[string]func(j *Job) string{
+	"queued_at":   func(j *Job) string { return sortableTime(&j.QueuedAt) },
+	"started_at":  func(j *Job) string { return sortableTime(j.StartedAt) },
+	"finished_at": func(j *Job) string { return sortableTime(j.FinishedAt) },
+	"name":        func(j *Job) string { return j.Name },
+	"state":       func(j *Job) string { return string(j.State) },
+	"worker":      func(j *Job) string { return fmt.Sprintf("%010d", j.Worker) },
+}
+
+// sortableTime formats a time so that it sorts lexically. Missing times sort first.
+func sortableTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+// jobFilter describes which jobs should be listed.
+type jobFilter struct {
+	names   map[string]bool
+	states  map[JobState]bool
+	workers map[int]bool
+	since   time.Time
+	until   time.Time
+}
+
+// match reports whether a job passes the filter.
+func (f *jobFilter) match(j *Job) bool {
+	if len(f.names) > 0 && !f.names[j.Name] {
+		return false
+	}
+	if len(f.states) > 0 && !f.states[j.State] {
+		return false
+	}
+	if len(f.workers) > 0 && !f.workers[j.Worker] {
+		return false
+	}
+	if !f.since.IsZero() && j.QueuedAt.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !j.QueuedAt.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// list returns copies of every job in the table.
+func (t *jobTable) list() []*Job {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	jobs := make([]*Job, 0, len(t.jobs))
+	for _, j := range t.jobs {
+		jobs = append(jobs, j.clone())
+	}
+	return jobs
+}
+
+// ListJobs lists the jobs known to the server.
+//
+// Jobs can be filtered by name, state and worker (each accepting a comma
+// separated list) and by the time they were queued with since and until.
+// They are sorted by the field given in sort, in the order given by order,
+// and returned in pages of at most limit jobs. The next_cursor of a response
+// can be passed as cursor to get the next page.
+func (c *Config) ListJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var filter jobFilter
+
+	if s := q.Get("name"); s != "" {
+		filter.names = make(map[string]bool)
+		for _, n := range strings.Split(s, ",") {
+			filter.names[n] = true
+		}
+	}
+
+	if s := q.Get("state"); s != "" {
+		filter.states = make(map[JobState]bool)
+		for _, st := range strings.Split(s, ",") {
+			filter.states[JobState(st)] = true
+		}
+	}
+
+	if s := q.Get("worker"); s != "" {
+		filter.workers = make(map[int]bool)
+		for _, ws := range strings.Split(s, ",") {
+			n, err := strconv.Atoi(ws)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, "Invalid worker.")
+				return
+			}
+			filter.workers[n] = true
+		}
+	}
+
+	for param, t := range map[string]*time.Time{"since": &filter.since, "until": &filter.until} {
+		if s := q.Get(param); s != "" {
+			v, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, "Invalid "+param+" time, expected RFC 3339.")
+				return
+			}
+			*t = v
+		}
+	}
+
+	field := q.Get("sort")
+	if field == "" {
+		field = "queued_at"
+	}
+	key, ok := sortKeys[field]
+	if !ok {
+		respondError(w, http.StatusBadRequest, "Invalid sort field.")
+		return
+	}
+
+	desc := true
+	switch q.Get("order") {
+	case "", "desc":
+	case "asc":
+		desc = false
+	default:
+		respondError(w, http.StatusBadRequest, "Invalid order, expected asc or desc.")
+		return
+	}
+
+	limit := defaultListLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			respondError(w, http.StatusBadRequest, "Invalid limit.")
+			return
+		}
+		if n > maxListLimit {
+			n = maxListLimit
+		}
+		limit = n
+	}
+
+	var after *cursor
+	if s := q.Get("cursor"); s != "" {
+		cur, err := decodeCursor(s)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid cursor.")
+			return
+		}
+		after = cur
+	}
+
+	// less orders two positions in the listing, using the id to break ties.
+	less := func(a, b cursor) bool {
+		if a.key != b.key {
+			return (a.key < b.key) != desc
+		}
+		return (a.id < b.id) != desc
+	}
+
+	var jobs []*Job
+	for _, j := range c.jobs.list() {
+		if !filter.match(j) {
+			continue
+		}
+		if after != nil && !less(*after, cursor{key(j), j.ID}) {
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+
+	sort.Slice(jobs, func(i, k int) bool {
+		return less(cursor{key(jobs[i]), jobs[i].ID}, cursor{key(jobs[k]), jobs[k].ID})
+	})
+
+	resp := struct {
+		Jobs       []*Job `json:"jobs"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}{Jobs: jobs}
+
+	if len(jobs) > limit {
+		last := jobs[limit-1]
+		resp.Jobs = jobs[:limit]
+		resp.NextCursor = cursor{key(last), last.ID}.encode()
+	}
+
+	if resp.Jobs == nil {
+		resp.Jobs = []*Job{}
+	}
+
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// cursor marks a position in a sorted job listing.
+type cursor struct {
+	key string
+	id  string
+}
+
+// encode returns the opaque form of the cursor that is handed to clients.
+func (c cursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.key + "\x00" + c.id))
+}
+
+// decodeCursor parses a cursor handed out by ListJobs.
+func decodeCursor(s string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(string(b), "\x00", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidCursor
+	}
+	return &cursor{key: parts[0], id: parts[1]}, nil
+}
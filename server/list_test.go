@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// listResponse is the body returned by ListJobs.
+type listResponse struct {
+	Jobs       []Job  `json:"jobs"`
+	NextCursor string `json:"next_cursor"`
+}
+
+// newListTestConfig sets up a config with a handful of jobs queued a minute apart.
+func newListTestConfig() (*Config, time.Time) {
+	config := &Config{Workers: 2, jobs: newJobTable(newMemoryStore())}
+
+	base := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	jobs := []struct {
+		id, name string
+		state    JobState
+		worker   int
+	}{
+		{"a", "frontend", StateSucceeded, 1},
+		{"b", "backend", StateFailed, 2},
+		{"c", "frontend", StateRunning, 1},
+		{"d", "docs", StateQueued, 2},
+		{"e", "frontend", StateFailed, 2},
+	}
+
+	for i, j := range jobs {
+		config.jobs.add(&Job{ID: j.id, Name: j.name, State: j.state, Worker: j.worker, QueuedAt: base.Add(time.Duration(i) * time.Minute)})
+	}
+
+	return config, base
+}
+
+// listJobs requests a job listing and returns the decoded response.
+func listJobs(t *testing.T, config *Config, query string) listResponse {
+	req, err := http.NewRequest("GET", "/jobs"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+	}
+
+	var resp listResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+// ids returns the ids of the listed jobs joined together.
+func ids(jobs []Job) string {
+	s := ""
+	for _, j := range jobs {
+		s += j.ID
+	}
+	return s
+}
+
+func TestListJobs(t *testing.T) {
+	config, _ := newListTestConfig()
+
+	// Newest jobs come first by default.
+	if got := ids(listJobs(t, config, "").Jobs); got != "edcba" {
+		t.Errorf("unexpected jobs: got %s want edcba", got)
+	}
+}
+
+func TestListJobsFilter(t *testing.T) {
+	config, base := newListTestConfig()
+
+	tests := []struct {
+		query, want string
+	}{
+		{"?name=frontend", "eca"},
+		{"?state=failed,queued", "edb"},
+		{"?worker=2&name=frontend", "e"},
+		{"?since=" + base.Add(time.Minute).Format(time.RFC3339) + "&until=" + base.Add(3*time.Minute).Format(time.RFC3339), "cb"},
+	}
+
+	for _, test := range tests {
+		if got := ids(listJobs(t, config, test.query).Jobs); got != test.want {
+			t.Errorf("unexpected jobs for %s: got %s want %s", test.query, got, test.want)
+		}
+	}
+}
+
+func TestListJobsSort(t *testing.T) {
+	config, _ := newListTestConfig()
+
+	if got := ids(listJobs(t, config, "?sort=name&order=asc").Jobs); got != "bdace" {
+		t.Errorf("unexpected jobs: got %s want bdace", got)
+	}
+}
+
+func TestListJobsPagination(t *testing.T) {
+	config, _ := newListTestConfig()
+
+	got := ""
+	query := "?sort=name&order=asc&limit=2"
+	for pages := 0; pages < 10; pages++ {
+		resp := listJobs(t, config, query)
+		got += ids(resp.Jobs)
+		if resp.NextCursor == "" {
+			break
+		}
+		query = "?sort=name&order=asc&limit=2&cursor=" + resp.NextCursor
+	}
+
+	if got != "bdace" {
+		t.Errorf("unexpected jobs: got %s want bdace", got)
+	}
+}
+
+func TestListJobsBadRequest(t *testing.T) {
+	config, _ := newListTestConfig()
+
+	for _, query := range []string{"?sort=color", "?order=up", "?limit=0", "?worker=one", "?since=yesterday", "?cursor=!!"} {
+		req, err := http.NewRequest("GET", "/jobs"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+
+		config.RegisterRoutes().ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v", query, status, http.StatusBadRequest)
+		}
+	}
+}
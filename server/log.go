@@ -0,0 +1,196 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// logPollInterval is how often a followed log is checked for new output.
+var logPollInterval = 250 * time.Millisecond
+
+// logDir returns the directory where job logs are kept.
+func (c *Config) logDir() string {
+	return c.WorkersDir + "_logs"
+}
+
+// logPath returns the path of the combined stdout/stderr log of a job.
+func (c *Config) logPath(id string) string {
+	return filepath.Join(c.logDir(), id+".log")
+}
+
+// GetJobLog serves the combined output of a job.
+//
+// The log can be read from a given byte position with either the offset query
+// parameter or a HTTP Range header. When follow=true is passed the connection
+// is kept open and new output is streamed until the job has finished. Jobs
+// that were retried have a log for every run, the latest one is served unless
+// another one is asked for with run.
+func (c *Config) GetJobLog(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+	id := ps.ByName("id")
+
+	job, ok := c.jobs.get(id)
+	if !ok {
+		respondError(w, http.StatusNotFound, "Job not found.")
+		return
+	}
+
+	if job.isPipeline() {
+		respondError(w, http.StatusBadRequest, "Pipelines have no log of their own, read the logs of their jobs.")
+		return
+	}
+
+	var offset int64
+	if s := r.URL.Query().Get("offset"); s != "" {
+		o, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || o < 0 {
+			respondError(w, http.StatusBadRequest, "Invalid offset.")
+			return
+		}
+		offset = o
+	}
+
+	run := job.runNumber()
+	if s := r.URL.Query().Get("run"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > run {
+			respondError(w, http.StatusBadRequest, "Invalid run.")
+			return
+		}
+		run = n
+	}
+
+	follow := r.URL.Query().Get("follow") == "true"
+
+	file, err := os.Open(c.runLogPath(id, run))
+	if os.IsNotExist(err) && (!follow || job.runDone(run)) {
+		// Nothing has been written by the job (yet).
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Could not open log of job %s: %s", id, err)
+		respondError(w, http.StatusInternalServerError, "Could not read job log.")
+		return
+	}
+
+	if !follow {
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Could not read job log.")
+			return
+		}
+
+		if offset > info.Size() {
+			offset = info.Size()
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeContent(w, r, "", info.ModTime(), io.NewSectionReader(file, offset, info.Size()-offset))
+		return
+	}
+
+	// In follow mode only open ended ranges make sense. The length of the log
+	// is not known until the job has finished.
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		start, ok := parseOpenRange(rng)
+		if !ok {
+			respondError(w, http.StatusRequestedRangeNotSatisfiable, "Only ranges of the form bytes=N- can be followed.")
+			return
+		}
+		offset += start
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-*/*")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+
+	c.followLog(w, r, id, run, file, offset)
+}
+
+// runDone reports whether the given run of the job has finished.
+func (j *Job) runDone(run int) bool {
+	return j.FinishedAt != nil || run < j.runNumber()
+}
+
+// followLog streams the log of a run of a job starting at offset until the
+// run has finished or the client goes away. file may be nil if the job has
+// not written anything yet.
+func (c *Config) followLog(w http.ResponseWriter, r *http.Request, id string, run int, file *os.File, offset int64) {
+	flusher, _ := w.(http.Flusher)
+
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	buf := make([]byte, 32*1024)
+	done := false
+
+	for {
+		if file == nil {
+			f, err := os.Open(c.runLogPath(id, run))
+			if err == nil {
+				file = f
+			}
+		}
+
+		if file != nil {
+			n, err := file.ReadAt(buf, offset)
+			if n > 0 {
+				offset += int64(n)
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+				continue
+			}
+			if err != nil && err != io.EOF {
+				log.Errorf("Could not read log of job %s: %s", id, err)
+				return
+			}
+		}
+
+		// Everything written before the job finished has been sent.
+		if done {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(logPollInterval):
+		}
+
+		job, ok := c.jobs.get(id)
+		done = !ok || job.runDone(run)
+	}
+}
+
+// parseOpenRange parses a Range header of the form "bytes=N-".
+func parseOpenRange(s string) (int64, bool) {
+	if !strings.HasPrefix(s, "bytes=") || !strings.HasSuffix(s, "-") {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(s, "bytes="), "-"), 10, 64)
+	if err != nil || start < 0 {
+		return 0, false
+	}
+	return start, true
+}
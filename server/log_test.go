@@ -0,0 +1,165 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newLogTestConfig sets up a config with a log directory and a single job that has written some output.
+func newLogTestConfig(t *testing.T, state JobState) (*Config, func()) {
+	dir, err := ioutil.TempDir("", "conveyor-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{Workers: 1, WorkersDir: filepath.Join(dir, "worker"), jobs: newJobTable(newMemoryStore())}
+
+	if err := os.MkdirAll(config.logDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	job := &Job{ID: "abc123", Name: "frontend", State: state, Worker: 1, QueuedAt: time.Now()}
+	if state != StateRunning {
+		job.finish(state, 0)
+	}
+	config.jobs.add(job)
+
+	if err := ioutil.WriteFile(config.logPath("abc123"), []byte("line 1\nline 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return config, func() { os.RemoveAll(dir) }
+}
+
+func TestGetJobLog(t *testing.T) {
+	config, cleanup := newLogTestConfig(t, StateSucceeded)
+	defer cleanup()
+
+	// Set up the request.
+	req, err := http.NewRequest("GET", "/job/abc123/log", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Set up the testing recorder.
+	rr := httptest.NewRecorder()
+
+	// Send the request.
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	// Check if status is correct.
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	expected := "line 1\nline 2\n"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", rr.Body.String(), expected)
+	}
+}
+
+func TestGetJobLogOffset(t *testing.T) {
+	config, cleanup := newLogTestConfig(t, StateSucceeded)
+	defer cleanup()
+
+	// Set up the request.
+	req, err := http.NewRequest("GET", "/job/abc123/log?offset=7", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Set up the testing recorder.
+	rr := httptest.NewRecorder()
+
+	// Send the request.
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	expected := "line 2\n"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", rr.Body.String(), expected)
+	}
+}
+
+func TestGetJobLogRange(t *testing.T) {
+	config, cleanup := newLogTestConfig(t, StateSucceeded)
+	defer cleanup()
+
+	// Set up the request.
+	req, err := http.NewRequest("GET", "/job/abc123/log", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=0-5")
+
+	// Set up the testing recorder.
+	rr := httptest.NewRecorder()
+
+	// Send the request.
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	// Check if status is correct.
+	if status := rr.Code; status != http.StatusPartialContent {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusPartialContent)
+	}
+
+	expected := "line 1"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", rr.Body.String(), expected)
+	}
+
+	expected = "bytes 0-5/14"
+	if rr.Header().Get("Content-Range") != expected {
+		t.Errorf("handler returned unexpected Content-Range: got %q want %q", rr.Header().Get("Content-Range"), expected)
+	}
+}
+
+func TestGetJobLogFollow(t *testing.T) {
+	config, cleanup := newLogTestConfig(t, StateRunning)
+	defer cleanup()
+
+	defer func(interval time.Duration) { logPollInterval = interval }(logPollInterval)
+	logPollInterval = 10 * time.Millisecond
+
+	// Keep writing to the log for a bit, then finish the job.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f, err := os.OpenFile(config.logPath("abc123"), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return
+		}
+		f.Write([]byte("line 3\n"))
+		f.Close()
+		config.jobs.update("abc123", func(j *Job) { j.finish(StateSucceeded, 0) })
+	}()
+
+	// Set up the request.
+	req, err := http.NewRequest("GET", "/job/abc123/log?follow=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=7-")
+
+	// Set up the testing recorder.
+	rr := httptest.NewRecorder()
+
+	// Send the request.
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusPartialContent {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusPartialContent)
+	}
+
+	if got := rr.Header().Get("Content-Range"); got != "bytes 7-*/*" {
+		t.Errorf("handler returned unexpected Content-Range: got %q want %q", got, "bytes 7-*/*")
+	}
+
+	expected := "line 2\nline 3\n"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", rr.Body.String(), expected)
+	}
+}
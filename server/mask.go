@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/base64"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maskText replaces secrets in job logs.
+const maskText = "[MASKED]"
+
+// minMaskLen is the shortest value that is masked. Shorter values would hide
+// too much of the log to be useful.
+const minMaskLen = 3
+
+// maskWriter replaces every secret written to it with maskText before passing
+// the output on. Output that could be the start of a secret is held back until
+// the next write shows whether it is, so secrets split across writes are
+// masked as well.
+type maskWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	replacer *strings.Replacer
+	patterns []string
+	pending  string
+}
+
+// newMaskWriter returns a writer that masks the given secret values, along
+// with their base64 and URL encoded forms, in everything written to w.
+func newMaskWriter(w io.Writer, secrets []string) *maskWriter {
+	seen := make(map[string]bool)
+	var patterns []string
+
+	add := func(s string) {
+		if len(s) >= minMaskLen && !seen[s] {
+			seen[s] = true
+			patterns = append(patterns, s)
+		}
+	}
+
+	for _, secret := range secrets {
+		values := []string{secret}
+		if strings.Contains(secret, "\n") {
+			// Multi-line secrets are usually printed line by line.
+			values = append(values, strings.Split(secret, "\n")...)
+		}
+		for _, v := range values {
+			add(v)
+			add(base64.StdEncoding.EncodeToString([]byte(v)))
+			add(base64.RawStdEncoding.EncodeToString([]byte(v)))
+			add(base64.URLEncoding.EncodeToString([]byte(v)))
+			add(base64.RawURLEncoding.EncodeToString([]byte(v)))
+			add(url.QueryEscape(v))
+			add(url.PathEscape(v))
+		}
+	}
+
+	// Longer patterns go first so that a secret is not only partly masked
+	// because a shorter pattern matched at the same position.
+	sort.Slice(patterns, func(i, k int) bool { return len(patterns[i]) > len(patterns[k]) })
+
+	pairs := make([]string, 0, 2*len(patterns))
+	for _, p := range patterns {
+		pairs = append(pairs, p, maskText)
+	}
+
+	return &maskWriter{w: w, replacer: strings.NewReplacer(pairs...), patterns: patterns}
+}
+
+// Write masks p and writes out everything that can no longer turn into a secret.
+func (m *maskWriter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.patterns) == 0 {
+		return m.w.Write(p)
+	}
+
+	buf := m.replacer.Replace(m.pending + string(p))
+
+	keep := m.partial(buf)
+	m.pending = buf[len(buf)-keep:]
+
+	if out := buf[:len(buf)-keep]; out != "" {
+		if _, err := io.WriteString(m.w, out); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// partial returns the length of the longest end of s that is the start of a secret.
+func (m *maskWriter) partial(s string) int {
+	longest := 0
+	for _, p := range m.patterns {
+		n := len(p) - 1
+		if n > len(s) {
+			n = len(s)
+		}
+		for ; n > longest; n-- {
+			if strings.HasPrefix(p, s[len(s)-n:]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// Close writes out whatever was held back and closes the underlying writer.
+func (m *maskWriter) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.pending != "" {
+		io.WriteString(m.w, m.pending)
+		m.pending = ""
+	}
+
+	if c, ok := m.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMaskWriter(t *testing.T) {
+	secret := "s3cr3t/p@ss"
+
+	tests := []struct {
+		in, want string
+	}{
+		{"token=" + secret + "\n", "token=[MASKED]\n"},
+		{"b64=" + base64.StdEncoding.EncodeToString([]byte(secret)) + "\n", "b64=[MASKED]\n"},
+		{"url=" + url.QueryEscape(secret) + "\n", "url=[MASKED]\n"},
+		{"nothing to see\n", "nothing to see\n"},
+		{"s3cr3t but not the rest", "s3cr3t but not the rest"},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		m := newMaskWriter(&out, []string{secret})
+
+		m.Write([]byte(test.in))
+		m.Close()
+
+		if out.String() != test.want {
+			t.Errorf("unexpected output for %q: got %q want %q", test.in, out.String(), test.want)
+		}
+	}
+}
+
+func TestMaskWriterSplitWrites(t *testing.T) {
+	var out bytes.Buffer
+	m := newMaskWriter(&out, []string{"hunter2", "line one\nline two"})
+
+	// Write one byte at a time so that every secret is split.
+	for _, b := range []byte("pass: hunter2, hunte, key: line two\ndone") {
+		m.Write([]byte{b})
+	}
+
+	// Output that cannot be part of a secret is written right away.
+	if !strings.HasPrefix(out.String(), "pass: [MASKED], ") {
+		t.Errorf("output was held back: %q", out.String())
+	}
+
+	m.Close()
+
+	if want := "pass: [MASKED], hunte, key: [MASKED]\ndone"; out.String() != want {
+		t.Errorf("unexpected output: got %q want %q", out.String(), want)
+	}
+}
+
+func TestJobLogMasked(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	if err := config.secrets.set("DEPLOY_TOKEN", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	id := postJob(t, config, `{"name": "deploy", "secrets": ["DEPLOY_TOKEN"], "commands": ["echo token $DEPLOY_TOKEN", "printf %s \"$DEPLOY_TOKEN\" | base64"]}`)
+
+	if job := waitForJob(t, config, id); job.State != StateSucceeded {
+		t.Fatalf("job did not succeed: %+v", job)
+	}
+
+	b, err := ioutil.ReadFile(config.logPath(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "token [MASKED]\n[MASKED]\n"; string(b) != want {
+		t.Errorf("secret was not masked in the stored log: got %q want %q", b, want)
+	}
+
+	// Set up the request.
+	req, err := http.NewRequest("GET", "/job/"+id+"/log", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if strings.Contains(rr.Body.String(), "hunter2") {
+		t.Errorf("secret was served in the log: %q", rr.Body.String())
+	}
+}
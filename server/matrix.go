@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxMatrixJobs limits how many jobs a single matrix can expand into.
+const maxMatrixJobs = 256
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Matrix fans a job out over every combination of its variables.
+type Matrix struct {
+	Vars    map[string][]string `json:"vars" yaml:"vars"`
+	Include []map[string]string `json:"include,omitempty" yaml:"include,omitempty"`
+	Exclude []map[string]string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+}
+
+// validate checks that the matrix only uses variables that can be put into
+// the environment and does not expand into too many jobs.
+func (m *Matrix) validate() error {
+	for name, values := range m.Vars {
+		if !envName.MatchString(name) {
+			return fmt.Errorf("matrix variable %q is not a valid environment variable name", name)
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("matrix variable %s has no values", name)
+		}
+	}
+
+	for _, include := range m.Include {
+		for name := range include {
+			if !envName.MatchString(name) {
+				return fmt.Errorf("matrix variable %q is not a valid environment variable name", name)
+			}
+		}
+	}
+
+	for _, exclude := range m.Exclude {
+		for name := range exclude {
+			if _, ok := m.Vars[name]; !ok {
+				return fmt.Errorf("matrix exclude refers to unknown variable %s", name)
+			}
+		}
+	}
+
+	combinations := m.combinations()
+	if len(combinations) == 0 {
+		return errors.New("matrix does not expand into any jobs")
+	}
+	if len(combinations) > maxMatrixJobs {
+		return fmt.Errorf("matrix expands into %d jobs, at most %d are allowed", len(combinations), maxMatrixJobs)
+	}
+
+	return nil
+}
+
+// combinations returns every combination of the matrix variables that is not
+// excluded, followed by the included combinations that are not there yet.
+func (m *Matrix) combinations() []map[string]string {
+	names := make([]string, 0, len(m.Vars))
+	for name := range m.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var combinations []map[string]string
+	if len(names) > 0 {
+		combinations = []map[string]string{{}}
+	}
+
+	for _, name := range names {
+		var next []map[string]string
+		for _, c := range combinations {
+			for _, value := range m.Vars[name] {
+				n := make(map[string]string, len(c)+1)
+				for k, v := range c {
+					n[k] = v
+				}
+				n[name] = value
+				next = append(next, n)
+			}
+		}
+		combinations = next
+	}
+
+	var kept []map[string]string
+	for _, c := range combinations {
+		excluded := false
+		for _, exclude := range m.Exclude {
+			if matches(c, exclude) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept = append(kept, c)
+		}
+	}
+
+	for _, include := range m.Include {
+		found := false
+		for _, c := range kept {
+			if matches(c, include) && len(c) == len(include) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kept = append(kept, include)
+		}
+	}
+
+	return kept
+}
+
+// matches reports whether every variable of want has the same value in c.
+func matches(c, want map[string]string) bool {
+	for k, v := range want {
+		if c[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// variant is one of the jobs a job request expands into.
+type variant struct {
+	req  JobRequest
+	vars map[string]string
+}
+
+// variants returns the requests a job request expands into, one for every
+// combination of its matrix. A request without a matrix is returned as is.
+func (r *JobRequest) variants() []variant {
+	if r.Matrix == nil {
+		return []variant{{req: *r}}
+	}
+
+	var variants []variant
+	for _, c := range r.Matrix.combinations() {
+		v := *r
+		v.Matrix = nil
+		v.Name = r.Name + " (" + describeCombination(c) + ")"
+		v.Env = make(map[string]string, len(r.Env)+len(c))
+		for k, val := range r.Env {
+			v.Env[k] = val
+		}
+		for k, val := range c {
+			v.Env[k] = val
+		}
+		variants = append(variants, variant{req: v, vars: c})
+	}
+	return variants
+}
+
+// describeCombination formats a combination of matrix variables as k=v pairs.
+func describeCombination(c map[string]string) string {
+	pairs := make([]string, 0, len(c))
+	for k, v := range c {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMatrixCombinations(t *testing.T) {
+	m := &Matrix{
+		Vars: map[string][]string{
+			"GO":   {"1.13", "1.14"},
+			"ARCH": {"amd64", "arm64"},
+		},
+		Exclude: []map[string]string{{"GO": "1.13", "ARCH": "arm64"}},
+		Include: []map[string]string{{"GO": "1.15", "ARCH": "amd64"}, {"GO": "1.14", "ARCH": "amd64"}},
+	}
+
+	var got []string
+	for _, c := range m.combinations() {
+		got = append(got, describeCombination(c))
+	}
+
+	want := "ARCH=amd64, GO=1.13|ARCH=amd64, GO=1.14|ARCH=arm64, GO=1.14|ARCH=amd64, GO=1.15"
+	if strings.Join(got, "|") != want {
+		t.Errorf("unexpected combinations: got %s want %s", strings.Join(got, "|"), want)
+	}
+}
+
+func TestMatrixInvalid(t *testing.T) {
+	tests := []string{
+		"name: a\ncommands: [ls]\nmatrix:\n  vars:\n    GO: []\n",
+		"name: a\ncommands: [ls]\nmatrix:\n  vars:\n    go-version: [1]\n",
+		"name: a\ncommands: [ls]\nmatrix:\n  vars:\n    GO: [1]\n  exclude:\n    - OS: linux\n",
+		"name: a\ncommands: [ls]\nmatrix:\n  vars:\n    GO: [1]\n  exclude:\n    - GO: 1\n",
+		"name: a\nmatrix:\n  vars:\n    GO: [1]\njobs:\n  - name: b\n    commands: [ls]\n",
+	}
+
+	for _, body := range tests {
+		if _, err := parseJobRequest("application/x-yaml", []byte(body)); err == nil {
+			t.Errorf("expected an error for %q", body)
+		}
+	}
+}
+
+func TestMatrixJob(t *testing.T) {
+	config, cleanup := newTestConfig(t, 2)
+	defer cleanup()
+
+	id := postPipeline(t, config, `
+name: toolchain
+env:
+  FLAGS: -v
+matrix:
+  vars:
+    GO: ["1.13", "1.14"]
+    OPT: ["0", "2"]
+  exclude:
+    - GO: "1.13"
+      OPT: "2"
+commands:
+  - echo "go $GO -O$OPT $FLAGS"
+  - test "$GO" != 1.14 || test "$OPT" != 2
+`)
+
+	pipeline := waitForJob(t, config, id)
+	if pipeline.State != StateFailed || len(pipeline.Children) != 3 {
+		t.Fatalf("unexpected pipeline: %+v", pipeline)
+	}
+
+	jobs := pipelineJobs(t, config, id)
+
+	tests := []struct {
+		name, output string
+		state        JobState
+	}{
+		{"toolchain (GO=1.13, OPT=0)", "go 1.13 -O0 -v", StateSucceeded},
+		{"toolchain (GO=1.14, OPT=0)", "go 1.14 -O0 -v", StateSucceeded},
+		{"toolchain (GO=1.14, OPT=2)", "go 1.14 -O2 -v", StateFailed},
+	}
+
+	for _, test := range tests {
+		job, ok := jobs[test.name]
+		if !ok {
+			t.Errorf("job %s was not created", test.name)
+			continue
+		}
+
+		if job.State != test.state || job.Matrix["GO"] == "" {
+			t.Errorf("unexpected job %s: %+v", test.name, job)
+		}
+
+		b, err := ioutil.ReadFile(config.logPath(job.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), test.output) {
+			t.Errorf("job %s did not get its variables: %q", test.name, b)
+		}
+	}
+}
+
+func TestMatrixNeeds(t *testing.T) {
+	config, cleanup := newTestConfig(t, 2)
+	defer cleanup()
+
+	id := postPipeline(t, config, `
+name: release
+jobs:
+  - name: test
+    matrix:
+      vars:
+        GO: ["1.13", "1.14"]
+    commands: ["true"]
+  - name: deploy
+    needs: [test]
+    commands: ["true"]
+`)
+
+	if pipeline := waitForJob(t, config, id); pipeline.State != StateSucceeded {
+		t.Fatalf("pipeline did not succeed: %+v", pipeline)
+	}
+
+	jobs := pipelineJobs(t, config, id)
+
+	// Needing a matrix job means needing every one of its variants.
+	if deploy := jobs["deploy"]; len(deploy.Needs) != 2 {
+		t.Errorf("deploy does not need all variants: %+v", deploy)
+	}
+}
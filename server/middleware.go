@@ -98,6 +98,13 @@ func (w *LogRequest) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Flush sends any buffered data to the client, so that streaming handlers keep working behind AccessLogger.
+func (w *LogRequest) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // SimpleMiddleware is just an example logging middleware.
 func SimpleMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/junland/conveyor/executor"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// defaultStage and defaultStep name the single step that runs the commands of a flat job request.
+const (
+	defaultStage = "default"
+	defaultStep  = "commands"
+)
+
+// Stage is a named phase of a pipeline, such as build, test or package.
+type Stage struct {
+	Name  string `json:"name" yaml:"name"`
+	Steps []Step `json:"steps" yaml:"steps"`
+}
+
+// Step is a list of commands that are run together in one shell.
+type Step struct {
+	Name     string            `json:"name" yaml:"name"`
+	Commands []string          `json:"commands" yaml:"commands"`
+	Env      map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	Dir      string            `json:"dir,omitempty" yaml:"dir,omitempty"`
+	Shell    string            `json:"shell,omitempty" yaml:"shell,omitempty"`
+}
+
+// StageStatus reports the progress of a stage of a job.
+type StageStatus struct {
+	Name  string       `json:"name"`
+	State JobState     `json:"state"`
+	Steps []StepStatus `json:"steps"`
+}
+
+// StepStatus reports the progress of a step of a job.
+type StepStatus struct {
+	Name       string     `json:"name"`
+	State      JobState   `json:"state"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// parseJobRequest decodes a job request. YAML pipeline definitions are
+// accepted when the content type says so, anything else is read as JSON.
+func parseJobRequest(contentType string, body []byte) (JobRequest, error) {
+	var req JobRequest
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch mediaType {
+	case "application/x-yaml", "application/yaml", "text/yaml", "text/x-yaml":
+		if err := yaml.UnmarshalStrict(body, &req); err != nil {
+			return req, fmt.Errorf("could not parse yaml: %s", err)
+		}
+	default:
+		if err := json.Unmarshal(body, &req); err != nil {
+			return req, fmt.Errorf("could not parse json: %s", err)
+		}
+	}
+
+	if len(req.Needs) > 0 {
+		return req, errors.New("needs can only be used by the jobs of a pipeline")
+	}
+
+	return req, req.validate()
+}
+
+// validate checks that a job request describes something that can be run.
+func (r *JobRequest) validate() error {
+	// Just do a quick bit of sanity checking to make sure the client actually provided us with a name.
+	if r.Name == "" {
+		return errors.New("no job name specified")
+	}
+
+	for name := range r.Env {
+		if !envName.MatchString(name) {
+			return fmt.Errorf("%q is not a valid environment variable name", name)
+		}
+	}
+
+	if r.Timeout < 0 {
+		return errors.New("timeout cannot be negative")
+	}
+
+	if r.Retry != nil {
+		if err := r.Retry.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Source != nil {
+		if err := r.Source.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := validateArtifacts(r.Artifacts); err != nil {
+		return err
+	}
+
+	if err := validateCleanup(r.Cleanup); err != nil {
+		return err
+	}
+
+	if r.Cache != nil {
+		if err := r.Cache.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Sandbox != nil {
+		if err := r.Sandbox.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Limits != nil {
+		if err := r.Limits.validate(); err != nil {
+			return err
+		}
+	}
+
+	if r.Image != "" {
+		if err := validateImage(r.Image); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range r.Secrets {
+		if !envName.MatchString(name) {
+			return fmt.Errorf("%q is not a valid secret name", name)
+		}
+		if _, ok := r.Env[name]; ok {
+			return fmt.Errorf("%s is both a variable and a secret", name)
+		}
+	}
+
+	if r.Matrix != nil {
+		if len(r.Jobs) > 0 {
+			return errors.New("a pipeline with jobs cannot have a matrix, give the matrix to its jobs instead")
+		}
+		if err := r.Matrix.validate(); err != nil {
+			return err
+		}
+	}
+
+	if len(r.Jobs) > 0 {
+		if len(r.Artifacts) > 0 {
+			return errors.New("a pipeline with jobs cannot have artifacts, give them to its jobs instead")
+		}
+		if r.Cache != nil {
+			return errors.New("a pipeline with jobs cannot have a cache, give it to its jobs instead")
+		}
+		return r.validateJobs()
+	}
+
+	if len(r.Commands) > 0 && len(r.Stages) > 0 {
+		return errors.New("a job can either have commands or stages, not both")
+	}
+
+	seen := make(map[string]bool)
+	for _, stage := range r.Stages {
+		if stage.Name == "" {
+			return errors.New("every stage needs a name")
+		}
+		if seen[stage.Name] {
+			return fmt.Errorf("stage %s is defined more than once", stage.Name)
+		}
+		seen[stage.Name] = true
+
+		if len(stage.Steps) == 0 {
+			return fmt.Errorf("stage %s has no steps", stage.Name)
+		}
+
+		for i, step := range stage.Steps {
+			if len(step.Commands) == 0 {
+				return fmt.Errorf("step %d of stage %s has no commands", i+1, stage.Name)
+			}
+			if d := filepath.Clean(step.Dir); filepath.IsAbs(d) || d == ".." || strings.HasPrefix(d, "../") {
+				return fmt.Errorf("step %d of stage %s has a directory outside of the workspace", i+1, stage.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// pipeline returns the stages of a job request. A flat list of commands is
+// run as a single stage with a single step. A request with jobs or a matrix
+// has no stages of its own.
+func (r *JobRequest) pipeline() []Stage {
+	if len(r.Jobs) > 0 || r.Matrix != nil {
+		return nil
+	}
+	if len(r.Stages) > 0 {
+		return r.Stages
+	}
+	return []Stage{{Name: defaultStage, Steps: []Step{{Name: defaultStep, Commands: r.Commands}}}}
+}
+
+// newStageStatus returns the status of a job whose steps have not run yet.
+func newStageStatus(stages []Stage) []StageStatus {
+	status := make([]StageStatus, len(stages))
+	for i, stage := range stages {
+		status[i] = StageStatus{Name: stage.Name, State: StatePending, Steps: make([]StepStatus, len(stage.Steps))}
+		for k, step := range stage.Steps {
+			name := step.Name
+			if name == "" {
+				name = fmt.Sprintf("step-%d", k+1)
+			}
+			status[i].Steps[k] = StepStatus{Name: name, State: StatePending}
+		}
+	}
+	return status
+}
+
+// executorSteps turns the stages of a pipeline into the steps run by the
+// executor. script returns the path of the script file for the n-th step.
+func executorSteps(stages []Stage, status []StageStatus, script func(n int) string) []executor.Step {
+	var steps []executor.Step
+	for i, stage := range stages {
+		for k, step := range stage.Steps {
+			steps = append(steps, executor.Step{
+				Name:   stage.Name + "/" + status[i].Steps[k].Name,
+				Script: script(len(steps)),
+				Shell:  step.Shell,
+				Dir:    step.Dir,
+				Env:    envList(step.Env),
+			})
+		}
+	}
+	return steps
+}
+
+// envList turns a map of environment variables into a sorted KEY=value list.
+func envList(env map[string]string) []string {
+	list := make([]string, 0, len(env))
+	for k, v := range env {
+		list = append(list, k+"="+v)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// step returns the status of the n-th step of the job, counting across stages.
+func (j *Job) step(n int) (*StageStatus, *StepStatus) {
+	for i := range j.Stages {
+		if n < len(j.Stages[i].Steps) {
+			return &j.Stages[i], &j.Stages[i].Steps[n]
+		}
+		n -= len(j.Stages[i].Steps)
+	}
+	return nil, nil
+}
+
+// finishSteps marks the steps that did not get to run as skipped and steps
+// that were still running as cancelled once the job is done.
+func (j *Job) finishSteps(at time.Time) {
+	for i := range j.Stages {
+		for k := range j.Stages[i].Steps {
+			step := &j.Stages[i].Steps[k]
+			switch step.State {
+			case StatePending:
+				step.State = StateSkipped
+			case StateRunning:
+				step.State = StateCancelled
+				step.FinishedAt = &at
+			}
+		}
+		j.Stages[i].update()
+	}
+}
+
+// update derives the state of a stage from the state of its steps.
+func (s *StageStatus) update() {
+	counts := make(map[JobState]int)
+	for _, step := range s.Steps {
+		counts[step.State]++
+	}
+
+	switch {
+	case counts[StateTimedOut] > 0:
+		s.State = StateTimedOut
+	case counts[StateFailed] > 0:
+		s.State = StateFailed
+	case counts[StateCancelled] > 0:
+		s.State = StateCancelled
+	case counts[StateRunning] > 0:
+		s.State = StateRunning
+	case counts[StateSkipped] > 0 && counts[StateSucceeded] > 0:
+		// The job was stopped in between two steps of the stage.
+		s.State = StateCancelled
+	case counts[StateSucceeded] == len(s.Steps):
+		s.State = StateSucceeded
+	case counts[StateSkipped] == len(s.Steps):
+		s.State = StateSkipped
+	case counts[StateSucceeded] > 0:
+		s.State = StateRunning
+	default:
+		s.State = StatePending
+	}
+}
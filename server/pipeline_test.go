@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPipeline = `
+name: frontend
+stages:
+  - name: build
+    steps:
+      - name: compile
+        env:
+          TARGET: release
+        commands:
+          - mkdir -p out
+          - echo "building $TARGET" > out/build.txt
+  - name: test
+    steps:
+      - name: unit
+        dir: out
+        commands:
+          - test -f build.txt
+          - exit 4
+      - name: lint
+        commands:
+          - echo lint
+  - name: package
+    steps:
+      - commands:
+          - echo package
+`
+
+// postPipeline posts a YAML pipeline and returns the id of the new job.
+func postPipeline(t *testing.T, config *Config, body string) string {
+	req, err := http.NewRequest("POST", "/job", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-yaml")
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+	}
+
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.ID
+}
+
+func TestParseJobRequest(t *testing.T) {
+	req, err := parseJobRequest("application/x-yaml; charset=utf-8", []byte(testPipeline))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(req.Stages) != 3 || req.Stages[1].Steps[0].Dir != "out" || req.Stages[0].Steps[0].Env["TARGET"] != "release" {
+		t.Errorf("pipeline was not parsed correctly: %+v", req)
+	}
+
+	// Flat JSON requests are run as a single step.
+	req, err = parseJobRequest("application/json", []byte(`{"name": "backend", "commands": ["echo 1"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stages := req.pipeline()
+	if len(stages) != 1 || len(stages[0].Steps) != 1 || stages[0].Steps[0].Commands[0] != "echo 1" {
+		t.Errorf("flat request was not turned into a single step: %+v", stages)
+	}
+}
+
+func TestParseJobRequestInvalid(t *testing.T) {
+	tests := []struct {
+		contentType, body string
+	}{
+		{"application/json", `{"commands": ["echo 1"]}`},
+		{"application/json", `{"name": "a", "commands": ["echo 1"], "stages": [{"name": "b", "steps": [{"commands": ["echo 1"]}]}]}`},
+		{"application/x-yaml", "name: a\nstages:\n  - name: build\n"},
+		{"application/x-yaml", "name: a\nstages:\n  - name: build\n    steps:\n      - name: empty\n"},
+		{"application/x-yaml", "name: a\nstages:\n  - name: build\n    steps:\n      - commands: [ls]\n  - name: build\n    steps:\n      - commands: [ls]\n"},
+		{"application/x-yaml", "name: a\nstages:\n  - name: build\n    steps:\n      - commands: [ls]\n        dir: ../other\n"},
+		{"application/x-yaml", "name: a\nstagez: []\n"},
+	}
+
+	for _, test := range tests {
+		if _, err := parseJobRequest(test.contentType, []byte(test.body)); err == nil {
+			t.Errorf("expected an error for %q", test.body)
+		}
+	}
+}
+
+func TestPipelineJob(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	id := postPipeline(t, config, testPipeline)
+
+	job := waitForJob(t, config, id)
+	if job.State != StateFailed || *job.ExitCode != 4 {
+		t.Fatalf("job did not fail: %+v", job)
+	}
+
+	want := []struct {
+		stage JobState
+		steps []JobState
+	}{
+		{StateSucceeded, []JobState{StateSucceeded}},
+		{StateFailed, []JobState{StateFailed, StateSkipped}},
+		{StateSkipped, []JobState{StateSkipped}},
+	}
+
+	for i, stage := range job.Stages {
+		if stage.State != want[i].stage {
+			t.Errorf("stage %s has wrong state: got %s want %s", stage.Name, stage.State, want[i].stage)
+		}
+		for k, step := range stage.Steps {
+			if step.State != want[i].steps[k] {
+				t.Errorf("step %s/%s has wrong state: got %s want %s", stage.Name, step.Name, step.State, want[i].steps[k])
+			}
+		}
+	}
+
+	if code := job.Stages[1].Steps[0].ExitCode; code == nil || *code != 4 {
+		t.Errorf("failed step has wrong exit code: %v", code)
+	}
+
+	if name := job.Stages[2].Steps[0].Name; name != "step-1" {
+		t.Errorf("unnamed step got the wrong name: %s", name)
+	}
+
+	// The environment of the build step ends up in its output.
+	b, err := ioutil.ReadFile(filepath.Join(config.jobDir(1, id), "out/build.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "building release") {
+		t.Errorf("step environment was not set: %q", b)
+	}
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// pollersKind is the kind of record the state of pollers is stored as.
+	pollersKind = "pollers"
+	// defaultPollInterval is how often repositories are polled by default.
+	defaultPollInterval = time.Minute
+	// minPollInterval keeps pollers from hammering a repository.
+	minPollInterval = time.Second
+)
+
+// Poller queues a pipeline for every new commit on the branches of a
+// repository that cannot send webhooks.
+type Poller struct {
+	// Name identifies the poller in the API and the job store.
+	Name string `yaml:"name"`
+	// Repo is the URL or local path of the git repository.
+	Repo string `yaml:"repo"`
+	// Branches limits the branches that are built, every branch if empty.
+	// Entries are patterns as understood by path.Match.
+	Branches []string `yaml:"branches,omitempty"`
+	// Interval is the time between two polls, a minute by default.
+	Interval Duration `yaml:"interval,omitempty"`
+	// Pipeline is queued for every new head, checking out its commit.
+	Pipeline JobRequest `yaml:"pipeline"`
+}
+
+// PollState is what a poller has seen of its repository.
+type PollState struct {
+	Name string `json:"name"`
+	Repo string `json:"repo"`
+	// Heads maps the polled branches to the last commit seen on them.
+	Heads map[string]string `json:"heads"`
+	// Jobs maps the branches to the last job queued for them.
+	Jobs     map[string]string `json:"jobs,omitempty"`
+	PolledAt *time.Time        `json:"polled_at,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// poller is a configured Poller along with its state.
+type poller struct {
+	Poller
+
+	mu    sync.Mutex
+	state PollState
+}
+
+// validate checks that the repository of the poller can be polled and fills
+// in the defaults.
+func (p *Poller) validate() error {
+	src := Source{Repo: p.Repo}
+	if err := src.validate(); err != nil {
+		return err
+	}
+	if p.Interval == 0 {
+		p.Interval = Duration(defaultPollInterval)
+	}
+	if time.Duration(p.Interval) < minPollInterval {
+		return fmt.Errorf("interval has to be at least %s", minPollInterval)
+	}
+	return validateTrigger(p.Name, p.Branches, &p.Pipeline)
+}
+
+// loadPollers reads the pollers from the pollers file, if one is configured,
+// and restores what they have seen from the job store.
+func (c *Config) loadPollers() error {
+	c.pollers = make(map[string]*poller)
+
+	if c.PollersFile == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(c.PollersFile)
+	if err != nil {
+		return err
+	}
+
+	var file struct {
+		Pollers []Poller `yaml:"pollers"`
+	}
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return fmt.Errorf("could not parse %s: %s", c.PollersFile, err)
+	}
+
+	for _, def := range file.Pollers {
+		if err := def.validate(); err != nil {
+			return fmt.Errorf("poller %q: %s", def.Name, err)
+		}
+		if _, ok := c.pollers[def.Name]; ok {
+			return fmt.Errorf("poller %q is defined more than once", def.Name)
+		}
+		c.pollers[def.Name] = &poller{Poller: def, state: PollState{Name: def.Name, Repo: def.Repo}}
+	}
+
+	err = c.jobs.store.List(pollersKind, func(name string, data []byte) error {
+		p, ok := c.pollers[name]
+		if !ok {
+			return nil
+		}
+		var state PollState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return err
+		}
+		// What was seen of another repository does not count.
+		if state.Repo == p.Repo {
+			p.state = state
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not load poller state: %s", err)
+	}
+
+	log.Infof("Loaded %d pollers from %s", len(c.pollers), c.PollersFile)
+
+	return nil
+}
+
+// startPollers polls every repository at its interval until the server stops.
+func (c *Config) startPollers() {
+	for _, p := range c.pollers {
+		go c.runPoller(p)
+	}
+}
+
+// runPoller polls a repository right away and then at its interval.
+func (c *Config) runPoller(p *poller) {
+	ticker := time.NewTicker(time.Duration(p.Interval))
+	defer ticker.Stop()
+
+	for {
+		if err := c.poll(p); err != nil {
+			log.Warnf("Could not poll %s for poller %s: %s", p.Repo, p.Name, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// lsRemote returns the commit every branch of a repository points at.
+func lsRemote(ctx context.Context, repo string, env []string) (map[string]string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--heads", repo)
+	cmd.Env = append(append([]string{}, env...), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git ls-remote: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	heads := make(map[string]string)
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "refs/heads/") {
+			continue
+		}
+		heads[strings.TrimPrefix(fields[1], "refs/heads/")] = fields[0]
+	}
+	return heads, scanner.Err()
+}
+
+// poll looks for new heads in the repository of a poller and queues the
+// pipeline for each of them. The first poll of a repository only records
+// its heads. The new heads are saved to the job store before any job is
+// queued, so that a restart never builds a head twice.
+func (c *Config) poll(p *poller) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.Interval)+time.Minute)
+	defer cancel()
+
+	heads, err := lsRemote(ctx, p.Repo, allowedEnv(os.Environ(), c.EnvAllow))
+
+	now := time.Now()
+	p.state.PolledAt = &now
+	p.state.Error = ""
+
+	if err != nil {
+		p.state.Error = err.Error()
+		c.savePollState(&p.state)
+		return err
+	}
+
+	first := p.state.Heads == nil
+	seen := make(map[string]string)
+	var branches []string
+
+	for branch, commit := range heads {
+		if !matchBranch(p.Branches, branch) {
+			continue
+		}
+		seen[branch] = commit
+		if !first && p.state.Heads[branch] != commit {
+			branches = append(branches, branch)
+		}
+	}
+
+	p.state.Heads = seen
+	c.savePollState(&p.state)
+
+	if first {
+		log.Infof("Poller %s is watching %d branches of %s", p.Name, len(seen), p.Repo)
+	}
+
+	sort.Strings(branches)
+
+	for _, branch := range branches {
+		req := sourceRequest(p.Pipeline, p.Repo, branch, seen[branch])
+
+		err := c.checkSecrets(&req)
+		if err == nil {
+			var job *Job
+			job, _, err = c.queueJob(req)
+			if p.state.Jobs == nil {
+				p.state.Jobs = make(map[string]string)
+			}
+			p.state.Jobs[branch] = job.ID
+			log.Infof("Poller %s queued job %s for %s at %s", p.Name, job.ID, branch, seen[branch])
+		}
+		if err != nil {
+			log.Errorf("Poller %s could not queue a job for %s: %s", p.Name, branch, err)
+			p.state.Error = err.Error()
+		}
+	}
+
+	if len(branches) > 0 {
+		c.savePollState(&p.state)
+	}
+
+	return nil
+}
+
+// savePollState writes the state of a poller to the job store.
+func (c *Config) savePollState(state *PollState) {
+	if err := c.jobs.store.Put(pollersKind, state.Name, state); err != nil {
+		log.Errorf("Could not save state of poller %s: %s", state.Name, err)
+	}
+}
+
+// snapshot returns a copy of what the poller has seen.
+func (p *poller) snapshot() PollState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := p.state
+	state.Heads = copyMap(p.state.Heads)
+	state.Jobs = copyMap(p.state.Jobs)
+	return state
+}
+
+// copyMap returns a copy of m, nil if m is nil.
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// ListPollers serves the state of every poller sorted by name.
+func (c *Config) ListPollers(w http.ResponseWriter, r *http.Request) {
+	pollers := []PollState{}
+	for _, p := range c.pollers {
+		pollers = append(pollers, p.snapshot())
+	}
+	sort.Slice(pollers, func(i, k int) bool { return pollers[i].Name < pollers[k].Name })
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{"pollers": pollers})
+}
+
+// PollNow polls the repository of a poller right away and serves its state.
+func (c *Config) PollNow(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+	name := ps.ByName("name")
+
+	p, ok := c.pollers[name]
+	if !ok {
+		respondError(w, http.StatusNotFound, "Poller not found.")
+		return
+	}
+
+	if err := c.poll(p); err != nil {
+		log.Warnf("Could not poll %s for poller %s: %s", p.Repo, name, err)
+		respondError(w, http.StatusBadGateway, "Could not poll repository.")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, p.snapshot())
+}
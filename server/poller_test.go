@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newPollerConfig sets up a server with a job database and the given pollers.
+func newPollerConfig(t *testing.T, dir, pollers string) (*Config, func()) {
+	config := &Config{
+		Workers:      1,
+		WorkersDir:   filepath.Join(dir, "worker"),
+		WorkspaceDir: filepath.Join(dir, "workspace"),
+		DBFile:       filepath.Join(dir, "conveyor.db"),
+		PollersFile:  filepath.Join(dir, "pollers.yml"),
+		EnvAllow:     []string{"PATH"},
+	}
+
+	if err := ioutil.WriteFile(config.PollersFile, []byte(pollers), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config.createDirs()
+	if err := config.setup(); err != nil {
+		t.Fatal(err)
+	}
+	config.recoverJobs()
+	if err := config.loadPollers(); err != nil {
+		t.Fatal(err)
+	}
+
+	return config, func() {
+		config.schedules.close()
+		config.pool.Stop()
+		config.jobs.store.Close()
+	}
+}
+
+// pollNow polls a repository through the API and returns the poller state.
+func pollNow(t *testing.T, config *Config, name string) PollState {
+	// Set up the request.
+	req, err := http.NewRequest("POST", "/pollers/"+name+"/poll", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+	}
+
+	var state PollState
+	if err := json.Unmarshal(rr.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestPollerInvalid(t *testing.T) {
+	tests := []Poller{
+		{Name: "app", Pipeline: JobRequest{Commands: []string{"ls"}}},
+		{Name: "app", Repo: "-x", Pipeline: JobRequest{Commands: []string{"ls"}}},
+		{Name: "a/b", Repo: "repo", Pipeline: JobRequest{Commands: []string{"ls"}}},
+		{Name: "app", Repo: "repo", Interval: 1, Pipeline: JobRequest{Commands: []string{"ls"}}},
+		{Name: "app", Repo: "repo", Branches: []string{"["}, Pipeline: JobRequest{Commands: []string{"ls"}}},
+	}
+
+	for _, p := range tests {
+		if err := p.validate(); err == nil {
+			t.Errorf("expected an error for %+v", p)
+		}
+	}
+}
+
+func TestPoll(t *testing.T) {
+	repo, commits := newTestRepo(t, "first")
+	defer os.RemoveAll(repo)
+
+	dir, err := ioutil.TempDir("", "conveyor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pollers := `
+pollers:
+  - name: app
+    repo: file://` + repo + `
+    branches: ["main", "release/*"]
+    interval: 1h
+    pipeline:
+      commands: ["echo $CONVEYOR_REF $(cat file.txt)"]
+`
+
+	config, cleanup := newPollerConfig(t, dir, pollers)
+
+	// The first poll only records the heads.
+	state := pollNow(t, config, "app")
+	if state.Heads["main"] != commits[0] || len(state.Jobs) != 0 || state.PolledAt == nil {
+		t.Fatalf("unexpected state after first poll: %+v", state)
+	}
+
+	// Every new head of a polled branch is built.
+	second := testCommit(t, repo, "second")
+	testGit(t, repo, "checkout", "--quiet", "-b", "release/1")
+	release := testCommit(t, repo, "release")
+	testGit(t, repo, "checkout", "--quiet", "-b", "feature")
+	testCommit(t, repo, "feature")
+
+	state = pollNow(t, config, "app")
+	if len(state.Heads) != 2 || len(state.Jobs) != 2 {
+		t.Fatalf("unexpected state after new commits: %+v", state)
+	}
+
+	for branch, commit := range map[string]string{"main": second, "release/1": release} {
+		job := waitForJob(t, config, state.Jobs[branch])
+		if job.State != StateSucceeded || job.Commit != commit || job.Name != "app" {
+			t.Errorf("unexpected job for %s: %+v", branch, job)
+		}
+	}
+
+	// Nothing new, nothing to build.
+	if again := pollNow(t, config, "app"); again.Jobs["main"] != state.Jobs["main"] || len(config.jobs.list()) != 2 {
+		t.Errorf("unchanged heads were built again: %+v", again)
+	}
+
+	cleanup()
+
+	// What was seen survives a restart, only the new head of main is built.
+	testGit(t, repo, "checkout", "--quiet", "main")
+	third := testCommit(t, repo, "third")
+
+	config, cleanup = newPollerConfig(t, dir, pollers)
+	defer cleanup()
+
+	state = pollNow(t, config, "app")
+	if state.Heads["main"] != third || state.Heads["release/1"] != release || state.Heads["feature"] != "" {
+		t.Errorf("unexpected heads after restart: %+v", state.Heads)
+	}
+
+	if job := waitForJob(t, config, state.Jobs["main"]); job.Commit != third {
+		t.Errorf("unexpected job after restart: %+v", job)
+	}
+	if n := len(config.jobs.list()); n != 3 {
+		t.Errorf("unexpected number of jobs after restart: got %d want 3", n)
+	}
+}
+
+func TestPollFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config, cleanup := newPollerConfig(t, dir, `
+pollers:
+  - name: app
+    repo: /does/not/exist
+    pipeline:
+      commands: ["true"]
+`)
+	defer cleanup()
+
+	// Set up the request.
+	req, err := http.NewRequest("POST", "/pollers/app/poll", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadGateway {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadGateway)
+	}
+
+	if state := config.pollers["app"].snapshot(); state.Error == "" || state.Heads != nil {
+		t.Errorf("failure was not recorded: %+v", state)
+	}
+}
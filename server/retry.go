@@ -0,0 +1,239 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/junland/conveyor/executor"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of failures a job can be retried on.
+const (
+	RetryOnExit    = "exit"
+	RetryOnTimeout = "timeout"
+	RetryOnError   = "error"
+)
+
+// maxRetryAttempts limits how often a single job can be run.
+const maxRetryAttempts = 10
+
+// RetryPolicy describes when and how often a failed job is run again.
+type RetryPolicy struct {
+	// Attempts is the number of times the job is run at most, including the first run.
+	Attempts int `json:"attempts" yaml:"attempts"`
+	// Backoff is how long to wait before the first retry, it doubles with every retry.
+	Backoff Duration `json:"backoff,omitempty" yaml:"backoff,omitempty"`
+	// MaxBackoff caps the time between retries.
+	MaxBackoff Duration `json:"max_backoff,omitempty" yaml:"max_backoff,omitempty"`
+	// On lists the kinds of failures that are retried, all of them if empty.
+	On []string `json:"on,omitempty" yaml:"on,omitempty"`
+}
+
+// RunRecord records a single run of a job.
+type RunRecord struct {
+	Number     int        `json:"number"`
+	State      JobState   `json:"state"`
+	Worker     int        `json:"worker,omitempty"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Usage      *Usage     `json:"usage,omitempty"`
+}
+
+// validate checks that the retry policy can be followed.
+func (p *RetryPolicy) validate() error {
+	if p.Attempts < 1 || p.Attempts > maxRetryAttempts {
+		return fmt.Errorf("retry attempts have to be between 1 and %d", maxRetryAttempts)
+	}
+	if p.Backoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("retry backoff cannot be negative")
+	}
+	for _, kind := range p.On {
+		switch kind {
+		case RetryOnExit, RetryOnTimeout, RetryOnError:
+		default:
+			return fmt.Errorf("cannot retry on %q, expected %s, %s or %s", kind, RetryOnExit, RetryOnTimeout, RetryOnError)
+		}
+	}
+	return nil
+}
+
+// retries reports whether the policy covers the given kind of failure.
+func (p *RetryPolicy) retries(kind string) bool {
+	if len(p.On) == 0 {
+		return true
+	}
+	for _, k := range p.On {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns how long to wait before the given run.
+func (p *RetryPolicy) delay(run int) time.Duration {
+	d := time.Duration(p.Backoff)
+	for i := 2; i < run; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > time.Duration(p.MaxBackoff) {
+		d = time.Duration(p.MaxBackoff)
+	}
+	return d
+}
+
+// failureKind returns the kind of failure of a finished task, or an empty
+// string if the task did not fail in a way that can be retried.
+func failureKind(res *executor.Result) string {
+	switch {
+	case res.TimedOut:
+		return RetryOnTimeout
+	case res.Cancelled:
+		return ""
+	case res.Err != nil:
+		return RetryOnError
+	case res.ExitCode != 0:
+		return RetryOnExit
+	}
+	return ""
+}
+
+// runNumber returns the number of the current run of the job.
+func (j *Job) runNumber() int {
+	if j.Run < 1 {
+		return 1
+	}
+	return j.Run
+}
+
+// currentRun returns the record of the current run, adding it if needed.
+func (j *Job) currentRun() *RunRecord {
+	n := j.runNumber()
+	if len(j.Runs) == 0 || j.Runs[len(j.Runs)-1].Number != n {
+		j.Runs = append(j.Runs, RunRecord{Number: n, State: j.State})
+	}
+	return &j.Runs[len(j.Runs)-1]
+}
+
+// recordRun copies the outcome of the current run into its record.
+func (j *Job) recordRun() {
+	run := j.currentRun()
+	run.State = j.State
+	run.Worker = j.Worker
+	run.ExitCode = j.ExitCode
+	run.Reason = j.Reason
+	run.Error = j.Error
+	run.FinishedAt = j.FinishedAt
+	run.Usage = j.Usage
+}
+
+// retry prepares a failed job to be run again if its retry policy allows it
+// and returns how long to wait before submitting it.
+func (j *Job) retry(res *executor.Result) (time.Duration, bool) {
+	p := j.Request.Retry
+	if p == nil || j.runNumber() >= p.Attempts {
+		return 0, false
+	}
+
+	kind := failureKind(res)
+	if kind == "" || !p.retries(kind) {
+		return 0, false
+	}
+
+	j.Run = j.runNumber() + 1
+	j.setState(StateQueued, time.Now())
+	j.ExitCode = nil
+	j.FinishedAt = nil
+	j.Reason = ""
+	j.Error = ""
+	j.Usage = nil
+	j.Stages = newStageStatus(j.Request.pipeline())
+
+	return p.delay(j.Run), true
+}
+
+// retryTimers keeps the timers of the jobs that are waiting to be retried.
+type retryTimers struct {
+	mu      sync.Mutex
+	timers  map[string]*time.Timer
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+func newRetryTimers() *retryTimers {
+	return &retryTimers{timers: make(map[string]*time.Timer)}
+}
+
+// after calls f for the job id once d has passed, unless the timers were
+// stopped before that.
+func (t *retryTimers) after(id string, d time.Duration, f func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return
+	}
+	t.timers[id] = time.AfterFunc(d, func() {
+		t.mu.Lock()
+		if t.stopped {
+			t.mu.Unlock()
+			return
+		}
+		delete(t.timers, id)
+		t.wg.Add(1)
+		t.mu.Unlock()
+
+		defer t.wg.Done()
+		f()
+	})
+}
+
+// stop stops the pending timers and waits for the ones that already fired.
+// Their jobs stay queued.
+func (t *retryTimers) stop() {
+	t.mu.Lock()
+	t.stopped = true
+	for id, timer := range t.timers {
+		timer.Stop()
+		delete(t.timers, id)
+	}
+	t.mu.Unlock()
+
+	t.wg.Wait()
+}
+
+// resubmit submits a job that is waiting to be retried, unless it was
+// cancelled in the meantime or the server is shutting down.
+func (c *Config) resubmit(id string) {
+	if c.stopping() {
+		return
+	}
+
+	job, ok := c.jobs.get(id)
+	if !ok || job.State != StateQueued || job.FinishedAt != nil {
+		return
+	}
+
+	log.Infof("Retrying job %s, run %d", id, job.runNumber())
+
+	if _, err := c.submit(&job); err != nil {
+		log.Errorf("Could not submit job %s: %s", id, err)
+		c.finished(id)
+	}
+}
+
+// runLogPath returns the path of the log of a single run of a job. The first
+// run logs to the same file as jobs without retries.
+func (c *Config) runLogPath(id string, run int) string {
+	if run <= 1 {
+		return c.logPath(id)
+	}
+	return filepath.Join(c.logDir(), id+"."+strconv.Itoa(run)+".log")
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyCommands fail until they have been run three times. The runs are
+// counted next to their workspace, which is emptied for every run.
+const flakyCommands = `["n=$(cat ../count 2>/dev/null || echo 0); n=$((n+1)); echo $n > ../count; echo run $n", "test $(cat ../count) -ge 3"]`
+
+// getRunLog returns the log of a single run of a job.
+func getRunLog(t *testing.T, config *Config, id, run string) string {
+	req, err := http.NewRequest("GET", "/job/"+id+"/log?run="+run, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	return rr.Body.String()
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &RetryPolicy{Attempts: 5, Backoff: Duration(time.Second), MaxBackoff: Duration(3 * time.Second)}
+
+	for run, want := range map[int]time.Duration{2: time.Second, 3: 2 * time.Second, 4: 3 * time.Second, 5: 3 * time.Second} {
+		if got := p.delay(run); got != want {
+			t.Errorf("unexpected delay before run %d: got %s want %s", run, got, want)
+		}
+	}
+}
+
+func TestRetryPolicyInvalid(t *testing.T) {
+	for _, retry := range []string{`{"attempts": 0}`, `{"attempts": 100}`, `{"attempts": 2, "on": ["sometimes"]}`, `{"attempts": 2, "backoff": "-1s"}`} {
+		body := `{"name": "a", "commands": ["ls"], "retry": ` + retry + `}`
+		if _, err := parseJobRequest("application/json", []byte(body)); err == nil {
+			t.Errorf("expected an error for %s", retry)
+		}
+	}
+}
+
+func TestRetryJob(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	id := postJob(t, config, `{"name": "flaky", "retry": {"attempts": 3, "backoff": "10ms"}, "commands": `+flakyCommands+`}`)
+
+	job := waitForJob(t, config, id)
+	if job.State != StateSucceeded || job.Run != 3 {
+		t.Fatalf("job did not succeed on the third run: %+v", job)
+	}
+
+	want := []JobState{StateFailed, StateFailed, StateSucceeded}
+	if len(job.Runs) != len(want) {
+		t.Fatalf("unexpected runs: %+v", job.Runs)
+	}
+	for i, run := range job.Runs {
+		if run.Number != i+1 || run.State != want[i] || run.StartedAt == nil || run.FinishedAt == nil {
+			t.Errorf("unexpected run %d: %+v", i+1, run)
+		}
+	}
+
+	// Every run has its own log.
+	for _, run := range []string{"1", "2", "3"} {
+		if got := getRunLog(t, config, id, run); got != "run "+run+"\n" {
+			t.Errorf("unexpected log of run %s: %q", run, got)
+		}
+	}
+}
+
+func TestRetryOnlyMatchingFailures(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	id := postJob(t, config, `{"name": "flaky", "retry": {"attempts": 3, "on": ["timeout", "error"]}, "commands": `+flakyCommands+`}`)
+
+	if job := waitForJob(t, config, id); job.State != StateFailed || job.Run != 1 || len(job.Runs) != 1 {
+		t.Errorf("job should not have been retried: %+v", job)
+	}
+}
+
+func TestCancelRetryingJob(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	id := postJob(t, config, `{"name": "flaky", "retry": {"attempts": 3, "backoff": "1h"}, "commands": ["false"]}`)
+
+	// Wait for the job to be queued for its second run.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if job, _ := config.jobs.get(id); job.Run == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job was not retried")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Set up the request.
+	req, err := http.NewRequest("DELETE", "/job/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	job := waitForJob(t, config, id)
+	if job.State != StateCancelled || len(job.Runs) != 2 || job.Runs[1].State != StateCancelled {
+		t.Errorf("job waiting to be retried was not cancelled: %+v", job)
+	}
+
+	if got := getRunLog(t, config, id, "2"); strings.TrimSpace(got) != "" {
+		t.Errorf("cancelled run should have no log: %q", got)
+	}
+}
@@ -25,6 +25,27 @@ func (config *Config) RegisterRoutes() *httprouter.Router {
 	router.Handler("GET", "/hello/:name", chain.ThenFunc(helloNameHandle))
 
 	router.Handler("POST", "/job", chain.ThenFunc(config.CreateJob))
+	router.Handler("GET", "/job/:id", chain.ThenFunc(config.GetJob))
+	router.Handler("DELETE", "/job/:id", chain.ThenFunc(config.CancelJob))
+	router.Handler("POST", "/job/:id", chain.ThenFunc(config.RestartJob))
+	router.Handler("GET", "/job/:id/log", chain.ThenFunc(config.GetJobLog))
+	router.Handler("GET", "/job/:id/artifacts", chain.ThenFunc(config.ListArtifacts))
+	router.Handler("GET", "/job/:id/artifacts/*path", chain.ThenFunc(config.GetArtifact))
+	router.Handler("GET", "/jobs", chain.ThenFunc(config.ListJobs))
+
+	router.Handler("GET", "/schedules", chain.ThenFunc(config.ListSchedules))
+	router.Handler("POST", "/schedules", chain.ThenFunc(config.CreateSchedule))
+	router.Handler("GET", "/schedules/:id", chain.ThenFunc(config.GetSchedule))
+	router.Handler("PUT", "/schedules/:id", chain.ThenFunc(config.UpdateSchedule))
+	router.Handler("DELETE", "/schedules/:id", chain.ThenFunc(config.DeleteSchedule))
+
+	router.Handler("GET", "/pollers", chain.ThenFunc(config.ListPollers))
+	router.Handler("POST", "/pollers/:name/poll", chain.ThenFunc(config.PollNow))
+
+	router.Handler("POST", "/hooks/:name", chain.ThenFunc(config.ReceiveHook))
+	router.Handler("GET", "/hooks/:name/deliveries", chain.ThenFunc(config.ListDeliveries))
+	router.Handler("GET", "/hooks/:name/deliveries/:delivery", chain.ThenFunc(config.GetDelivery))
+	router.Handler("POST", "/hooks/:name/deliveries/:delivery/replay", chain.ThenFunc(config.ReplayDelivery))
 
 	return router
 }
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"errors"
+	"runtime"
+
+	"github.com/junland/conveyor/executor"
+)
+
+// Sandbox runs a job with a private view of the system: its workspace, the
+// sandbox mounts of the server read-only and, unless it asks for it, no
+// network.
+type Sandbox struct {
+	Network bool `json:"network,omitempty" yaml:"network,omitempty"`
+}
+
+// validate checks that sandboxes can be used on this system.
+func (s *Sandbox) validate() error {
+	if runtime.GOOS != "linux" {
+		return errors.New("sandboxes are only supported on Linux")
+	}
+	return nil
+}
+
+// sandbox returns the executor sandbox of a job request, nil if the job is
+// not sandboxed.
+func (c *Config) sandbox(req JobRequest) *executor.Sandbox {
+	if req.Sandbox == nil {
+		return nil
+	}
+	return &executor.Sandbox{Mounts: c.SandboxMounts, Network: req.Sandbox.Network}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// newSandboxConfig returns a test config with sandboxes that can run a shell,
+// skipping the test if this user cannot create sandboxes.
+func newSandboxConfig(t *testing.T) (*Config, func()) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sandboxes are only supported on Linux")
+	}
+
+	config, cleanup := newTestConfig(t, 1)
+	config.SandboxMounts = []string{"/bin", "/sbin", "/usr", "/lib", "/lib64", "/etc"}
+
+	job := waitForJob(t, config, postJob(t, config, `{"name": "a", "sandbox": {}, "commands": ["true"]}`))
+	if job.State != StateSucceeded {
+		log := getRunLog(t, config, job.ID, "1")
+		cleanup()
+		t.Skipf("sandboxes are not available: %s", log)
+	}
+	return config, cleanup
+}
+
+func TestSandboxJob(t *testing.T) {
+	config, cleanup := newSandboxConfig(t)
+	defer cleanup()
+
+	// Files of the host outside of the sandbox mounts cannot be seen.
+	host := filepath.Join(filepath.Dir(config.WorkersDir), "host-file")
+	ioutil.WriteFile(host, []byte("secret"), 0600)
+
+	job := waitForJob(t, config, postJob(t, config, `{"name": "a", "sandbox": {}, "commands": [
+		"echo built > out",
+		"test ! -e `+host+`",
+		"! touch /usr/conveyor 2>/dev/null",
+		"grep -c : /proc/net/dev"
+	]}`))
+
+	if job.State != StateSucceeded {
+		t.Fatalf("sandboxed job failed: %+v: %s", job, getRunLog(t, config, job.ID, "1"))
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(job.Workspace, "out")); err != nil || string(b) != "built\n" {
+		t.Errorf("file written in the workspace is missing: %q %v", b, err)
+	}
+	if log := getRunLog(t, config, job.ID, "1"); !strings.HasSuffix(log, "1\n") {
+		t.Errorf("sandboxed job has a network: %q", log)
+	}
+}
+
+func TestSandboxPipeline(t *testing.T) {
+	config, cleanup := newSandboxConfig(t)
+	defer cleanup()
+
+	// Jobs of a pipeline are sandboxed like the pipeline unless they have a
+	// sandbox of their own.
+	id := postJob(t, config, `{"name": "p", "sandbox": {}, "jobs": [
+		{"name": "isolated", "commands": ["grep -c : /proc/net/dev"]},
+		{"name": "networked", "sandbox": {"network": true}, "commands": ["grep -c : /proc/net/dev"]}
+	]}`)
+	waitForJob(t, config, id)
+
+	jobs := pipelineJobs(t, config, id)
+	if log := getRunLog(t, config, jobs["isolated"].ID, "1"); !strings.HasSuffix(log, "1\n") {
+		t.Errorf("pipeline sandbox was not inherited: %q", log)
+	}
+	if job := jobs["networked"]; job.Request.Sandbox == nil || !job.Request.Sandbox.Network {
+		t.Errorf("job lost its own sandbox: %+v", job.Request.Sandbox)
+	}
+}
@@ -0,0 +1,504 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Policies for the runs of a schedule that were missed while the server was
+// not running.
+const (
+	// MissedSkip drops missed runs and waits for the next one.
+	MissedSkip = "skip"
+	// MissedCoalesce queues a single job for all missed runs.
+	MissedCoalesce = "coalesce"
+)
+
+const (
+	// schedulesKind is the kind of record schedules are stored as.
+	schedulesKind = "schedules"
+	// maxMissedRuns limits how many missed runs are counted.
+	maxMissedRuns = 10000
+	// schedulerIdle is how long the scheduler sleeps when nothing is due.
+	schedulerIdle = time.Hour
+)
+
+// Schedule queues a job at the times given by a cron expression.
+type Schedule struct {
+	ID   string `json:"id" yaml:"-"`
+	Name string `json:"name" yaml:"name"`
+	// Cron is a five field cron expression or a macro such as @daily.
+	Cron string `json:"cron" yaml:"cron"`
+	// Timezone is the IANA time zone Cron is read in, the one of the server if empty.
+	Timezone string `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+	// Jitter delays every run by a random duration of up to Jitter.
+	Jitter Duration `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+	// Missed is the policy for runs missed while the server was not running.
+	Missed string     `json:"missed,omitempty" yaml:"missed,omitempty"`
+	Job    JobRequest `json:"job" yaml:"job"`
+
+	CreatedAt  time.Time  `json:"created_at" yaml:"-"`
+	UpdatedAt  time.Time  `json:"updated_at" yaml:"-"`
+	NextRun    *time.Time `json:"next_run,omitempty" yaml:"-"`
+	LastRun    *time.Time `json:"last_run,omitempty" yaml:"-"`
+	LastJob    string     `json:"last_job,omitempty" yaml:"-"`
+	LastError  string     `json:"last_error,omitempty" yaml:"-"`
+	MissedRuns int        `json:"missed_runs,omitempty" yaml:"-"`
+
+	spec   *cronSpec
+	loc    *time.Location
+	fireAt time.Time
+}
+
+// parseSchedule reads a schedule from a JSON or YAML request body.
+func parseSchedule(contentType string, body []byte) (Schedule, error) {
+	var s Schedule
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch mediaType {
+	case "application/x-yaml", "application/yaml", "text/yaml", "text/x-yaml":
+		if err := yaml.UnmarshalStrict(body, &s); err != nil {
+			return s, fmt.Errorf("could not parse yaml: %s", err)
+		}
+	default:
+		if err := json.Unmarshal(body, &s); err != nil {
+			return s, fmt.Errorf("could not parse json: %s", err)
+		}
+	}
+
+	return s, s.compile()
+}
+
+// compile validates the schedule and parses its cron expression and time zone.
+func (s *Schedule) compile() error {
+	if s.Name == "" {
+		s.Name = s.Job.Name
+	}
+	if s.Name == "" {
+		return errors.New("no schedule name specified")
+	}
+	if s.Job.Name == "" {
+		s.Job.Name = s.Name
+	}
+
+	spec, err := parseCron(s.Cron)
+	if err != nil {
+		return err
+	}
+
+	loc := time.Local
+	if s.Timezone != "" {
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("unknown time zone %q", s.Timezone)
+		}
+	}
+
+	if s.Jitter < 0 {
+		return errors.New("jitter cannot be negative")
+	}
+
+	switch s.Missed {
+	case "":
+		s.Missed = MissedSkip
+	case MissedSkip, MissedCoalesce:
+	default:
+		return fmt.Errorf("unknown missed run policy %q, expected %s or %s", s.Missed, MissedSkip, MissedCoalesce)
+	}
+
+	if len(s.Job.Needs) > 0 {
+		return errors.New("needs can only be used by the jobs of a pipeline")
+	}
+	if err := s.Job.validate(); err != nil {
+		return err
+	}
+
+	s.spec = spec
+	s.loc = loc
+	return nil
+}
+
+// jitter returns a random delay for a single run.
+func (s *Schedule) jitter(rnd *rand.Rand) time.Duration {
+	if s.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rnd.Int63n(int64(s.Jitter)))
+}
+
+// plan sets the next run of the schedule to the first one after now, with
+// its jitter drawn from rnd.
+func (s *Schedule) plan(now time.Time, rnd *rand.Rand) {
+	next := s.spec.next(now.In(s.loc))
+	if next.IsZero() {
+		s.NextRun = nil
+		s.fireAt = time.Time{}
+		return
+	}
+	s.NextRun = &next
+	s.fireAt = next.Add(s.jitter(rnd))
+}
+
+// catchUp plans a schedule that was loaded when the server started. Runs
+// that were missed in the meantime are skipped or coalesced into a single
+// run right away, as the policy of the schedule says.
+func (s *Schedule) catchUp(now time.Time, rnd *rand.Rand) {
+	if s.NextRun == nil || s.NextRun.After(now) {
+		if s.NextRun == nil {
+			s.plan(now, rnd)
+		} else {
+			s.fireAt = s.NextRun.Add(s.jitter(rnd))
+		}
+		return
+	}
+
+	var missed int
+	last := *s.NextRun
+	for t := last; !t.IsZero() && !t.After(now) && missed < maxMissedRuns; t = s.spec.next(t) {
+		last = t
+		missed++
+	}
+
+	if s.Missed == MissedCoalesce {
+		log.Infof("Schedule %s missed %d runs, running it once", s.ID, missed)
+		s.MissedRuns += missed - 1
+		s.NextRun = &last
+		s.fireAt = now.Add(s.jitter(rnd))
+		return
+	}
+
+	log.Warnf("Schedule %s missed %d runs, skipping them", s.ID, missed)
+	s.MissedRuns += missed
+	s.plan(now, rnd)
+}
+
+// scheduleTable holds the schedules of the server and wakes up the scheduler
+// when they change. Every change is written through to the job store.
+type scheduleTable struct {
+	mu        sync.Mutex
+	schedules map[string]*Schedule
+	store     JobStore
+	wake      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	// rand draws the jitter of the schedules. The package wide source is
+	// not seeded before Go 1.20, which would give every start of the server
+	// the same jitter.
+	rand *rand.Rand
+}
+
+func newScheduleTable(store JobStore) *scheduleTable {
+	return &scheduleTable{
+		schedules: make(map[string]*Schedule),
+		store:     store,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// save writes a schedule to the store. The table lock has to be held.
+func (t *scheduleTable) save(s *Schedule) {
+	if err := t.store.Put(schedulesKind, s.ID, s); err != nil {
+		log.Errorf("Could not save schedule %s: %s", s.ID, err)
+	}
+}
+
+// notify wakes up the scheduler so that it picks up a changed schedule.
+func (t *scheduleTable) notify() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close stops the scheduler.
+func (t *scheduleTable) close() {
+	t.closeOnce.Do(func() { close(t.done) })
+}
+
+// load fills the table with the schedules kept in the store and catches up
+// on the runs they missed.
+func (t *scheduleTable) load(now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err := t.store.List(schedulesKind, func(id string, data []byte) error {
+		var s Schedule
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if err := s.compile(); err != nil {
+			log.Errorf("Could not load schedule %s: %s", id, err)
+			return nil
+		}
+		s.catchUp(now, t.rand)
+		t.schedules[s.ID] = &s
+		return nil
+	})
+
+	for _, s := range t.schedules {
+		t.save(s)
+	}
+
+	t.notify()
+	return err
+}
+
+// put adds or replaces a schedule and plans its next run after now.
+func (t *scheduleTable) put(s *Schedule, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.plan(now, t.rand)
+	t.schedules[s.ID] = s
+	t.save(s)
+	t.notify()
+}
+
+// get returns a copy of a schedule.
+func (t *scheduleTable) get(id string) (Schedule, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.schedules[id]
+	if !ok {
+		return Schedule{}, false
+	}
+	return *s, true
+}
+
+// update applies fn to a schedule and saves the result.
+func (t *scheduleTable) update(id string, fn func(s *Schedule)) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.schedules[id]
+	if !ok {
+		return false
+	}
+	fn(s)
+	t.save(s)
+	return true
+}
+
+// remove deletes a schedule.
+func (t *scheduleTable) remove(id string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.schedules[id]; !ok {
+		return false, nil
+	}
+	if err := t.store.Delete(schedulesKind, id); err != nil {
+		return true, err
+	}
+	delete(t.schedules, id)
+	t.notify()
+	return true, nil
+}
+
+// list returns copies of all schedules sorted by name.
+func (t *scheduleTable) list() []Schedule {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	schedules := make([]Schedule, 0, len(t.schedules))
+	for _, s := range t.schedules {
+		schedules = append(schedules, *s)
+	}
+	sort.Slice(schedules, func(i, k int) bool {
+		if schedules[i].Name != schedules[k].Name {
+			return schedules[i].Name < schedules[k].Name
+		}
+		return schedules[i].ID < schedules[k].ID
+	})
+	return schedules
+}
+
+// due returns copies of the schedules whose next run is due and plans their
+// following run. It also returns how long to wait until the next run.
+func (t *scheduleTable) due(now time.Time) ([]Schedule, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var due []Schedule
+	wait := schedulerIdle
+
+	for _, s := range t.schedules {
+		if s.fireAt.IsZero() {
+			continue
+		}
+		if !s.fireAt.After(now) {
+			due = append(due, *s)
+			s.LastRun = s.NextRun
+			s.plan(now, t.rand)
+			t.save(s)
+		}
+		if !s.fireAt.IsZero() && s.fireAt.Sub(now) < wait {
+			wait = s.fireAt.Sub(now)
+		}
+	}
+
+	return due, wait
+}
+
+// runScheduler queues the jobs of schedules when they are due until the
+// schedule table is closed.
+func (c *Config) runScheduler() {
+	for {
+		due, wait := c.schedules.due(time.Now())
+		for _, s := range due {
+			c.runSchedule(s)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-c.schedules.wake:
+			timer.Stop()
+		case <-c.schedules.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// runSchedule queues the job of a schedule and records it in the schedule.
+func (c *Config) runSchedule(s Schedule) {
+	var jobID string
+
+	err := c.checkSecrets(&s.Job)
+	if err == nil {
+		var job *Job
+		job, _, err = c.queueJob(s.Job)
+		jobID = job.ID
+	}
+
+	if err != nil {
+		log.Errorf("Could not queue the job of schedule %s: %s", s.ID, err)
+	} else {
+		log.Infof("Schedule %s queued job %s", s.ID, jobID)
+	}
+
+	c.schedules.update(s.ID, func(s *Schedule) {
+		s.LastJob = jobID
+		s.LastError = ""
+		if err != nil {
+			s.LastError = err.Error()
+		}
+	})
+}
+
+// readSchedule reads and validates the schedule in a request body.
+func (c *Config) readSchedule(r *http.Request) (Schedule, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("Something went wrong with reading the schedule: %s", err)
+		return Schedule{}, errors.New("could not read request")
+	}
+
+	s, err := parseSchedule(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		return s, err
+	}
+
+	return s, c.checkSecrets(&s.Job)
+}
+
+// ListSchedules lists all schedules sorted by name.
+func (c *Config) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]interface{}{"schedules": c.schedules.list()})
+}
+
+// CreateSchedule adds a schedule from a JSON or YAML request.
+func (c *Config) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	s, err := c.readSchedule(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := time.Now()
+	s.ID = newJobID()
+	s.CreatedAt = now
+	s.UpdatedAt = now
+	s.NextRun, s.LastRun, s.LastJob, s.LastError, s.MissedRuns = nil, nil, "", "", 0
+
+	c.schedules.put(&s, now)
+
+	log.Infof("Created schedule %s (%s)", s.ID, s.Name)
+
+	respondJSON(w, http.StatusOK, s)
+}
+
+// GetSchedule serves a schedule.
+func (c *Config) GetSchedule(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+
+	s, ok := c.schedules.get(ps.ByName("id"))
+	if !ok {
+		respondError(w, http.StatusNotFound, "Schedule not found.")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, s)
+}
+
+// UpdateSchedule replaces the definition of a schedule, keeping its history.
+func (c *Config) UpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+	id := ps.ByName("id")
+
+	old, ok := c.schedules.get(id)
+	if !ok {
+		respondError(w, http.StatusNotFound, "Schedule not found.")
+		return
+	}
+
+	s, err := c.readSchedule(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := time.Now()
+	s.ID = id
+	s.CreatedAt = old.CreatedAt
+	s.UpdatedAt = now
+	s.LastRun, s.LastJob, s.LastError, s.MissedRuns = old.LastRun, old.LastJob, old.LastError, old.MissedRuns
+
+	c.schedules.put(&s, now)
+
+	log.Infof("Updated schedule %s (%s)", s.ID, s.Name)
+
+	respondJSON(w, http.StatusOK, s)
+}
+
+// DeleteSchedule removes a schedule. Jobs it already queued are kept.
+func (c *Config) DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	ps := httprouter.ParamsFromContext(r.Context())
+	id := ps.ByName("id")
+
+	ok, err := c.schedules.remove(id)
+	if err != nil {
+		log.Errorf("Could not remove schedule %s: %s", id, err)
+		respondError(w, http.StatusInternalServerError, "Could not remove schedule.")
+		return
+	}
+	if !ok {
+		respondError(w, http.StatusNotFound, "Schedule not found.")
+		return
+	}
+
+	log.Info("Removed schedule " + id)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{"message": "Schedule Removed", "id": id})
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// scheduleRequest sends a request to the schedule endpoints and decodes the
+// schedule in the response.
+func scheduleRequest(t *testing.T, config *Config, method, url, body string, want int) Schedule {
+	// Set up the request.
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != want {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, want, rr.Body.String())
+	}
+
+	var s Schedule
+	json.Unmarshal(rr.Body.Bytes(), &s)
+	return s
+}
+
+func TestScheduleCatchUp(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+	missed := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	skip := Schedule{Name: "nightly", Cron: "@hourly", Timezone: "UTC", Job: JobRequest{Commands: []string{"true"}}, NextRun: &missed}
+	if err := skip.compile(); err != nil {
+		t.Fatal(err)
+	}
+	skip.catchUp(now, rand.New(rand.NewSource(1)))
+
+	if skip.MissedRuns != 3 || !skip.NextRun.Equal(time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)) || !skip.fireAt.Equal(*skip.NextRun) {
+		t.Errorf("missed runs were not skipped: %+v", skip)
+	}
+
+	coalesce := Schedule{Name: "nightly", Cron: "@hourly", Timezone: "UTC", Missed: MissedCoalesce, Job: JobRequest{Commands: []string{"true"}}, NextRun: &missed}
+	if err := coalesce.compile(); err != nil {
+		t.Fatal(err)
+	}
+	coalesce.catchUp(now, rand.New(rand.NewSource(1)))
+
+	if coalesce.MissedRuns != 2 || !coalesce.NextRun.Equal(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)) || !coalesce.fireAt.Equal(now) {
+		t.Errorf("missed runs were not coalesced: %+v", coalesce)
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	tests := []string{
+		`{"cron": "@daily", "job": {"commands": ["ls"]}}`,
+		`{"name": "a", "cron": "@often", "job": {"commands": ["ls"]}}`,
+		`{"name": "a", "cron": "@daily", "timezone": "Mars/Olympus", "job": {"commands": ["ls"]}}`,
+		`{"name": "a", "cron": "@daily", "jitter": "-1m", "job": {"commands": ["ls"]}}`,
+		`{"name": "a", "cron": "@daily", "missed": "all", "job": {"commands": ["ls"]}}`,
+		`{"name": "a", "cron": "@daily", "job": {"commands": ["ls"], "needs": ["b"]}}`,
+	}
+
+	for _, body := range tests {
+		if _, err := parseSchedule("application/json", []byte(body)); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
+
+func TestScheduleCRUD(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	s := scheduleRequest(t, config, "POST", "/schedules", `{"name": "nightly", "cron": "0 3 * * *", "timezone": "America/New_York", "job": {"commands": ["make"]}}`, http.StatusOK)
+	if s.ID == "" || s.Job.Name != "nightly" || s.Missed != MissedSkip || s.NextRun == nil {
+		t.Fatalf("unexpected schedule: %+v", s)
+	}
+
+	ny, _ := time.LoadLocation("America/New_York")
+	if next := s.NextRun.In(ny); next.Hour() != 3 || next.Minute() != 0 {
+		t.Errorf("next run is not at 3:00 in New York: %s", next)
+	}
+
+	s = scheduleRequest(t, config, "PUT", "/schedules/"+s.ID, `{"name": "hourly", "cron": "@hourly", "job": {"commands": ["make"]}}`, http.StatusOK)
+	if s.Name != "hourly" || s.Cron != "@hourly" {
+		t.Errorf("schedule was not updated: %+v", s)
+	}
+
+	if got := scheduleRequest(t, config, "GET", "/schedules/"+s.ID, "", http.StatusOK); got.Name != "hourly" || !got.CreatedAt.Equal(s.CreatedAt) {
+		t.Errorf("unexpected schedule: %+v", got)
+	}
+
+	if got := config.schedules.list(); len(got) != 1 || got[0].ID != s.ID {
+		t.Errorf("unexpected schedules: %+v", got)
+	}
+
+	scheduleRequest(t, config, "POST", "/schedules", `{"name": "bad", "cron": "* * *", "job": {"commands": ["make"]}}`, http.StatusBadRequest)
+	scheduleRequest(t, config, "PUT", "/schedules/missing", `{"name": "hourly", "cron": "@hourly", "job": {"commands": ["make"]}}`, http.StatusNotFound)
+
+	scheduleRequest(t, config, "DELETE", "/schedules/"+s.ID, "", http.StatusOK)
+	scheduleRequest(t, config, "GET", "/schedules/"+s.ID, "", http.StatusNotFound)
+	scheduleRequest(t, config, "DELETE", "/schedules/"+s.ID, "", http.StatusNotFound)
+}
+
+func TestScheduleRun(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	s := scheduleRequest(t, config, "POST", "/schedules", `{"name": "nightly", "cron": "@daily", "job": {"commands": ["echo scheduled"]}}`, http.StatusOK)
+	next := *s.NextRun
+
+	// Pretend the next run is due.
+	config.schedules.update(s.ID, func(s *Schedule) { s.fireAt = time.Now() })
+	config.schedules.notify()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if s, _ = config.schedules.get(s.ID); s.LastJob != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("schedule did not queue a job")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if job := waitForJob(t, config, s.LastJob); job.State != StateSucceeded || job.Name != "nightly" {
+		t.Errorf("unexpected job: %+v", job)
+	}
+	if s.LastRun == nil || !s.LastRun.Equal(next) || s.NextRun.Before(next) {
+		t.Errorf("run was not recorded: %+v", s)
+	}
+}
+
+func TestRecoverSchedules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{
+		Workers:      1,
+		WorkersDir:   filepath.Join(dir, "worker"),
+		WorkspaceDir: filepath.Join(dir, "workspace"),
+		DBFile:       filepath.Join(dir, "conveyor.db"),
+	}
+
+	// Leave behind schedules that missed runs while the server was down.
+	store, err := openBoltStore(config.DBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missed := time.Now().Add(-3 * time.Hour)
+	store.Put(schedulesKind, "skip", &Schedule{ID: "skip", Name: "skip", Cron: "@hourly", Job: JobRequest{Commands: []string{"true"}}, NextRun: &missed})
+	store.Put(schedulesKind, "coalesce", &Schedule{ID: "coalesce", Name: "coalesce", Cron: "@hourly", Missed: MissedCoalesce, Job: JobRequest{Commands: []string{"true"}}, NextRun: &missed})
+	store.Close()
+
+	config.createDirs()
+	if err := config.setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer config.jobs.store.Close()
+	defer config.pool.Stop()
+	defer config.schedules.close()
+
+	if err := config.schedules.load(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if s, _ := config.schedules.get("coalesce"); s.LastJob != "" {
+			waitForJob(t, config, s.LastJob)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("missed runs were not coalesced")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if s, _ := config.schedules.get("skip"); s.LastJob != "" || s.MissedRuns < 3 || !s.NextRun.After(time.Now()) {
+		t.Errorf("missed runs were not skipped: %+v", s)
+	}
+	if jobs := config.jobs.list(); len(jobs) != 1 {
+		t.Errorf("unexpected number of jobs: got %d want 1", len(jobs))
+	}
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// maxSecretSize limits the size of a single secret value.
+const maxSecretSize = 64 << 10
+
+// secretsMagic starts every secret file. It is followed by the salt of the
+// key, the nonce and the encrypted secrets.
+const secretsMagic = "conveyor-secrets-v1\n"
+
+// Parameters of the scrypt key derivation and the salt it is given.
+const (
+	scryptN        = 1 << 15
+	scryptR        = 8
+	scryptP        = 1
+	secretsSaltLen = 16
+)
+
+var errSecretsLocked = errors.New("secret store is not configured")
+
+// secretStore keeps named secrets in a file encrypted with AES-GCM. The key
+// is derived from a passphrase that is never written to disk and the salt
+// kept in the file. The file is read again whenever it changes, so secrets
+// can be managed while the server is running.
+type secretStore struct {
+	mu         sync.Mutex
+	path       string
+	passphrase string
+	salt       []byte
+	aead       cipher.AEAD
+	info       os.FileInfo
+	secrets    map[string]string
+}
+
+// openSecretStore unlocks the secret file at path with the given passphrase.
+// The file is created on the first write if it does not exist yet.
+func openSecretStore(path, passphrase string) (*secretStore, error) {
+	s := &secretStore{path: path, passphrase: passphrase, secrets: make(map[string]string)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// unlock derives the key of the store from its passphrase and salt.
+func (s *secretStore) unlock(salt []byte) error {
+	key, err := scrypt.Key([]byte(s.passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	s.salt = salt
+	s.aead = aead
+	return nil
+}
+
+// load reads the secret file if it has changed since it was last read. A
+// missing file is an empty store with a new salt. The lock has to be held.
+func (s *secretStore) load() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.secrets = make(map[string]string)
+		s.info = nil
+		if s.aead != nil {
+			return nil
+		}
+		salt := make([]byte, secretsSaltLen)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return err
+		}
+		return s.unlock(salt)
+	} else if err != nil {
+		return err
+	}
+	// The file is always replaced, never written in place.
+	if s.info != nil && os.SameFile(info, s.info) && info.ModTime().Equal(s.info.ModTime()) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(b, []byte(secretsMagic)) {
+		return errors.New("not a secret file")
+	}
+	b = b[len(secretsMagic):]
+	if len(b) < secretsSaltLen {
+		return errors.New("secret file is too short")
+	}
+
+	if salt := b[:secretsSaltLen]; !bytes.Equal(salt, s.salt) {
+		if err := s.unlock(append([]byte{}, salt...)); err != nil {
+			return err
+		}
+	}
+	b = b[secretsSaltLen:]
+
+	if len(b) < s.aead.NonceSize() {
+		return errors.New("secret file is too short")
+	}
+	plain, err := s.aead.Open(nil, b[:s.aead.NonceSize()], b[s.aead.NonceSize():], nil)
+	if err != nil {
+		return errors.New("could not decrypt secret file, is the key right?")
+	}
+	secrets := make(map[string]string)
+	if err := json.Unmarshal(plain, &secrets); err != nil {
+		return err
+	}
+
+	s.secrets = secrets
+	s.info = info
+	return nil
+}
+
+// save encrypts the secrets and replaces the secret file. The lock has to be held.
+func (s *secretStore) save() error {
+	plain, err := json.Marshal(s.secrets)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".secrets")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	b := append([]byte(secretsMagic), s.salt...)
+	if _, err := tmp.Write(s.aead.Seal(append(b, nonce...), nonce, plain, nil)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// set stores a secret.
+func (s *secretStore) set(name, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	old, had := s.secrets[name]
+	s.secrets[name] = value
+	if err := s.save(); err != nil {
+		if had {
+			s.secrets[name] = old
+		} else {
+			delete(s.secrets, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// remove deletes a secret and reports whether it existed.
+func (s *secretStore) remove(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	old, ok := s.secrets[name]
+	if !ok {
+		return false, nil
+	}
+	delete(s.secrets, name)
+	if err := s.save(); err != nil {
+		s.secrets[name] = old
+		return true, err
+	}
+	return true, nil
+}
+
+// lookup returns the values of the named secrets as they are in the secret
+// file now.
+func (s *secretStore) lookup(names []string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(names))
+	for _, name := range names {
+		v, ok := s.secrets[name]
+		if !ok {
+			return nil, fmt.Errorf("secret %s does not exist", name)
+		}
+		values[name] = v
+	}
+	return values, nil
+}
+
+// names returns the names of all secrets in order.
+func (s *secretStore) names() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(s.secrets))
+	for name := range s.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// lookupSecrets returns the values of the secrets a job refers to.
+func (c *Config) lookupSecrets(names []string) (map[string]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	if c.secrets == nil {
+		return nil, errSecretsLocked
+	}
+	return c.secrets.lookup(names)
+}
+
+// checkSecrets makes sure that every secret a request and its jobs refer to exists.
+func (c *Config) checkSecrets(req *JobRequest) error {
+	if _, err := c.lookupSecrets(req.Secrets); err != nil {
+		return err
+	}
+	for i := range req.Jobs {
+		if err := c.checkSecrets(&req.Jobs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowedEnv returns the variables of the server environment that match the
+// allowlist. Entries ending in * match every variable with that prefix.
+func allowedEnv(environ, allow []string) []string {
+	var env []string
+	for _, kv := range environ {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if name == "CONVEYOR_SECRETS_KEY" {
+			continue
+		}
+		for _, a := range allow {
+			if name == a || (strings.HasSuffix(a, "*") && strings.HasPrefix(name, strings.TrimSuffix(a, "*"))) {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+	return env
+}
+
+// SecretNames returns the names of the secrets in the secret file at path,
+// unlocked with the given passphrase. Values are never returned.
+func SecretNames(path, passphrase string) ([]string, error) {
+	s, err := openSecretStore(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return s.names()
+}
+
+// SetSecret creates or replaces a secret in the secret file at path, which is
+// created if it does not exist yet.
+func SetSecret(path, passphrase, name, value string) error {
+	if !envName.MatchString(name) {
+		return errors.New("secret names have to be valid environment variable names")
+	}
+	if len(value) > maxSecretSize {
+		return fmt.Errorf("secrets cannot be larger than %d bytes", maxSecretSize)
+	}
+	s, err := openSecretStore(path, passphrase)
+	if err != nil {
+		return err
+	}
+	return s.set(name, value)
+}
+
+// RemoveSecret removes a secret from the secret file at path and reports
+// whether it existed.
+func RemoveSecret(path, passphrase, name string) (bool, error) {
+	s, err := openSecretStore(path, passphrase)
+	if err != nil {
+		return false, err
+	}
+	return s.remove(name)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "conveyor.secrets")
+
+	store, err := openSecretStore(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.set("DEPLOY_TOKEN", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The value must not be readable from the file.
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("hunter2")) || bytes.Contains(b, []byte("DEPLOY_TOKEN")) {
+		t.Errorf("secret file is not encrypted: %q", b)
+	}
+
+	store, err = openSecretStore(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := store.lookup([]string{"DEPLOY_TOKEN"})
+	if err != nil || values["DEPLOY_TOKEN"] != "hunter2" {
+		t.Errorf("secret was not stored: %v %v", values, err)
+	}
+
+	if _, err := openSecretStore(path, "wrong"); err == nil {
+		t.Error("secret file could be opened with the wrong key")
+	}
+
+	// Every file gets a salt of its own, which is kept in its header.
+	other := filepath.Join(dir, "other.secrets")
+	if err := SetSecret(other, "passphrase", "DEPLOY_TOKEN", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := ioutil.ReadFile(path)
+	o, _ := ioutil.ReadFile(other)
+	if !bytes.HasPrefix(a, []byte(secretsMagic)) {
+		t.Fatalf("secret file has no header: %q", a)
+	}
+	salt := func(b []byte) []byte { return b[len(secretsMagic) : len(secretsMagic)+secretsSaltLen] }
+	if bytes.Equal(salt(a), salt(o)) {
+		t.Error("secret files share a salt")
+	}
+}
+
+func TestSecretStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "conveyor.secrets")
+
+	store, err := openSecretStore(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Secrets managed offline are seen by a running server.
+	if err := SetSecret(path, "passphrase", "API_KEY", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if values, err := store.lookup([]string{"API_KEY"}); err != nil || values["API_KEY"] != "abc" {
+		t.Errorf("new secret was not loaded: %v %v", values, err)
+	}
+
+	if ok, err := RemoveSecret(path, "passphrase", "API_KEY"); !ok || err != nil {
+		t.Fatalf("could not remove secret: %v %v", ok, err)
+	}
+	if _, err := store.lookup([]string{"API_KEY"}); err == nil {
+		t.Error("removed secret can still be looked up")
+	}
+
+	if err := SetSecret(path, "passphrase", "not-valid", "abc"); err == nil {
+		t.Error("secret with an invalid name was stored")
+	}
+	if names, err := SecretNames(path, "passphrase"); err != nil || len(names) != 0 {
+		t.Errorf("unexpected secrets: %v %v", names, err)
+	}
+}
+
+func TestAllowedEnv(t *testing.T) {
+	environ := []string{"PATH=/bin", "HOME=/root", "LC_ALL=C", "AWS_SECRET_ACCESS_KEY=x", "CONVEYOR_SECRETS_KEY=y"}
+
+	got := allowedEnv(environ, []string{"PATH", "LC_*", "CONVEYOR_*"})
+
+	if strings.Join(got, " ") != "PATH=/bin LC_ALL=C" {
+		t.Errorf("unexpected environment: %v", got)
+	}
+}
+
+func TestJobEnvAndSecrets(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	os.Setenv("CONVEYOR_TEST_LEAK", "leaked")
+	defer os.Unsetenv("CONVEYOR_TEST_LEAK")
+
+	if err := config.secrets.set("DEPLOY_TOKEN", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	id := postJob(t, config, `{"name": "deploy", "env": {"TARGET": "prod"}, "secrets": ["DEPLOY_TOKEN"], "commands": ["echo \"$TARGET $DEPLOY_TOKEN ${CONVEYOR_TEST_LEAK:-clean}\" > env.txt"]}`)
+
+	if job := waitForJob(t, config, id); job.State != StateSucceeded {
+		t.Fatalf("job did not succeed: %+v", job)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(config.jobDir(1, id), "env.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "prod hunter2 clean\n" {
+		t.Errorf("unexpected job environment: %q", b)
+	}
+}
+
+func TestCreateJobUnknownSecret(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	// Set up the request.
+	req, err := http.NewRequest("POST", "/job", strings.NewReader(`{"name": "deploy", "secrets": ["MISSING"], "commands": ["true"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	config.RegisterRoutes().ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
@@ -6,27 +6,55 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"time"
 
+	"github.com/junland/conveyor/executor"
 	log "github.com/sirupsen/logrus"
 )
 
 // Config struct provides configuration fields for the server.
 type Config struct {
-	LogLvl       string
-	Access       bool
-	Port         string
-	PID          string
-	TLS          bool
-	Cert         string
-	Key          string
-	WorkspaceDir string
-	Workers      int
-	WorkersDir   string
+	LogLvl             string
+	Access             bool
+	Port               string
+	PID                string
+	TLS                bool
+	Cert               string
+	Key                string
+	WorkspaceDir       string
+	Workers            int
+	WorkersDir         string
+	DBFile             string
+	SecretsFile        string
+	SecretsKey         string
+	EnvAllow           []string
+	JobTimeout         time.Duration
+	HooksFile          string
+	PollersFile        string
+	ArtifactsDir       string
+	ArtifactRetention  time.Duration
+	CacheSize          int64
+	WorkspaceCleanup   string
+	WorkspaceRetention time.Duration
+	SandboxMounts      []string
+	Limits             Limits
+	CgroupDir          string
+	ImagesDir          string
+
+	jobs      *jobTable
+	pool      *executor.Pool
+	secrets   *secretStore
+	images    *imageStore
+	hooks     map[string]*Hook
+	schedules *scheduleTable
+	pollers   map[string]*poller
+	retries   *retryTimers
+	done      chan struct{}
 }
 
-var stop = make(chan os.Signal)
+var stop = make(chan os.Signal, 1)
 
 // Start sets up and starts the main server application
 func Start(c Config) error {
@@ -48,6 +76,108 @@ func Start(c Config) error {
 
 	log.Info("Setting up server...")
 
+	c.createDirs()
+
+	if err := c.setup(); err != nil {
+		log.Fatal("Could not set up server: ", err)
+	}
+
+	if err := c.loadHooks(); err != nil {
+		log.Fatal("Could not load webhooks: ", err)
+	}
+
+	if err := c.loadPollers(); err != nil {
+		log.Fatal("Could not load pollers: ", err)
+	}
+
+	c.recoverJobs()
+
+	if err := c.schedules.load(time.Now()); err != nil {
+		log.Error("Could not load schedules from job store: ", err)
+	}
+
+	c.startPollers()
+
+	go c.runArtifactSweeper()
+	go c.runWorkspaceCollector()
+
+	router := c.RegisterRoutes()
+
+	log.Debug("Setting up http logging...")
+
+	srv := &http.Server{Addr: ":" + c.Port, Handler: AccessLogger(router, c.Access)}
+
+	log.Debug("Starting server on port ", c.Port)
+
+	go func() {
+		if c.TLS == true {
+			err := srv.ListenAndServeTLS(c.Cert, c.Key)
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatal("ListenAndServeTLS: ", err)
+			}
+			return
+		}
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("ListenAndServe: ", err)
+		}
+	}()
+
+	p := CreatePID(c.PID)
+
+	signal.Notify(stop, os.Interrupt)
+
+	log.Info("Serving on port " + c.Port + ", press CTRL + C to shutdown.")
+
+	<-stop // wait for SIGINT
+
+	log.Warn("Shutting down server...")
+
+	p.RemovePID()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 45*time.Second) // shut down gracefully, but wait no longer than 45 seconds before halting.
+
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	c.stopJobs()
+
+	return nil
+}
+
+// stopJobs stops the scheduler and the running jobs and closes the job store.
+func (c *Config) stopJobs() {
+	c.schedules.close()
+	close(c.done)
+
+	// Retries that are already being submitted finish before the pool stops,
+	// so that they are not failed by it.
+	c.retries.stop()
+
+	log.Warn("Stopping running jobs...")
+
+	c.pool.Stop()
+
+	if err := c.jobs.store.Close(); err != nil {
+		log.Error("Could not close job store: ", err)
+	}
+}
+
+// stopping reports whether the server is shutting down.
+func (c *Config) stopping() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// createDirs creates the directories used by the workers if they do not exist yet.
+func (c *Config) createDirs() {
 	var w int
 
 	w = 1
@@ -78,46 +208,130 @@ func Start(c Config) error {
 		w = w + 1
 	}
 
-	router := c.RegisterRoutes()
+	if _, err := os.Stat(c.artifactDir()); os.IsNotExist(err) {
+		log.Info("Artifact directory does not exist. Creating...")
+		os.MkdirAll(c.artifactDir(), 0700)
+		log.Debug("Created " + c.artifactDir())
+	}
 
-	log.Debug("Setting up http logging...")
+	if _, err := os.Stat(c.cacheDir()); os.IsNotExist(err) {
+		log.Info("Cache directory does not exist. Creating...")
+		os.MkdirAll(c.cacheDir(), 0700)
+		log.Debug("Created " + c.cacheDir())
+	}
 
-	srv := &http.Server{Addr: ":" + c.Port, Handler: AccessLogger(router, c.Access)}
+	if _, err := os.Stat(c.imageDir()); os.IsNotExist(err) {
+		log.Info("Image directory does not exist. Creating...")
+		os.MkdirAll(c.imageDir(), 0700)
+		log.Debug("Created " + c.imageDir())
+	}
 
-	log.Debug("Starting server on port ", c.Port)
+	if _, err := os.Stat(c.logDir()); os.IsNotExist(err) {
+		log.Info("Log directory does not exist. Creating...")
+		os.MkdirAll(c.logDir(), 0700)
+		log.Debug("Created " + c.logDir())
+	}
+}
 
-	go func() {
-		if c.TLS == true {
-			err := srv.ListenAndServeTLS(c.Cert, c.Key)
-			if err != nil {
-				log.Fatal("ListenAndServeTLS: ", err)
-			}
+// setup opens the job store, creates the job and schedule tables and starts the
+// worker pool and the scheduler.
+// Without a database file jobs are only kept in memory. The secret store is
+// only available when a key is given.
+func (c *Config) setup() error {
+	if err := validateCleanup(c.WorkspaceCleanup); err != nil {
+		return err
+	}
+
+	if c.Limits != (Limits{}) {
+		if err := c.Limits.validate(); err != nil {
+			return err
 		}
-		err := srv.ListenAndServe()
+	}
+
+	if c.SecretsKey != "" {
+		log.Debug("Opening secret store " + c.SecretsFile)
+		secrets, err := openSecretStore(c.SecretsFile, c.SecretsKey)
 		if err != nil {
-			log.Fatal("ListenAndServe: ", err)
+			return fmt.Errorf("could not open secret store: %s", err)
 		}
-	}()
+		c.secrets = secrets
+	}
 
-	p := CreatePID(c.PID)
+	var store JobStore = newMemoryStore()
 
-	signal.Notify(stop, os.Interrupt)
+	if c.DBFile != "" {
+		log.Debug("Opening job store " + c.DBFile)
+		bs, err := openBoltStore(c.DBFile)
+		if err != nil {
+			return err
+		}
+		store = bs
+	}
 
-	log.Info("Serving on port " + c.Port + ", press CTRL + C to shutdown.")
+	c.jobs = newJobTable(store)
+	c.images = newImageStore(c.imageDir())
+	c.pool = executor.New(c.Workers, c.handleEvent)
+	if c.CgroupDir != "" {
+		log.Debug("Using cgroup " + c.CgroupDir)
+		if err := c.pool.UseCgroup(c.CgroupDir); err != nil {
+			c.pool.Stop()
+			return fmt.Errorf("could not use cgroup: %s", err)
+		}
+	}
+	c.schedules = newScheduleTable(store)
+	c.retries = newRetryTimers()
+	c.done = make(chan struct{})
 
-	<-stop // wait for SIGINT
+	go c.runScheduler()
 
-	log.Warn("Shutting down server...")
+	return nil
+}
 
-	p.RemovePID()
+// recoverJobs loads the jobs kept in the job store. Jobs that were running
+// when the server stopped are marked as interrupted and jobs that never
+// started are queued again.
+func (c *Config) recoverJobs() {
+	jobs, err := c.jobs.load()
+	if err != nil {
+		log.Error("Could not load jobs from job store: ", err)
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 45*time.Second) // shut down gracefully, but wait no longer than 45 seconds before halting.
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].QueuedAt.Before(jobs[k].QueuedAt) })
 
-	defer cancel()
+	var pipelines []string
 
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal(err)
+	for _, j := range jobs {
+		if j.isPipeline() {
+			if j.FinishedAt == nil {
+				pipelines = append(pipelines, j.ID)
+			}
+			continue
+		}
+
+		switch j.State {
+		case StateRunning:
+			log.Warnf("Job %s was interrupted", j.ID)
+			c.jobs.update(j.ID, func(j *Job) {
+				j.finish(StateInterrupted, -1)
+				j.ExitCode = nil
+			})
+		case StateQueued:
+			log.Infof("Queueing up job %s again", j.ID)
+			if len(j.Stages) == 0 {
+				// Jobs stored by older versions have no step status.
+				j.Stages = newStageStatus(j.Request.pipeline())
+				c.jobs.update(j.ID, func(job *Job) { job.Stages = j.Stages })
+			}
+			if _, err := c.submit(j); err != nil {
+				log.Errorf("Could not submit job %s: %s", j.ID, err)
+			}
+		}
 	}
 
-	return nil
+	// Pipelines pick up where they left off, jobs that needed an
+	// interrupted job are skipped.
+	for _, id := range pipelines {
+		c.schedulePipeline(id)
+	}
 }
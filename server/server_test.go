@@ -1,26 +1,95 @@
 package server
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
 func TestServerShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
 	config := Config{
 		LogLvl: "DEBUG",
 		Port:   "0",
-		PID:    "./test-server.pid",
+		PID:    filepath.Join(dir, "test-server.pid"),
 		TLS:    false,
 		Cert:   "",
 		Key:    "",
+		// The directories of the server are created next to these.
+		WorkersDir:   filepath.Join(dir, "worker"),
+		WorkspaceDir: filepath.Join(dir, "workspace"),
 	}
 
+	done := make(chan error, 1)
 	go func() {
-		Start(config)
+		done <- Start(config)
 	}()
 
 	time.Sleep(2 * time.Second)
 
 	stop <- os.Interrupt
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(60 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+
+	if _, err := os.Stat(config.PID); !os.IsNotExist(err) {
+		t.Errorf("pid file was not removed: %v", err)
+	}
+}
+
+func TestStopJobs(t *testing.T) {
+	config, _ := newTestConfig(t, 1)
+	defer os.RemoveAll(filepath.Dir(config.WorkersDir))
+
+	retry := postJob(t, config, `{"name": "flaky", "retry": {"attempts": 3, "backoff": "300ms"}, "commands": ["false"]}`)
+	pipeline := postPipeline(t, config, `
+name: release
+jobs:
+  - name: build
+    commands: ["sleep 30"]
+  - name: deploy
+    needs: [build]
+    commands: ["true"]
+`)
+
+	// Wait for the flaky job to wait for its retry and the build to run.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		job, _ := config.jobs.get(retry)
+		if job.Run == 2 && pipelineJobs(t, config, pipeline)["build"].State == StateRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("jobs did not start")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	config.stopJobs()
+	time.Sleep(500 * time.Millisecond)
+
+	// The jobs that did not get to run are left for the next start.
+	if job, _ := config.jobs.get(retry); job.State != StateQueued || len(job.Runs) != 1 {
+		t.Errorf("job waiting for its retry was run or finished: %+v", job)
+	}
+	jobs := pipelineJobs(t, config, pipeline)
+	if jobs["build"].State != StateInterrupted {
+		t.Errorf("running job was not interrupted: %+v", jobs["build"])
+	}
+	if jobs["deploy"].State != StatePending {
+		t.Errorf("job of the pipeline did not stay pending: %+v", jobs["deploy"])
+	}
 }
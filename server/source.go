@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var commitSHA = regexp.MustCompile(`^[0-9a-fA-F]{4,40}$`)
+
+// Source describes the repository a job builds.
+type Source struct {
+	// Repo is the URL or local path of a git repository.
+	Repo string `json:"repo" yaml:"repo"`
+	// Ref is the branch or tag to check out, the default branch if empty.
+	Ref string `json:"ref,omitempty" yaml:"ref,omitempty"`
+	// Commit pins the checkout to a commit, which has to be reachable from Ref.
+	Commit string `json:"commit,omitempty" yaml:"commit,omitempty"`
+	// Depth limits the history that is fetched, zero fetches all of it.
+	Depth int `json:"depth,omitempty" yaml:"depth,omitempty"`
+}
+
+// validate checks that the source can be checked out.
+func (s *Source) validate() error {
+	if s.Repo == "" {
+		return errors.New("source needs a repo")
+	}
+	// Nothing that could be mistaken for an option is handed to git.
+	if strings.HasPrefix(s.Repo, "-") || strings.HasPrefix(s.Ref, "-") {
+		return errors.New("source repo and ref cannot start with a dash")
+	}
+	if strings.ContainsAny(s.Ref, " \t\n") {
+		return errors.New("source ref cannot contain whitespace")
+	}
+	if s.Commit != "" && !commitSHA.MatchString(s.Commit) {
+		return errors.New("source commit has to be a commit SHA")
+	}
+	if s.Depth < 0 {
+		return errors.New("source depth cannot be negative")
+	}
+	return nil
+}
+
+// checkout fetches the source into dir, which is emptied first, and returns
+// the commit that was checked out. The output of git is written to out.
+func (s *Source) checkout(ctx context.Context, dir string, env []string, out io.Writer) (string, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	git := func(args ...string) error {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(append([]string{}, env...), "GIT_TERMINAL_PROMPT=0")
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("git %s: %s", args[0], err)
+		}
+		return nil
+	}
+
+	fetch := func(depth int, target string) error {
+		args := []string{"fetch", "--quiet", "--no-tags"}
+		if depth > 0 {
+			args = append(args, "--depth", strconv.Itoa(depth))
+		}
+		return git(append(args, "origin", target)...)
+	}
+
+	fmt.Fprintf(out, "Checking out %s\n", s.describe())
+
+	if err := git("init", "--quiet"); err != nil {
+		return "", err
+	}
+	if err := git("remote", "add", "origin", s.Repo); err != nil {
+		return "", err
+	}
+
+	ref := s.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	switch {
+	case s.Commit == "":
+		if err := fetch(s.Depth, ref); err != nil {
+			return "", err
+		}
+		if err := git("checkout", "--quiet", "--detach", "FETCH_HEAD"); err != nil {
+			return "", err
+		}
+	default:
+		// Not every server hands out commits by their SHA, so fall back to
+		// fetching the ref and looking for the commit in its history.
+		if err := fetch(s.Depth, s.Commit); err != nil {
+			log.Debugf("Could not fetch commit %s directly, fetching %s: %s", s.Commit, ref, err)
+			if err := fetch(0, ref); err != nil {
+				return "", err
+			}
+		}
+		if err := git("checkout", "--quiet", "--detach", s.Commit); err != nil {
+			return "", err
+		}
+	}
+
+	var sha bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = &sha
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git rev-parse: %s", err)
+	}
+
+	return strings.TrimSpace(sha.String()), nil
+}
+
+// describe returns a short description of what is checked out.
+func (s *Source) describe() string {
+	d := s.Repo
+	if s.Ref != "" {
+		d += " " + s.Ref
+	}
+	if s.Commit != "" {
+		d += " at " + s.Commit
+	}
+	return d
+}
+
+// checkoutSource checks out the source of a job and records the commit.
+// Checking out may take at most as long as the job may run.
+func (c *Config) checkoutSource(id string, req JobRequest, dir string, env []string, out io.Writer) (string, error) {
+	ctx := context.Background()
+	if timeout := c.timeout(req); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	started := time.Now()
+
+	commit, err := req.Source.checkout(ctx, dir, env, out)
+	if err != nil {
+		return "", fmt.Errorf("could not check out source: %s", err)
+	}
+
+	log.Infof("Checked out %s for job %s in %s", commit, id, time.Since(started))
+
+	c.jobs.update(id, func(j *Job) { j.Commit = commit })
+
+	return commit, nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testGit runs git in dir and returns its trimmed output.
+func testGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s: %s", args[0], err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// testCommit commits content as file.txt to the repository in dir and
+// returns the SHA of the commit.
+func testCommit(t *testing.T, dir, content string) string {
+	if err := ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte(content+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, dir, "add", "file.txt")
+	testGit(t, dir, "commit", "--quiet", "-m", content)
+	return testGit(t, dir, "rev-parse", "HEAD")
+}
+
+// newTestRepo creates a git repository with a commit for every content of
+// file.txt and returns its path and the SHAs of the commits.
+func newTestRepo(t *testing.T, contents ...string) (string, []string) {
+	dir, err := ioutil.TempDir("", "conveyor-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testGit(t, dir, "init", "--quiet")
+	testGit(t, dir, "checkout", "--quiet", "-b", "main")
+
+	var commits []string
+	for _, content := range contents {
+		commits = append(commits, testCommit(t, dir, content))
+	}
+
+	return dir, commits
+}
+
+func TestSourceInvalid(t *testing.T) {
+	tests := []string{
+		`{"name": "a", "commands": ["ls"], "source": {}}`,
+		`{"name": "a", "commands": ["ls"], "source": {"repo": "--upload-pack=touch /tmp/x"}}`,
+		`{"name": "a", "commands": ["ls"], "source": {"repo": "repo", "ref": "-x"}}`,
+		`{"name": "a", "commands": ["ls"], "source": {"repo": "repo", "commit": "main"}}`,
+		`{"name": "a", "commands": ["ls"], "source": {"repo": "repo", "depth": -1}}`,
+	}
+
+	for _, body := range tests {
+		if _, err := parseJobRequest("application/json", []byte(body)); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
+
+func TestSourceCheckout(t *testing.T) {
+	repo, commits := newTestRepo(t, "first", "second")
+	defer os.RemoveAll(repo)
+
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	tests := []struct {
+		source, content, commit string
+	}{
+		{`{"repo": "` + repo + `", "ref": "main"}`, "second", commits[1]},
+		{`{"repo": "file://` + repo + `", "depth": 1}`, "second", commits[1]},
+		{`{"repo": "file://` + repo + `", "ref": "main", "commit": "` + commits[0] + `", "depth": 1}`, "first", commits[0]},
+		{`{"repo": "` + repo + `", "commit": "` + commits[0][:10] + `"}`, "first", commits[0]},
+	}
+
+	for _, test := range tests {
+		id := postJob(t, config, `{"name": "build", "source": `+test.source+`, "commands": ["echo $CONVEYOR_COMMIT $(cat file.txt) > result.out"]}`)
+
+		job := waitForJob(t, config, id)
+		if job.State != StateSucceeded || job.Commit != test.commit {
+			t.Errorf("unexpected job for %s: %+v", test.source, job)
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(config.jobDir(1, id), "result.out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := test.commit + " " + test.content + "\n"; string(b) != want {
+			t.Errorf("unexpected checkout for %s: got %q want %q", test.source, b, want)
+		}
+	}
+}
+
+func TestSourceCheckoutFailure(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	id := postJob(t, config, `{"name": "build", "source": {"repo": "/does/not/exist"}, "commands": ["true"]}`)
+
+	job := waitForJob(t, config, id)
+	if job.State != StateFailed || !strings.Contains(job.Error, "could not check out source") {
+		t.Errorf("job did not fail to check out: %+v", job)
+	}
+}
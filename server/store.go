@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// JobStore persists jobs so that they survive a restart of the server.
+type JobStore interface {
+	// Save creates or replaces the stored copy of a job.
+	Save(j *Job) error
+	// Load returns every stored job.
+	Load() ([]*Job, error)
+	// Put creates or replaces a record of the given kind, such as a webhook
+	// delivery, that is kept alongside the jobs.
+	Put(kind, id string, v interface{}) error
+	// List calls fn with the JSON encoding of every record of a kind, data is
+	// only valid during the call.
+	List(kind string, fn func(id string, data []byte) error) error
+	// Delete removes a record.
+	Delete(kind, id string) error
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// memoryStore is a JobStore that only keeps jobs for the lifetime of the process.
+type memoryStore struct {
+	mu      sync.Mutex
+	jobs    map[string][]byte
+	records map[string]map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{jobs: make(map[string][]byte), records: make(map[string]map[string][]byte)}
+}
+
+// Save stores a copy of the job.
+func (s *memoryStore) Save(j *Job) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.ID] = b
+	return nil
+}
+
+// Load returns copies of every stored job.
+func (s *memoryStore) Load() ([]*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []*Job
+	for _, b := range s.jobs {
+		var j Job
+		if err := json.Unmarshal(b, &j); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &j)
+	}
+	return jobs, nil
+}
+
+// Put stores a copy of the record.
+func (s *memoryStore) Put(kind, id string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records[kind] == nil {
+		s.records[kind] = make(map[string][]byte)
+	}
+	s.records[kind][id] = b
+	return nil
+}
+
+// List calls fn with every stored record of a kind.
+func (s *memoryStore) List(kind string, fn func(id string, data []byte) error) error {
+	s.mu.Lock()
+	records := make(map[string][]byte, len(s.records[kind]))
+	for id, b := range s.records[kind] {
+		records[id] = b
+	}
+	s.mu.Unlock()
+
+	for id, b := range records {
+		if err := fn(id, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes a record.
+func (s *memoryStore) Delete(kind, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records[kind], id)
+	return nil
+}
+
+// Close does nothing for the memory store.
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+var jobsBucket = []byte("jobs")
+
+// boltStore is a JobStore that keeps jobs in an embedded BoltDB database.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBoltStore opens or creates the database at path.
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(jobsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// Save writes the job to the database.
+func (s *boltStore) Save(j *Job) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(j.ID), b)
+	})
+}
+
+// Load reads every job from the database.
+func (s *boltStore) Load() ([]*Job, error) {
+	var jobs []*Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var j Job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return err
+			}
+			jobs = append(jobs, &j)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// Put writes the record to the bucket of its kind, which is created on the
+// first write.
+func (s *boltStore) Put(kind, id string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), b)
+	})
+}
+
+// List reads every record of a kind from the database.
+func (s *boltStore) List(kind string, fn func(id string, data []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kind))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+// Delete removes a record from the database.
+func (s *boltStore) Delete(kind, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kind))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+// Close closes the database.
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
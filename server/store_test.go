@@ -0,0 +1,108 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := openBoltStore(filepath.Join(dir, "conveyor.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := &Job{ID: "abc123", Name: "frontend", Worker: 2, QueuedAt: time.Now(), Request: JobRequest{Name: "frontend", Commands: []string{"echo 1"}}}
+	job.setState(StateQueued, job.QueuedAt)
+	job.finish(StateFailed, 3)
+
+	if err := store.Save(job); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Close()
+
+	// Jobs have to be there after reopening the database.
+	store, err = openBoltStore(filepath.Join(dir, "conveyor.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	jobs, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 1 {
+		t.Fatalf("unexpected number of jobs: got %d want 1", len(jobs))
+	}
+
+	got := jobs[0]
+	if got.ID != "abc123" || got.State != StateFailed || got.Worker != 2 || *got.ExitCode != 3 || got.Request.Commands[0] != "echo 1" {
+		t.Errorf("job was not stored correctly: %+v", got)
+	}
+
+	if len(got.Transitions) != 2 || got.Transitions[0].State != StateQueued || got.Transitions[1].State != StateFailed {
+		t.Errorf("state transitions were not stored correctly: %+v", got.Transitions)
+	}
+}
+
+func TestRecoverJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{
+		Workers:      1,
+		WorkersDir:   filepath.Join(dir, "worker"),
+		WorkspaceDir: filepath.Join(dir, "workspace"),
+		DBFile:       filepath.Join(dir, "conveyor.db"),
+	}
+
+	// Leave behind a job that was running and one that never started.
+	store, err := openBoltStore(config.DBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Now()
+
+	running := &Job{ID: "running", Name: "frontend", Worker: 1, QueuedAt: started, StartedAt: &started}
+	running.setState(StateRunning, started)
+	store.Save(running)
+
+	queued := &Job{ID: "queued", Name: "frontend", QueuedAt: started, Request: JobRequest{Name: "frontend", Commands: []string{"echo 1"}}}
+	queued.setState(StateQueued, started)
+	store.Save(queued)
+
+	store.Close()
+
+	config.createDirs()
+	if err := config.setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer config.jobs.store.Close()
+	defer config.pool.Stop()
+	defer config.schedules.close()
+
+	config.recoverJobs()
+
+	if job, _ := config.jobs.get("running"); job.State != StateInterrupted || job.FinishedAt == nil {
+		t.Errorf("running job was not marked as interrupted: %+v", job)
+	}
+
+	if job := waitForJob(t, config, "queued"); job.State != StateSucceeded {
+		t.Errorf("queued job was not run: %+v", job)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobTimeout(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	config.JobTimeout = time.Hour
+
+	id := postJob(t, config, `{"name": "hang", "timeout": "200ms", "commands": ["echo start", "sleep 30"]}`)
+
+	job := waitForJob(t, config, id)
+	if job.State != StateTimedOut || job.Reason != "timed out after 200ms" {
+		t.Fatalf("job did not time out: %+v", job)
+	}
+
+	if d := job.FinishedAt.Sub(*job.StartedAt); d > 5*time.Second {
+		t.Errorf("job ran for too long: %s", d)
+	}
+
+	if step := job.Stages[0].Steps[0]; step.State != StateTimedOut {
+		t.Errorf("step was not marked as timed out: %+v", step)
+	}
+}
+
+func TestJobDefaultTimeout(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	config.JobTimeout = 200 * time.Millisecond
+
+	id := postJob(t, config, `{"name": "hang", "commands": ["sleep 30"]}`)
+
+	if job := waitForJob(t, config, id); job.State != StateTimedOut {
+		t.Fatalf("job did not time out: %+v", job)
+	}
+}
+
+func TestJobTimeoutInvalid(t *testing.T) {
+	for _, body := range []string{`{"name": "a", "timeout": 10, "commands": ["ls"]}`, `{"name": "a", "timeout": "soon", "commands": ["ls"]}`, `{"name": "a", "timeout": "-1s", "commands": ["ls"]}`} {
+		if _, err := parseJobRequest("application/json", []byte(body)); err == nil {
+			t.Errorf("expected an error for %s", body)
+		}
+	}
+}
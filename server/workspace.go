@@ -0,0 +1,165 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Policies for cleaning up the workspace of a job once it has finished.
+const (
+	CleanupAlways    = "always"
+	CleanupOnSuccess = "on_success"
+	CleanupNever     = "never"
+)
+
+// workspaceSweepInterval is how often workspaces that were left behind are
+// collected.
+const workspaceSweepInterval = 10 * time.Minute
+
+var jobIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// validateCleanup checks that a workspace cleanup policy is known.
+func validateCleanup(policy string) error {
+	switch policy {
+	case "", CleanupAlways, CleanupOnSuccess, CleanupNever:
+		return nil
+	}
+	return fmt.Errorf("cannot clean up workspaces %q, expected %s, %s or %s", policy, CleanupAlways, CleanupOnSuccess, CleanupNever)
+}
+
+// jobDir returns the workspace a job is run in on the given worker.
+func (c *Config) jobDir(worker int, id string) string {
+	return filepath.Join(c.WorkspaceDir+"_"+strconv.Itoa(worker), id)
+}
+
+// cleanup returns the cleanup policy of a job, the server wide default
+// unless the job asks for its own.
+func (c *Config) cleanup(req JobRequest) string {
+	if req.Cleanup != "" {
+		return req.Cleanup
+	}
+	if c.WorkspaceCleanup != "" {
+		return c.WorkspaceCleanup
+	}
+	return CleanupOnSuccess
+}
+
+// prepareWorkspace gives a run of a job an empty workspace on the worker
+// that picked it up and returns it.
+func (c *Config) prepareWorkspace(id string, worker int) (string, error) {
+	dir := c.jobDir(worker, id)
+
+	// An earlier run of the job may have been picked up by another worker.
+	if job, ok := c.jobs.get(id); ok && job.Workspace != "" && job.Workspace != dir {
+		c.removeWorkspace(id, job.Workspace)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("could not create workspace: %s", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("could not create workspace: %s", err)
+	}
+
+	c.jobs.update(id, func(j *Job) { j.Workspace = dir })
+
+	return dir, nil
+}
+
+// cleanWorkspace removes the workspace of a job that has finished if its
+// cleanup policy asks for it.
+func (c *Config) cleanWorkspace(id string) {
+	job, ok := c.jobs.get(id)
+	if !ok || job.Workspace == "" {
+		return
+	}
+
+	switch c.cleanup(job.Request) {
+	case CleanupAlways:
+	case CleanupOnSuccess:
+		if job.State != StateSucceeded {
+			log.Infof("Keeping workspace of job %s at %s", id, job.Workspace)
+			return
+		}
+	default:
+		return
+	}
+
+	c.removeWorkspace(id, job.Workspace)
+}
+
+// removeWorkspace removes a workspace of a job.
+func (c *Config) removeWorkspace(id, dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		log.Errorf("Could not remove workspace %s of job %s: %s", dir, id, err)
+		return
+	}
+	c.jobs.update(id, func(j *Job) {
+		if j.Workspace == dir {
+			j.Workspace = ""
+		}
+	})
+}
+
+// collectWorkspaces removes the workspaces of jobs that finished longer ago
+// than the retention period, along with workspaces of jobs the server does
+// not know about.
+func (c *Config) collectWorkspaces(now time.Time) {
+	cutoff := now.Add(-c.WorkspaceRetention)
+
+	for w := 1; w <= c.Workers; w++ {
+		root := c.WorkspaceDir + "_" + strconv.Itoa(w)
+
+		entries, err := ioutil.ReadDir(root)
+		if err != nil {
+			log.Errorf("Could not read workspace directory %s: %s", root, err)
+			continue
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() || !jobIDPattern.MatchString(entry.Name()) {
+				continue
+			}
+
+			dir := filepath.Join(root, entry.Name())
+
+			job, ok := c.jobs.get(entry.Name())
+			switch {
+			case !ok:
+				log.Infof("Removing workspace %s of unknown job", dir)
+				if err := os.RemoveAll(dir); err != nil {
+					log.Errorf("Could not remove workspace %s: %s", dir, err)
+				}
+				continue
+			case job.FinishedAt == nil, c.WorkspaceRetention <= 0, job.FinishedAt.After(cutoff):
+				continue
+			}
+
+			log.Infof("Removing workspace %s of job %s", dir, job.ID)
+			c.removeWorkspace(job.ID, dir)
+		}
+	}
+}
+
+// runWorkspaceCollector collects workspaces regularly until the server stops.
+func (c *Config) runWorkspaceCollector() {
+	ticker := time.NewTicker(workspaceSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		c.collectWorkspaces(time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
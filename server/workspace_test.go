@@ -0,0 +1,102 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanupInvalid(t *testing.T) {
+	body := `{"name": "a", "commands": ["ls"], "cleanup": "sometimes"}`
+	if _, err := parseJobRequest("application/json", []byte(body)); err == nil {
+		t.Errorf("expected an error for %s", body)
+	}
+
+	config := &Config{WorkspaceCleanup: "sometimes"}
+	if err := config.setup(); err == nil {
+		t.Error("expected an error for an unknown default cleanup policy")
+	}
+}
+
+func TestWorkspaceIsolation(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	first := waitForJob(t, config, postJob(t, config, `{"name": "a", "commands": ["touch leftover"]}`))
+	second := waitForJob(t, config, postJob(t, config, `{"name": "b", "commands": ["test ! -e leftover", "test -z \"$(ls -A)\""]}`))
+
+	if second.State != StateSucceeded {
+		t.Errorf("job saw files of an earlier job: %+v", second)
+	}
+	if first.Workspace != config.jobDir(1, first.ID) || second.Workspace == first.Workspace {
+		t.Errorf("jobs did not get workspaces of their own: %s, %s", first.Workspace, second.Workspace)
+	}
+}
+
+func TestWorkspaceCleanup(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	config.WorkspaceCleanup = ""
+
+	tests := []struct {
+		body string
+		kept bool
+	}{
+		{`{"name": "a", "commands": ["true"]}`, false},
+		{`{"name": "a", "commands": ["false"]}`, true},
+		{`{"name": "a", "cleanup": "always", "commands": ["false"]}`, false},
+		{`{"name": "a", "cleanup": "never", "commands": ["true"]}`, true},
+	}
+
+	var ids []string
+	for _, test := range tests {
+		ids = append(ids, postJob(t, config, test.body))
+	}
+
+	// Workspaces are cleaned up before the worker picks up its next job.
+	waitForJob(t, config, postJob(t, config, `{"name": "last", "commands": ["true"]}`))
+
+	for i, test := range tests {
+		job, _ := config.jobs.get(ids[i])
+
+		_, err := os.Stat(config.jobDir(1, job.ID))
+		if kept := err == nil; kept != test.kept || (job.Workspace != "") != test.kept {
+			t.Errorf("unexpected workspace for %s: kept %v, got %v (%q)", test.body, test.kept, err, job.Workspace)
+		}
+	}
+}
+
+func TestCollectWorkspaces(t *testing.T) {
+	config, cleanup := newTestConfig(t, 1)
+	defer cleanup()
+
+	config.WorkspaceRetention = time.Hour
+
+	old := waitForJob(t, config, postJob(t, config, `{"name": "a", "commands": ["false"]}`))
+	recent := waitForJob(t, config, postJob(t, config, `{"name": "a", "commands": ["false"]}`))
+
+	finished := time.Now().Add(-2 * time.Hour)
+	config.jobs.update(old.ID, func(j *Job) { j.FinishedAt = &finished })
+
+	// Directories of jobs the server does not know about are removed, other
+	// files are left alone.
+	root := config.WorkspaceDir + "_1"
+	orphan := filepath.Join(root, "0123456789abcdef")
+	other := filepath.Join(root, "notes")
+	os.Mkdir(orphan, 0700)
+	os.Mkdir(other, 0700)
+
+	config.collectWorkspaces(time.Now())
+
+	for dir, kept := range map[string]bool{old.Workspace: false, recent.Workspace: true, orphan: false, other: true} {
+		if _, err := os.Stat(dir); (err == nil) != kept {
+			t.Errorf("unexpected state of %s: kept %v, got %v", dir, kept, err)
+		}
+	}
+
+	if job, _ := config.jobs.get(old.ID); job.Workspace != "" {
+		t.Errorf("removed workspace is still reported: %s", job.Workspace)
+	}
+}